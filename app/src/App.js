@@ -57,7 +57,7 @@ export default function App() {
   let teamcolumns = [
     {title: 'Team', field: 'team',editable: 'onAdd', defaultSort: 'desc'},
     {title: 'Password', field: 'password', sorting: false,
-      render: rowData => <p>{rowData.password.split('').map(() => '*')}</p>,
+      render: () => <p>****</p>,
       editComponent: props => (
         <TextField
           type="password"
@@ -96,6 +96,7 @@ export default function App() {
     hidden : !(appconfig && (appconfig.whatsapp))
     },
     {title: 'Admin', field: 'admin', hidden : !(appconfig && appconfig.admin),type: "boolean"},
+    {title: 'Accounts only', field: 'accountsonly', type: "boolean"},
     {title: 'QRCode', field: 'qrcode',editable: 'never',hidden : true},
     {title: 'Id', field: 'id', editable: 'never',hidden : true},
   ]
@@ -106,7 +107,7 @@ export default function App() {
     {title: 'Name', field: 'name'},
     {title: 'Username', field: 'user'},
     {title: 'Password', field: 'password', sorting: false,
-      render: rowData => <p>{rowData.password.split('').map(() => '*')}</p>,
+      render: () => <p>****</p>,
       editComponent: props => (
         <TextField
           type="password"
@@ -142,13 +143,15 @@ export default function App() {
         />)
     },
     {
-      title: 'Fallback', field: 'fallback', editable: 'onAdd',
+      title: 'Fallbacks', field: 'fallbacks', editable: 'onAdd',
+      render: rowData => (rowData.fallbacks || []).join(', '),
       editComponent: props => (
         <Autocomplete
+          multiple
           freeSolo
-          id="boats"
+          id="fallbacks"
           options={boats}
-          value={props.value}
+          value={props.value || []}
           renderInput={params => {
             return (
               <TextField
@@ -157,10 +160,13 @@ export default function App() {
               />
             );
           }}
-          onChange={e => { if (e) props.onChange(e.target.innerText) }}
-          onInputChange={e => { if (e) props.onChange(e.target.value) }}
+          onChange={(e, value) => { props.onChange(value) }}
         />)
     },
+    { title: 'Type', field: 'boattype', editable: 'onAdd' },
+    { title: 'Weight class', field: 'weightclass', editable: 'onAdd' },
+    { title: 'Location', field: 'location', editable: 'onAdd' },
+    { title: 'Booked', field: 'bookedboat', editable: 'never' },
     { title: 'Date', field: 'date', type: 'date', defaultSort: 'desc' },
     {
       title: 'Time', field: 'time', sorting: false,
@@ -204,12 +210,6 @@ export default function App() {
           value={props.value}
           onChange={(e, v) => {
             if (e && e.target && e.target.innerText) {
-              for (var i = 0; i < users.length; i++) {
-                if (users[i]["user"] === e.target.innerText.toUpperCase() &&
-                  props.rowData["password"] !== users[i]["password"]) {
-                  props.rowData["password"] = users[i]["password"]
-                }
-              }
               props.onChange(e.target.innerText)
             } else {
               props.onChange(v)
@@ -217,12 +217,6 @@ export default function App() {
           }}
           onInputChange={(e, v) => {
             if (e && e.target && e.target.value) {
-              for (var i = 0; i < users.length; i++) {
-                if (users[i]["user"] === e.target.value.toUpperCase() &&
-                  props.rowData["password"] !== users[i]["password"]) {
-                  props.rowData["password"] = users[i]["password"]
-                }
-              }
               props.onChange(e.target.value)
             } else {
               props.onChange(v)
@@ -237,7 +231,7 @@ export default function App() {
     },
     {
       title: 'Password', field: 'password', sorting: false,
-      render: rowData => <p>{rowData.password.split('').map(() => '*')}</p>,
+      render: () => <p>****</p>,
       editComponent: props => (
         <TextField
           type="password"
@@ -270,6 +264,8 @@ export default function App() {
         />)
     },
     { title: 'Repeat', field: 'repeat', sorting: false, initialEditValue: 0, type: 'numeric',  lookup: RepeatLookup },
+    { title: 'Recurrence', field: 'rrule', sorting: false },
+    { title: 'Except', field: 'exdates', sorting: false },
     { title: 'Message', field: 'message', editable: 'never', sorting: false},
     { title: 'UserComment', field: 'usercomment', type: 'boolean', hidden: true },
     { title: 'Id', field: 'id', hidden: true },
@@ -281,7 +277,13 @@ export default function App() {
         const booking = res.data;
         setFailure(false)
         setBooking(booking);
-      }).catch(reason => {setBooking([]);setFailure(true)})
+      }).catch(reason => {
+        //A expired or revoked session token needs a new login
+        if (reason.response && reason.response.status === 401 && header.headers) {
+          logout()
+          return
+        }
+        setBooking([]);setFailure(true)})
   }
 
   //Refresh the boat data
@@ -339,14 +341,12 @@ export default function App() {
     refreshWhatsAppTo()
   }
 
-  //Load the login Cookies
+  //Load the session token from the login Cookie
   const loginCookie =() =>{
-    var auth = Cookies.get('auth')
-    if (auth) {
+    var token = Cookies.get('auth')
+    if (token) {
       var h = header
-      h.auth = JSON.parse(atob(auth))
-      //Update the cookie to keep 7 days before login out
-      Cookies.set('auth', auth, { expires: 7 })
+      h.headers = {Authorization: `Bearer ${token}`}
       setHeader(h)
       refreshAll()
     }
@@ -355,10 +355,10 @@ export default function App() {
   //Login
   const logout = () => {
     var h = header
-    delete h.auth
+    delete h.headers
     Cookies.remove('auth')
-    //To logout some browser need invalid login
-   // axios.get(`${url}teams/`,{auth:{username: "invalid",password:"invalid"}})
+    //Remove the token cookie of the server
+    axios.post(`${url}logout`).catch(reason => {console.log(reason)})
     setHeader(h)
     setIserror(false)
     setErrorMessages([])
@@ -446,10 +446,9 @@ export default function App() {
     .then(res => {
       const data = res.data;
       if (data.status === "ok") {
-          var d = {username: team.value, password: pass.value}
           var h = header
-          h.auth = d
-          Cookies.set('auth', btoa(JSON.stringify(d)), { expires: 7 })
+          h.headers = {Authorization: `Bearer ${data.token}`}
+          Cookies.set('auth', data.token, { expires: new Date(data.expires * 1000) })
           setHeader(h)
           refreshAll()
       } else {
@@ -464,9 +463,6 @@ export default function App() {
    const handleTeamUpdate = (newData, oldData, resolve, reject) => {
     //validating the data inputs
     let errorList = []
-    if (!('password' in newData) || newData.password === "" || newData.password === null) {
-      errorList.push("Try Again, You didn't enter the Password field")
-    }
     if (!('team' in newData) || newData.team === "" || newData.team== null) {
       errorList.push("Try Again, You didn't enter the Team field")
     } 
@@ -485,7 +481,7 @@ export default function App() {
           resolve()
         })
         .catch(error => {
-          setErrorMessages(["Update failed! Server error"])
+          setErrorMessages([error.response && error.response.status === 400 ? String(error.response.data) : "Update failed! Server error"])
           setIserror(true)
           reject()
         })
@@ -555,9 +551,6 @@ export default function App() {
     const handleUserUpdate = (newData, oldData, resolve, reject) => {
     //validating the data inputs
     let errorList = []
-    if (!('password' in newData) || newData.password === "" || newData.password === null) {
-      errorList.push("Try Again, You didn't enter the Password field")
-    }
     if (!('user' in newData) || newData.user === "" || newData.user === null) {
       errorList.push("Try Again, You didn't enter the Username field")
     }
@@ -643,9 +636,6 @@ export default function App() {
   const handleRowUpdate = (newData, oldData, resolve, reject) => {
     //validating the data inputs
     let errorList = []
-    if (!('password' in newData) || newData.password === "" || newData.password === null) {
-      errorList.push("Try Again, You didn't enter the Password field")
-    }
     if (!('user' in newData) || newData.user === "" || newData.user == null) {
       errorList.push("Try Again, You didn't enter the User field")
     } else {
@@ -680,7 +670,13 @@ export default function App() {
           refreshWhatsAppTo()
         })
         .catch(error => {
-          setErrorMessages(["Update failed! Server error"])
+          if (error.response && error.response.status === 409) {
+            setErrorMessages(["Update failed! The booking has been changed, reload and try again"])
+          } else if (error.response && error.response.status === 502) {
+            setErrorMessages(["Update failed! " + String(error.response.data)])
+          } else {
+            setErrorMessages(["Update failed! Server error"])
+          }
           setIserror(true)
           reject()
         })
@@ -712,9 +708,6 @@ export default function App() {
   const handleRowAdd = (newData, resolve, reject) => {
     //validating the data inputs
     let errorList = []
-    if (!('password' in newData) || newData.password === "" || newData.password === null) {
-      errorList.push("Try Again, You didn't enter the Password field")
-    }
     if (!('user' in newData) || newData.user === "" || newData.user === null) {
       errorList.push("Try Again, You didn't enter the User field")
     } else {
@@ -765,7 +758,7 @@ export default function App() {
 
   const onIdle = () => {
     //Refresh data every minute
-    if ((appconfig && !appconfig.authRequired) || header.auth) {
+    if ((appconfig && !appconfig.authRequired) || header.headers) {
        idleTimer = setInterval(refreshBooking, 60000)
     }
   }
@@ -773,7 +766,7 @@ export default function App() {
   const onActive = () => {
     if (idleTimer !== 0) {
       clearInterval(idleTimer);
-      if ((appconfig && !appconfig.authRequired) || header.auth) {
+      if ((appconfig && !appconfig.authRequired) || header.headers) {
         refreshBooking()
         refreshUsers()
         refreshBoat()
@@ -1083,7 +1076,7 @@ export default function App() {
        <ActivityDetector activityEvents={customActivityEvents} enabled={true} timeout={30 * 1000} onIdle={refreshAppConfig} onActive={refreshAppConfig} />
       <div className="loading"><div className="lds-roller"><div></div><div></div><div></div><div></div><div></div><div></div><div></div><div></div></div></div>
      </div> :
-    (appconfig && appconfig.authRequired) && !('auth' in header) ? renderLogin :
+    (appconfig && appconfig.authRequired) && !('headers' in header) ? renderLogin :
       <div id="app" className="App" >
       {renderFailure}
       <StyledOffCanvas position = 'left' isOpen={isMenuOpen} onClose={() => setIsMenuOpen(false)} >
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxAuditBody = 1 << 20 //The maximum request body kept for the audit of a new item
+const robotActor = "robot"   //The actor of the actions of the robot
+
+// A entry of the append only audit log
+type AuditEntry struct {
+	Id     int64           `json:"id"`
+	Time   int64           `json:"time"`
+	Team   string          `json:"team"`
+	Actor  string          `json:"actor"` //The account, the team or the robot
+	Role   string          `json:"role,omitempty"`
+	Ip     string          `json:"ip,omitempty"`
+	Action string          `json:"action"` //The api call like PUT /data/booking/:id, or Book, Update, Cancel and WhatsApp
+	Target string          `json:"target"` //The changed item like booking/12, or the receiver of a message
+	Status int             `json:"status"` //The http status of a api call
+	Error  string          `json:"error,omitempty"`
+	Diff   json.RawMessage `json:"diff,omitempty"` //The changed fields as {"field":[before,after]}
+}
+
+// The fields never written to the audit log
+var auditRedacted = map[string]bool{"password": true, "secret": true, "token": true, "qrcode": true, "logs": true}
+
+// Readers of the items changed by the api, used for the before and after of the audit
+var auditSnapshots = map[string]func(id int64) interface{}{
+	"booking": func(id int64) interface{} {
+		if b, err := readBooking(db, id); err == nil {
+			return b
+		}
+		return nil
+	},
+	"users": func(id int64) interface{} {
+		if u, err := readUser(db, id); err == nil {
+			return u
+		}
+		return nil
+	},
+	"accounts": func(id int64) interface{} {
+		if a, err := readAccount(db, id); err == nil {
+			return a
+		}
+		return nil
+	},
+	"teams": func(id int64) interface{} {
+		for _, t := range readTeams() {
+			if t.Id == id {
+				return t
+			}
+		}
+		return nil
+	},
+	"groups": func(id int64) interface{} {
+		if g, err := readBookingGroup(db, id); err == nil {
+			return g
+		}
+		return nil
+	},
+	"notify": func(id int64) interface{} {
+		if n, err := readNotifyChannel(db, id); err == nil {
+			return n
+		}
+		return nil
+	},
+	"blackouts": func(id int64) interface{} {
+		if bo, err := readBlackout(db, id); err == nil {
+			return bo
+		}
+		return nil
+	},
+}
+
+// Convert the item to a map of fields without the redacted fields
+func auditFields(item interface{}) map[string]interface{} {
+	if item == nil {
+		return nil
+	}
+	var data []byte
+	if raw, ok := item.([]byte); ok {
+		data = raw
+	} else {
+		data, _ = json.Marshal(item)
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	for k := range fields {
+		if auditRedacted[strings.ToLower(k)] {
+			delete(fields, k)
+		}
+	}
+	return fields
+}
+
+// The changed fields of the item as {"field":[before,after]}, empty when nothing changed
+func auditDiff(before map[string]interface{}, after map[string]interface{}) json.RawMessage {
+	diff := map[string][2]interface{}{}
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			diff[k] = [2]interface{}{v, after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, ok := before[k]; !ok && v != nil {
+			diff[k] = [2]interface{}{nil, v}
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(diff)
+	return data
+}
+
+// Append the entry to the audit log
+func audit(a *AuditEntry) {
+	if a.Time == 0 {
+		a.Time = timeNow().Unix()
+	}
+	err := withTx(func(tx *sql.Tx) error {
+		_, err := insertAudit(tx, a)
+		return err
+	})
+	if err != nil {
+		log.WithField("action", a.Action).Error("Audit failed ", err)
+	}
+}
+
+// Middleware recording every POST, PUT and DELETE under /data with the before and after of the changed item
+func auditMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !strings.HasPrefix(req.URL.Path, "/data/") ||
+			(req.Method != http.MethodPost && req.Method != http.MethodPut && req.Method != http.MethodDelete) {
+			return next(c)
+		}
+		//The body is kept for a new item, it has no id to read it back
+		var body []byte
+		if req.Body != nil && req.Method == http.MethodPost {
+			body, _ = io.ReadAll(io.LimitReader(req.Body, maxAuditBody))
+			req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		}
+		kind := strings.Split(strings.TrimPrefix(req.URL.Path, "/data/"), "/")[0]
+		snapshot := auditSnapshots[kind]
+		id, idErr := strconv.ParseInt(c.Param("id"), 10, 64)
+		var before map[string]interface{}
+		if snapshot != nil && idErr == nil {
+			before = auditFields(snapshot(id))
+		}
+
+		err := next(c)
+
+		a := AuditEntry{Ip: c.RealIP(), Action: req.Method + " " + iif(c.Path(), req.URL.Path), Target: kind,
+			Status: c.Response().Status}
+		if err != nil {
+			a.Status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				a.Status = he.Code
+			}
+			a.Error = err.Error()
+		}
+		if idErr == nil {
+			a.Target += "/" + strconv.FormatInt(id, 10)
+		}
+		var after map[string]interface{}
+		if snapshot != nil && idErr == nil {
+			after = auditFields(snapshot(id))
+		} else if req.Method == http.MethodPost && len(body) > 0 {
+			after = auditFields(body)
+		}
+		a.Diff = auditDiff(before, after)
+		if p, ok := c.Get("team").(*Principal); ok {
+			a.Team, a.Actor, a.Role = p.Team, p.Actor(), p.Role.String()
+		} else if p, perr := getTeamByContext(c); perr == nil {
+			a.Team, a.Actor, a.Role = p.Team, p.Actor(), p.Role.String()
+		} else if login := auditFields(body); login != nil {
+			//A login, only the team and account of the request are known
+			a.Actor, _ = login["team"].(string)
+			if account, ok := login["account"].(string); ok && account != "" {
+				a.Actor += "/" + account
+			}
+		}
+		//The change is logged for the team of the item, a club admin can change other teams
+		for _, fields := range []map[string]interface{}{after, before} {
+			if team, ok := fields["team"].(string); ok && team != "" {
+				a.Team = team
+				break
+			}
+		}
+		audit(&a)
+		return err
+	}
+}
+
+// The MyFleetClient recording every reservation change and confirmation in my-fleet in the audit log
+type auditFleetClient struct {
+	next MyFleetClient
+}
+
+// The reservation fields of the booking compared in the audit
+func auditReservation(b *BookingInterface) map[string]interface{} {
+	fields := map[string]interface{}{"bookingid": b.BookingId, "boatid": b.BoatId}
+	if b.BookStart != 0 {
+		loc, _ := time.LoadLocation(timeZoneLoc)
+		fields["start"] = time.Unix(b.BookStart, 0).In(loc).Format(time.RFC3339)
+		fields["end"] = time.Unix(b.BookStart+b.BookDur*60, 0).In(loc).Format(time.RFC3339)
+	}
+	return fields
+}
+
+// Record the reservation change of the robot
+func (a auditFleetClient) record(action string, b *BookingInterface, before map[string]interface{}, err error) {
+	e := AuditEntry{Team: b.Team, Actor: robotActor, Action: action, Target: "booking/" + strconv.FormatInt(b.Id, 10),
+		Diff: auditDiff(before, auditReservation(b))}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	audit(&e)
+}
+
+func (a auditFleetClient) Session(booking *BookingInterface) error {
+	return a.next.Session(booking)
+}
+
+func (a auditFleetClient) Login(booking *BookingInterface) error {
+	return a.next.Login(booking)
+}
+
+func (a auditFleetClient) ListBoats(booking *BookingInterface) (BoatListStruct, error) {
+	return a.next.ListBoats(booking)
+}
+
+func (a auditFleetClient) Book(booking *BookingInterface, startTime int64, endTime int64) error {
+	before := auditReservation(booking)
+	err := a.next.Book(booking, startTime, endTime)
+	a.record("Book", booking, before, err)
+	return err
+}
+
+func (a auditFleetClient) Update(booking *BookingInterface, startTime int64, endTime int64) error {
+	before := auditReservation(booking)
+	err := a.next.Update(booking, startTime, endTime)
+	a.record("Update", booking, before, err)
+	return err
+}
+
+func (a auditFleetClient) Cancel(booking *BookingInterface) error {
+	before := auditReservation(booking)
+	err := a.next.Cancel(booking)
+	a.record("Cancel", booking, before, err)
+	return err
+}
+
+func (a auditFleetClient) Confirm(booking *BookingInterface) error {
+	before := auditReservation(booking)
+	err := a.next.Confirm(booking)
+	a.record("Confirm", booking, before, err)
+	return err
+}
+
+func (a auditFleetClient) Logout(booking *BookingInterface) error {
+	return a.next.Logout(booking)
+}
+
+// The api of the audit log, a team admin sees the own team and a club admin all teams
+func auditRoutes(g *echo.Group) {
+	g.GET("/audit", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		where := []string{"1 = 1"}
+		args := []interface{}{}
+		filter := teamFilter(team)
+		if filter == "" {
+			filter = c.QueryParam("team")
+		}
+		if filter != "" {
+			where = append(where, "team = ?")
+			args = append(args, filter)
+		}
+		for _, f := range []string{"actor", "action", "target"} {
+			if v := c.QueryParam(f); v != "" {
+				where = append(where, f+" LIKE ?")
+				args = append(args, "%"+v+"%")
+			}
+		}
+		for _, f := range []struct{ param, cond string }{{"from", "time >= ?"}, {"to", "time < ?"}} {
+			if v := c.QueryParam(f.param); v != "" {
+				t, err := parseAuditTime(v)
+				if err != nil {
+					return c.String(http.StatusBadRequest, "Invalid "+f.param+" "+v)
+				}
+				where = append(where, f.cond)
+				args = append(args, t.Unix())
+			}
+		}
+		limit, _ := strconv.Atoi(c.QueryParam("limit"))
+		if limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+		return c.JSON(http.StatusOK, readAudit(strings.Join(where, " AND "), limit, args...))
+	})
+}
+
+// Parse a RFC3339 time or a date in the time zone of the club
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestAuditConfirm(t *testing.T) {
+	openTestDB(t)
+	b := BookingInterface{Id: 7, Team: "t1", BookingId: "1001", BoatId: "4"}
+	for _, client := range []MyFleetClient{&replayFleetClient{}, &refusingFleetClient{}} {
+		auditFleetClient{next: client}.Confirm(&b)
+	}
+	rows, err := db.Query("SELECT action, target, error FROM audit ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var entries []string
+	for rows.Next() {
+		var action, target, e string
+		if err = rows.Scan(&action, &target, &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, action+" "+target+" "+e)
+	}
+	if len(entries) != 2 || entries[0] != "Confirm booking/7 " || entries[1] != "Confirm booking/7 refused" {
+		t.Fatalf("audit entries %q, expected a confirm and a refused confirm", entries)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var tokenLifetime int = 24 //The number of hours a session token is valid
+var tokenSecret []byte     //The secret used to sign session tokens
+const tokenCookie = "token"
+
+// The payload of a session token
+type tokenPayload struct {
+	TeamId    int64  `json:"t"`
+	AccountId int64  `json:"a,omitempty"` //The account, 0 when logged in with the team password
+	Expires   int64  `json:"e"`
+	Pwd       string `json:"p"` //Fingerprint of the password hash, a password change revokes the token
+}
+
+// Check if the stored password is already a hash
+func isPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// Hash a team password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Check the password against a stored hash
+func passwordHashMatches(hash string, password string) bool {
+	return isPasswordHash(hash) && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Check the password of the team, a plain text password is migrated to a hash on the first valid login
+func checkTeamPassword(t *TeamInterface, password string) bool {
+	if t.Password == "" || password == "" {
+		return false
+	}
+	if isPasswordHash(t.Password) {
+		return passwordHashMatches(t.Password, password)
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Password), []byte(password)) != 1 {
+		return false
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		return updateTeamPassword(tx, t.Id, hash)
+	})
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	t.Password = hash
+	log.WithFields(log.Fields{"team": t.Team}).Info("Migrated team password to hash")
+	return true
+}
+
+// Find the team by name and check the password, refused when the team only allows the accounts to login
+func authenticateTeam(name string, password string) (*TeamInterface, error) {
+	for i, t := range teams {
+		if t.Team == name && !t.Accounts && checkTeamPassword(&teams[i], password) {
+			return &teams[i], nil
+		}
+	}
+	return nil, errors.New("invalid team or password")
+}
+
+// Load the token secret from the environment or the database, a new one is created when not found
+func loadTokenSecret() error {
+	if secret := os.Getenv("TOKENSECRET"); secret != "" {
+		tokenSecret = []byte(secret)
+		return nil
+	}
+	return withTx(func(tx *sql.Tx) error {
+		secret, err := readSetting(tx, "tokensecret")
+		if err != nil {
+			return err
+		}
+		if secret == "" {
+			b := make([]byte, 32)
+			if _, err = rand.Read(b); err != nil {
+				return err
+			}
+			secret = hex.EncodeToString(b)
+			if err = writeSetting(tx, "tokensecret", secret); err != nil {
+				return err
+			}
+		}
+		tokenSecret = []byte(secret)
+		return nil
+	})
+}
+
+// The fingerprint of the stored password
+func passwordFingerprint(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Sign the payload of a token
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue a signed session token for the team or account
+func issueToken(p *Principal) (string, int64) {
+	expires := time.Now().Add(time.Duration(tokenLifetime) * time.Hour).Unix()
+	payload := tokenPayload{TeamId: p.Id, Expires: expires, Pwd: passwordFingerprint(p.Password)}
+	if p.Account != nil {
+		payload.AccountId, payload.Pwd = p.Account.Id, passwordFingerprint(p.Account.Password)
+	}
+	b, _ := json.Marshal(payload)
+	signed := base64.RawURLEncoding.EncodeToString(b)
+	return signed + "." + signToken(signed), expires
+}
+
+// Resolve the team and account of a session token
+func parseToken(token string) (*Principal, error) {
+	s := strings.Split(token, ".")
+	if len(s) != 2 || !hmac.Equal([]byte(s[1]), []byte(signToken(s[0]))) {
+		return nil, errors.New("invalid token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[0])
+	if err != nil {
+		return nil, err
+	}
+	var p tokenPayload
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p.Expires < time.Now().Unix() {
+		return nil, errors.New("token expired")
+	}
+	for i, t := range teams {
+		if t.Id != p.TeamId {
+			continue
+		}
+		if p.AccountId == 0 && !t.Accounts && p.Pwd == passwordFingerprint(t.Password) {
+			return teamPrincipal(&teams[i]), nil
+		}
+		if a, err := readAccount(db, p.AccountId); p.AccountId != 0 && err == nil && a.Team == t.Team &&
+			p.Pwd == passwordFingerprint(a.Password) {
+			return accountPrincipal(&teams[i], a), nil
+		}
+	}
+	return nil, errors.New("invalid token")
+}
+
+// Set the session token cookie
+func setTokenCookie(c echo.Context, token string, expires int64) {
+	c.SetCookie(&http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(expires, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Middleware allowing only authorized requests
+func teamAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if t, err := getTeamByContext(c); err != nil || !t.Has(RoleViewer) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Basic realm=Restricted")
+			return echo.ErrUnauthorized
+		}
+		return next(c)
+	}
+}
+
+// Remove the password material of the teams before sending them
+func publicTeams(list []TeamInterface) []TeamInterface {
+	result := make([]TeamInterface, len(list))
+	for i, t := range list {
+		t.Password = ""
+		result[i] = t
+	}
+	return result
+}
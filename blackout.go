@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// A period the club is closed for repeated bookings, like a regatta or winter maintenance
+type Blackout struct {
+	Id     int64  `db:"id" json:"id"`
+	Start  string `db:"startdate" json:"start"` //The first date yyyy-mm-dd
+	End    string `db:"enddate" json:"end"`     //The last date yyyy-mm-dd, inclusive
+	Reason string `db:"reason" json:"reason"`
+	Uid    string `db:"uid" json:"uid,omitempty"` //The uid of the imported calendar event
+}
+
+// Check the dates of the blackout
+func (bo *Blackout) validate() error {
+	bo.Start = shortDate(bo.Start)
+	bo.End = shortDate(iif(bo.End, bo.Start))
+	start, err := time.Parse(ruleDate, bo.Start)
+	if err != nil {
+		return errors.New("invalid start date " + bo.Start)
+	}
+	end, err := time.Parse(ruleDate, bo.End)
+	if err != nil || end.Before(start) {
+		return errors.New("invalid end date " + bo.End)
+	}
+	return nil
+}
+
+// Find the blackout of the date of the booking, only repeated bookings are suppressed
+func bookingBlackout(b *BookingInterface) *Blackout {
+	if rule, err := b.recurrence(); err != nil || rule == nil {
+		return nil
+	}
+	bo, err := readBlackoutAt(db, shortDate(b.Date))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Error(err)
+		}
+		return nil
+	}
+	return &bo
+}
+
+// Parse the date of a ics date property, the end of a all day event is exclusive
+func parseIcsDate(property string, value string, end bool) (string, error) {
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	if i := strings.Index(property, "TZID="); i >= 0 {
+		if l, err := time.LoadLocation(strings.Split(property[i+5:], ";")[0]); err == nil {
+			loc = l
+		}
+	}
+	var t time.Time
+	var err error
+	switch {
+	case len(value) == 8:
+		if t, err = time.ParseInLocation("20060102", value, loc); err == nil && end {
+			t = t.AddDate(0, 0, -1)
+		}
+	case strings.HasSuffix(value, "Z"):
+		if t, err = time.Parse("20060102T150405Z", value); err == nil {
+			t = t.In(loc)
+		}
+	default:
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+	}
+	if err != nil {
+		return "", errors.New("invalid date " + value)
+	}
+	//A event ending at midnight does not include that day
+	if end && len(value) > 8 && t.Hour() == 0 && t.Minute() == 0 {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t.Format(ruleDate), nil
+}
+
+// Parse the events of a ics calendar as blackouts
+func parseIcs(r io.Reader) ([]Blackout, error) {
+	var list []Blackout
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		//Unfold the continuation lines
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var event *Blackout
+	for _, line := range lines {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name := strings.ToUpper(strings.Split(kv[0], ";")[0])
+		var err error
+		switch {
+		case name == "BEGIN" && kv[1] == "VEVENT":
+			event = &Blackout{}
+		case event == nil:
+			continue
+		case name == "END" && kv[1] == "VEVENT":
+			if err = event.validate(); err != nil {
+				return nil, err
+			}
+			list = append(list, *event)
+			event = nil
+		case name == "DTSTART":
+			event.Start, err = parseIcsDate(kv[0], kv[1], false)
+		case name == "DTEND":
+			event.End, err = parseIcsDate(kv[0], kv[1], true)
+		case name == "SUMMARY":
+			event.Reason = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\\`, `\`).Replace(kv[1])
+		case name == "UID":
+			event.Uid = kv[1]
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// The api of the blackout calendar, only the club admin can change it
+func blackoutRoutes(g *echo.Group) {
+	g.GET("/blackouts", func(c echo.Context) error {
+		if _, err := getTeamByContext(c); err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		return c.JSON(http.StatusOK, readBlackouts())
+	})
+
+	g.POST("/blackouts", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.ClubAdmin() {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		bo := new(Blackout)
+		if err = c.Bind(bo); err != nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		if err = bo.validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			_, err := insertBlackout(tx, bo)
+			return err
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.WithFields(log.Fields{"start": bo.Start, "end": bo.End}).Info("Added blackout " + bo.Reason)
+		scheduler.Reload()
+		return c.JSON(http.StatusOK, readBlackouts())
+	})
+
+	g.PUT("/blackouts/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.ClubAdmin() {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		bo := new(Blackout)
+		if err = c.Bind(bo); err != nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		if err = bo.validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		current, err := readBlackout(db, id)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		bo.Id = current.Id
+		err = withTx(func(tx *sql.Tx) error {
+			return updateBlackout(tx, bo)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		scheduler.Reload()
+		return c.JSON(http.StatusOK, readBlackouts())
+	})
+
+	g.DELETE("/blackouts/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.ClubAdmin() {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		err = withTx(func(tx *sql.Tx) error {
+			return deleteBlackout(tx, id)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		scheduler.Reload()
+		return c.JSON(http.StatusOK, readBlackouts())
+	})
+
+	//Import the events of a ics calendar, events imported before are updated by their uid
+	g.POST("/blackouts/import", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.ClubAdmin() {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		var body io.Reader = c.Request().Body
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+			file, err := c.FormFile("file")
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Bad request.")
+			}
+			f, err := file.Open()
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Bad request.")
+			}
+			defer f.Close()
+			body = f
+		}
+		list, err := parseIcs(io.LimitReader(body, 4*1024*1024))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			for i := range list {
+				if err := upsertBlackout(tx, &list[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.Info("Imported ", len(list), " blackouts")
+		scheduler.Reload()
+		return c.JSON(http.StatusOK, readBlackouts())
+	})
+}
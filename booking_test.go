@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Start the api with the team t1 and a booked boat, returns the server and the stored booking
+func newTestApi(t *testing.T) (*echo.Echo, *BookingInterface) {
+	t.Helper()
+	openTestDB(t)
+	list, protect := teams, jsonProtect
+	t.Cleanup(func() { teams, jsonProtect = list, protect })
+	hash, err := hashPassword("team-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	team := TeamInterface{Team: "t1", Title: "Team 1", Password: hash}
+	b := &BookingInterface{Team: "t1", Name: "Lynx", Date: "2030-06-01", Time: "10:00", Duration: 60, Username: "U1",
+		Password: "secret", State: "Finished", BookingId: "1001", BoatId: "4", BookStart: 1906444800, BookDur: 60, BookedBoat: "Lynx"}
+	err = withTx(func(tx *sql.Tx) error {
+		if _, err := insertTeam(tx, &team, false); err != nil {
+			return err
+		}
+		_, err := insertBooking(tx, b, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	teams, jsonProtect = readTeams(), true
+	return newServer(), b
+}
+
+// Do a request as the team t1
+func apiRequest(t *testing.T, e *echo.Echo, method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.SetBasicAuth("t1", "team-pw")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// Read the booking from the database
+func readTestBooking(t *testing.T, id int64) *BookingInterface {
+	t.Helper()
+	b, err := readBooking(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The fleet client of the replay failing every cancel
+type failingCancelClient struct {
+	replayFleetClient
+	canceled []string
+}
+
+func (f *failingCancelClient) Cancel(booking *BookingInterface) error {
+	f.canceled = append(f.canceled, booking.BookingId)
+	return errors.New("my-fleet unavailable")
+}
+
+func TestPutKeepsReservation(t *testing.T) {
+	e, b := newTestApi(t)
+	//A row of the app read before the robot booked, without a version
+	body := `{"team":"t1","boat":"Lynx","date":"2030-06-01","time":"10:00","duration":60,"user":"U1","comment":"Changed",
+		"state":"","bookingid":"","boatid":"","bookstart":0,"bookdur":0,"retry":5,"next":1}`
+	if rec := apiRequest(t, e, http.MethodPut, "/data/booking/1", body, nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	got := readTestBooking(t, b.Id)
+	if got.Comment != "Changed" || got.BookingId != "1001" || got.BoatId != "4" || got.BookStart != b.BookStart ||
+		got.BookDur != 60 || got.BookedBoat != "Lynx" || got.Retry != 0 {
+		t.Fatalf("reservation not kept: %+v", got)
+	}
+	if got.Password != "secret" {
+		t.Fatal("password not kept")
+	}
+}
+
+func TestPutCancelsToUpdate(t *testing.T) {
+	e, b := newTestApi(t)
+	defer func(c MyFleetClient) { fleetClient = c }(fleetClient)
+	fleetClient = &replayFleetClient{}
+	body := `{"team":"t1","boat":"Lynx","date":"2030-06-02","time":"10:00","duration":60,"user":"U1","version":1}`
+	if rec := apiRequest(t, e, http.MethodPut, "/data/booking/1", body, nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	got := readTestBooking(t, b.Id)
+	if got.Date != "2030-06-02" || got.State != "" || got.BookingId != "" || got.BoatId != "" || got.BookStart != 0 ||
+		got.BookDur != 0 || got.BookedBoat != "" {
+		t.Fatalf("canceled reservation kept: %+v", got)
+	}
+	if l := got.Logs[len(got.Logs)-1]; !strings.HasPrefix(l.Log, "Canceled to update") {
+		t.Fatalf("log %q", l.Log)
+	}
+}
+
+func TestPutCancelFailure(t *testing.T) {
+	e, b := newTestApi(t)
+	defer func(c MyFleetClient) { fleetClient = c }(fleetClient)
+	client := &failingCancelClient{}
+	fleetClient = client
+	body := `{"team":"t1","boat":"Lynx","date":"2030-06-02","time":"10:00","duration":60,"user":"U1"}`
+	rec := apiRequest(t, e, http.MethodPut, "/data/booking/1", body, nil)
+	if rec.Code != http.StatusBadGateway || len(client.canceled) != 1 {
+		t.Fatalf("status %d after %d cancels: %s", rec.Code, len(client.canceled), rec.Body.String())
+	}
+	got := readTestBooking(t, b.Id)
+	if got.Date != "2030-06-01" || got.State != "Finished" || got.BookingId != "1001" {
+		t.Fatalf("booking changed by a failed cancel: %+v", got)
+	}
+}
+
+func TestPutConflictBeforeCancel(t *testing.T) {
+	e, b := newTestApi(t)
+	defer func(c MyFleetClient) { fleetClient = c }(fleetClient)
+	client := &failingCancelClient{}
+	fleetClient = client
+	body := `{"team":"t1","boat":"Lynx","date":"2030-06-02","time":"10:00","duration":60,"user":"U1"}`
+	rec := apiRequest(t, e, http.MethodPut, "/data/booking/1", body, map[string]string{"If-Match": `"7"`})
+	if rec.Code != http.StatusConflict || len(client.canceled) != 0 {
+		t.Fatalf("status %d after %d cancels", rec.Code, len(client.canceled))
+	}
+	if etag := rec.Header().Get("ETag"); etag != bookingETag(readTestBooking(t, b.Id)) {
+		t.Fatalf("conflict with ETag %s", etag)
+	}
+}
+
+func TestDeleteConflict(t *testing.T) {
+	e, b := newTestApi(t)
+	rec := apiRequest(t, e, http.MethodDelete, "/data/booking/1", "", map[string]string{"If-Match": `"7"`})
+	if rec.Code != http.StatusConflict || rec.Header().Get("ETag") != bookingETag(b) {
+		t.Fatalf("status %d with ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+	if got := readTestBooking(t, b.Id); got.State != "Finished" {
+		t.Fatalf("booking canceled with a stale version: %s", got.State)
+	}
+	rec = apiRequest(t, e, http.MethodDelete, "/data/booking/1", "", map[string]string{"If-Match": bookingETag(b)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d with the current version", rec.Code)
+	}
+}
+
+func TestMergeBooking(t *testing.T) {
+	base := BookingInterface{Id: 1, Version: 1, Comment: "base", State: "Finished", Message: "Booked", BookingId: "1001", BookStart: 100}
+	//The robot changed the state and the reservation
+	robot := base
+	robot.State, robot.Message, robot.BookingId, robot.BookStart = "Updated", "Moved", "2002", 200
+	//The api changed the comment, the state and a stale reservation in the meantime
+	current := base
+	current.Version, current.Comment, current.State, current.BookingId = 2, "api", "Cancel", ""
+	mergeBooking(&base, &robot, &current)
+	if robot.Comment != "api" || robot.State != "Cancel" {
+		t.Fatalf("api changes lost: %+v", robot)
+	}
+	if robot.BookingId != "2002" || robot.BookStart != 200 || robot.Message != "Moved" {
+		t.Fatalf("robot changes lost: %+v", robot)
+	}
+	if robot.Version != 2 {
+		t.Fatalf("version %d, expected the current version", robot.Version)
+	}
+}
+
+func TestSaveBookingConflict(t *testing.T) {
+	_, b := newTestApi(t)
+	orig := readTestBooking(t, b.Id)
+	robot := *orig
+	robot.State, robot.BookingId, robot.BookStart = "Updated", "2002", orig.BookStart+1800
+	//The api changes the booking while the robot is processing it
+	api := readTestBooking(t, b.Id)
+	api.Comment, api.BookingId = "By api", ""
+	if err := withTx(func(tx *sql.Tx) error { return updateBooking(tx, api) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBooking(orig, &robot, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestBooking(t, b.Id)
+	if got.Comment != "By api" || got.State != "Updated" || got.BookingId != "2002" || got.BookStart != orig.BookStart+1800 {
+		t.Fatalf("merged booking %+v", got)
+	}
+	if got.Version != orig.Version+2 {
+		t.Fatalf("version %d, expected %d", got.Version, orig.Version+2)
+	}
+}
+
+func TestSaveBookingKeepsApiCancel(t *testing.T) {
+	e, b := newTestApi(t)
+	orig := readTestBooking(t, b.Id)
+	//The robot moves the reservation while the user cancels the booking by the api
+	robot := *orig
+	robot.State, robot.Message, robot.BookStart = "Updated", "Moved", orig.BookStart+1800
+	if rec := apiRequest(t, e, http.MethodDelete, "/data/booking/1", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := saveBooking(orig, &robot, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestBooking(t, b.Id)
+	if got.State != "Cancel" || got.BookingId != "1001" || got.BookStart != orig.BookStart+1800 {
+		t.Fatalf("api cancel lost: state %s, reservation %s at %d", got.State, got.BookingId, got.BookStart)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The clock used for every time decision of the booking logic
+type Clock interface {
+	Now() time.Time
+}
+
+// The system clock, shifted by the offset
+type systemClock struct {
+	offset time.Duration
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+// A clock that only moves when it is set or advanced, used by the replay
+type FakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// Create a fake clock standing still at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Set the time of the fake clock
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+// Advance the fake clock by the duration
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var clock Clock = systemClock{} //The clock of the booking logic
+var timeShift string = ""       //Run at a shifted time, a duration like 36h or a RFC3339 time to start at
+
+// The current time of the clock
+func timeNow() time.Time {
+	return clock.Now()
+}
+
+// Shift the system clock by a duration or to the given start time
+func setTimeShift(shift string) error {
+	if shift == "" {
+		clock = systemClock{}
+		return nil
+	}
+	if d, err := time.ParseDuration(shift); err == nil {
+		clock = systemClock{offset: d}
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, shift); err == nil {
+		clock = systemClock{offset: time.Until(t)}
+		return nil
+	}
+	return errors.New("invalid time shift " + shift + ", use a duration like 36h or a time like 2006-01-02T15:04:05+01:00")
+}
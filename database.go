@@ -0,0 +1,1155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The schema migrations, every entry is one version and is executed only once in order
+var migrations = []string{
+	//1: Initial tables replacing the json files
+	`CREATE TABLE teams (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL UNIQUE,
+		admin BOOLEAN NOT NULL DEFAULT FALSE,
+		password TEXT NOT NULL DEFAULT '',
+		title TEXT NOT NULL DEFAULT '',
+		addtime BOOLEAN NOT NULL DEFAULT FALSE,
+		whatsapp BOOLEAN NOT NULL DEFAULT FALSE,
+		whatsappid TEXT NOT NULL DEFAULT '',
+		whatsappto TEXT NOT NULL DEFAULT '',
+		prefix TEXT NOT NULL DEFAULT '',
+		planner BOOLEAN NOT NULL DEFAULT FALSE
+	);
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		username TEXT NOT NULL,
+		password TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		lastused BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX users_team ON users (team);
+	CREATE TABLE whatsappto (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		msgto TEXT NOT NULL,
+		lastused BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX whatsappto_team ON whatsappto (team);
+	CREATE TABLE bookings (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		boat TEXT NOT NULL DEFAULT '',
+		fallback TEXT NOT NULL DEFAULT '',
+		date TEXT NOT NULL DEFAULT '',
+		time TEXT NOT NULL DEFAULT '',
+		duration BIGINT NOT NULL DEFAULT 0,
+		username TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		comment TEXT NOT NULL DEFAULT '',
+		repeat INTEGER NOT NULL DEFAULT 0,
+		state TEXT NOT NULL DEFAULT '',
+		bookingid TEXT NOT NULL DEFAULT '',
+		boatid TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		epochnext BIGINT NOT NULL DEFAULT 0,
+		retrycounter INTEGER NOT NULL DEFAULT 0,
+		usercomment BOOLEAN NOT NULL DEFAULT FALSE,
+		whatsapp TEXT NOT NULL DEFAULT '',
+		bookstart BIGINT NOT NULL DEFAULT 0,
+		bookdur BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX bookings_team ON bookings (team);
+	CREATE TABLE booking_logs (
+		id INTEGER PRIMARY KEY,
+		booking INTEGER NOT NULL REFERENCES bookings (id) ON DELETE CASCADE,
+		date BIGINT NOT NULL,
+		state TEXT NOT NULL DEFAULT '',
+		log TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX booking_logs_booking ON booking_logs (booking);`,
+	//2: Settings of the application, like the token secret
+	`CREATE TABLE settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL DEFAULT ''
+	);`,
+	//3: Notification channels per team and the delivery attempts
+	`CREATE TABLE notify_channels (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		type TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		secret TEXT NOT NULL DEFAULT '',
+		states TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL DEFAULT TRUE
+	);
+	CREATE INDEX notify_channels_team ON notify_channels (team);
+	CREATE TABLE notify_deliveries (
+		id INTEGER PRIMARY KEY,
+		channel INTEGER NOT NULL DEFAULT 0,
+		team TEXT NOT NULL,
+		type TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'Pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lasterror TEXT NOT NULL DEFAULT '',
+		created BIGINT NOT NULL,
+		next BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX notify_deliveries_status ON notify_deliveries (status, next);
+	CREATE INDEX notify_deliveries_team ON notify_deliveries (team);`,
+	//4: The fallback column holds a ordered list, the boat actually booked is kept separate
+	`ALTER TABLE bookings ADD COLUMN bookedboat TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN fallbackindex INTEGER NOT NULL DEFAULT 0;`,
+	//5: Book any boat matching the type, weight class and location
+	`ALTER TABLE bookings ADD COLUMN boattype TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN weightclass TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN location TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN permissions TEXT NOT NULL DEFAULT '';`,
+	//6: Booking groups, the boats of a training session booked together
+	`CREATE TABLE booking_groups (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		minimum INTEGER NOT NULL DEFAULT 0,
+		state TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX booking_groups_team ON booking_groups (team);
+	ALTER TABLE bookings ADD COLUMN groupid INTEGER NOT NULL DEFAULT 0;`,
+	//7: Recurrence rules with exception dates
+	`ALTER TABLE bookings ADD COLUMN rrule TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN exdates TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bookings ADD COLUMN repeatstart TEXT NOT NULL DEFAULT '';`,
+	//8: The club wide blackout calendar
+	`CREATE TABLE blackouts (
+		id INTEGER PRIMARY KEY,
+		startdate TEXT NOT NULL,
+		enddate TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		uid TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX blackouts_dates ON blackouts (startdate, enddate);`,
+	//9: Individual accounts with a role within the team
+	`CREATE TABLE accounts (
+		id INTEGER PRIMARY KEY,
+		team TEXT NOT NULL,
+		username TEXT NOT NULL,
+		password TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		role TEXT NOT NULL DEFAULT 'viewer',
+		UNIQUE (team, username)
+	);`,
+	//10: The append only audit log of the api mutations and robot actions
+	`CREATE TABLE audit (
+		id INTEGER PRIMARY KEY,
+		time BIGINT NOT NULL,
+		team TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL DEFAULT '',
+		role TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL DEFAULT '',
+		target TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		diff TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_time ON audit (time);
+	CREATE INDEX audit_team ON audit (team, time);`,
+	//11: Version of the booking, increased by every update
+	`ALTER TABLE bookings ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+	//12: Login of the team by the accounts only
+	`ALTER TABLE teams ADD COLUMN accountsonly BOOLEAN NOT NULL DEFAULT FALSE;`,
+}
+
+// The columns of the tables, in the order used by the scan functions
+const teamColumns = "id, team, admin, password, title, addtime, whatsapp, whatsappid, whatsappto, prefix, planner, accountsonly"
+const userColumns = "id, team, username, password, name, lastused"
+const accountColumns = "id, team, username, password, name, role"
+const auditColumns = "id, time, team, actor, role, ip, action, target, status, error, diff"
+const whatsAppToColumns = "team, msgto, lastused"
+const notifyChannelColumns = "id, team, type, target, secret, states, enabled"
+const bookingGroupColumns = "id, team, name, minimum, state, message"
+const blackoutColumns = "id, startdate, enddate, reason, uid"
+const notifyDeliveryColumns = "id, channel, team, type, target, state, message, body, status, attempts, lasterror, created, next"
+const bookingColumns = "id, team, boat, fallback, date, time, duration, username, password, comment, repeat, state, " +
+	"bookingid, boatid, message, epochnext, retrycounter, usercomment, whatsapp, bookstart, bookdur, bookedboat, fallbackindex, " +
+	"boattype, weightclass, location, permissions, groupid, rrule, exdates, repeatstart, version"
+
+// The booking has been changed or deleted since it was read
+var errBookingConflict = errors.New("the booking has been changed")
+
+// Interface implemented by sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Interface implemented by sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Insert a row of the table, a nil id is assigned by the database. The columns start with the id
+func insertRow(tx execer, table string, columns string, id interface{}, values ...interface{}) (int64, error) {
+	if id == nil {
+		columns = strings.TrimPrefix(columns, "id, ")
+	} else {
+		values = append([]interface{}{id}, values...)
+	}
+	query := "INSERT INTO " + table + " (" + columns + ") VALUES (?" + strings.Repeat(", ?", len(values)-1) + ")"
+	if id == nil {
+		return storage.InsertId(tx, query, values...)
+	}
+	if _, err := tx.Exec(query, values...); err != nil {
+		return 0, err
+	}
+	return id.(int64), storage.SyncIds(tx, table)
+}
+
+// Run the function within a transaction, commit on success and rollback on error
+func withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Upgrade the database schema by running all migrations not yet applied
+func Upgrade() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, app TEXT NOT NULL, applied BIGINT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	var version int
+	if err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		err = withTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(storage.Migration(migrations[i])); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_version (version, app, applied) VALUES (?, ?, ?)",
+				i+1, AppVersion, timeNow().Unix())
+			return err
+		})
+		if err != nil {
+			return errors.New("migration " + strconv.Itoa(i+1) + " failed: " + err.Error())
+		}
+		log.Info("Database upgraded to version ", i+1)
+	}
+	//Remove the old version file, the version is now kept in the database
+	os.Remove(versionFile)
+	return importJsonFiles()
+}
+
+// Read a json file into data, returns false if the file does not exists
+func readJsonFile(fileName string, data interface{}) (bool, error) {
+	file, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(file, data)
+}
+
+// One time import of the json files used before the database, imported files are renamed
+func importJsonFiles() error {
+	var teamData []TeamInterface
+	var userData []UserInterface
+	var whatsAppData []WhatsAppToInterface
+	var bookingData BookingSlice
+	files := map[string]interface{}{teamFile: &teamData, userFile: &userData, whatsAppFile: &whatsAppData, bookingFile: &bookingData}
+	found := []string{}
+	for fileName, data := range files {
+		exists, err := readJsonFile(fileName, data)
+		if err != nil {
+			log.WithField("file", fileName).Error("Import failed ", err)
+			continue
+		}
+		if exists {
+			found = append(found, fileName)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	err := withTx(func(tx *sql.Tx) error {
+		teamNames := map[string]bool{}
+		for _, t := range teamData {
+			if teamNames[t.Team] {
+				continue
+			}
+			teamNames[t.Team] = true
+			if _, err := insertTeam(tx, &t, true); err != nil {
+				return err
+			}
+		}
+		for _, u := range userData {
+			if u.Username == "?" {
+				continue
+			}
+			if _, err := insertUser(tx, &u, true); err != nil {
+				return err
+			}
+		}
+		for _, w := range whatsAppData {
+			if w.To == "?" {
+				continue
+			}
+			if _, err := tx.Exec("INSERT INTO whatsappto ("+whatsAppToColumns+") VALUES (?, ?, ?)", w.Team, w.To, w.LastUsed); err != nil {
+				return err
+			}
+		}
+		for _, b := range bookingData {
+			b.normalizeFallbacks()
+			if _, err := insertBooking(tx, &b, true); err != nil {
+				return err
+			}
+			for _, l := range b.Logs {
+				if err := insertBookingLog(tx, b.Id, l); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fileName := range found {
+		os.Rename(fileName, fileName+".imported")
+		log.WithField("file", fileName).Info("Imported json file into database")
+	}
+	return nil
+}
+
+// Scan a team row
+func scanTeam(row scanner) (TeamInterface, error) {
+	var t TeamInterface
+	err := row.Scan(&t.Id, &t.Team, &t.Admin, &t.Password, &t.Title, &t.AddTime, &t.WhatsApp, &t.WhatsAppId,
+		&t.WhatsAppTo, &t.Prefix, &t.Planner, &t.Accounts)
+	return t, err
+}
+
+// Create or update the admin team of JSONTEAM and JSONPWD at startup, changing JSONPWD resets its password and
+// turns the team password login on again
+func upsertEnvTeam() error {
+	return withTx(func(tx *sql.Tx) error {
+		t, err := scanTeam(tx.QueryRow("SELECT "+teamColumns+" FROM teams WHERE team = ?", jsonTeam))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		found := err == nil
+		if found && t.Admin && passwordHashMatches(t.Password, jsonPwd) {
+			return nil
+		}
+		hash, err := hashPassword(jsonPwd)
+		if err != nil {
+			return err
+		}
+		if !found {
+			t = TeamInterface{Team: jsonTeam, Admin: true, Password: hash, Title: title, Prefix: commentPrefix}
+			_, err = insertTeam(tx, &t, false)
+			return err
+		}
+		t.Admin, t.Password, t.Accounts = true, hash, false
+		log.WithField("team", t.Team).Info("Admin team password set from the environment")
+		return updateTeam(tx, &t)
+	})
+}
+
+// Read all teams
+func readTeams() []TeamInterface {
+	var b []TeamInterface
+	rows, err := db.Query("SELECT " + teamColumns + " FROM teams ORDER BY id")
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTeam(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, t)
+	}
+	return b
+}
+
+// Insert a team, the id is only used when keepId is set
+func insertTeam(tx execer, t *TeamInterface, keepId bool) (int64, error) {
+	var id interface{}
+	if keepId {
+		id = t.Id
+	}
+	var err error
+	t.Id, err = insertRow(tx, "teams", teamColumns, id,
+		t.Team, t.Admin, t.Password, t.Title, t.AddTime, t.WhatsApp, t.WhatsAppId, t.WhatsAppTo, t.Prefix, t.Planner, t.Accounts)
+	return t.Id, err
+}
+
+// Update a team
+func updateTeam(tx execer, t *TeamInterface) error {
+	_, err := tx.Exec("UPDATE teams SET team = ?, admin = ?, password = ?, title = ?, addtime = ?, whatsapp = ?, "+
+		"whatsappid = ?, whatsappto = ?, prefix = ?, planner = ?, accountsonly = ? WHERE id = ?",
+		t.Team, t.Admin, t.Password, t.Title, t.AddTime, t.WhatsApp, t.WhatsAppId, t.WhatsAppTo, t.Prefix, t.Planner, t.Accounts, t.Id)
+	return err
+}
+
+// Update the password hash of a team
+func updateTeamPassword(tx execer, id int64, password string) error {
+	_, err := tx.Exec("UPDATE teams SET password = ? WHERE id = ?", password, id)
+	return err
+}
+
+// Delete a team including all users, whatsapp receivers and bookings with their logs of the team
+func deleteTeam(tx execer, t *TeamInterface) error {
+	for _, q := range []string{"DELETE FROM users WHERE team = ?", "DELETE FROM whatsappto WHERE team = ?",
+		"DELETE FROM booking_logs WHERE booking IN (SELECT id FROM bookings WHERE team = ?)",
+		"DELETE FROM bookings WHERE team = ?", "DELETE FROM notify_channels WHERE team = ?",
+		"DELETE FROM notify_deliveries WHERE team = ?", "DELETE FROM booking_groups WHERE team = ?",
+		"DELETE FROM accounts WHERE team = ?", "DELETE FROM teams WHERE team = ?"} {
+		if _, err := tx.Exec(q, t.Team); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan a user row
+func scanUser(row scanner) (UserInterface, error) {
+	var u UserInterface
+	err := row.Scan(&u.Id, &u.Team, &u.Username, &u.Password, &u.Name, &u.LastUsed)
+	return u, err
+}
+
+// Read the users of a team, all teams when team is empty
+func readUsers(team string) []UserInterface {
+	var b []UserInterface
+	var u UserInterface = UserInterface{Username: "?", Password: "?"}
+	b = append(b, u)
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE ? = '' OR team = ? ORDER BY id", team, team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, u)
+	}
+	return b
+}
+
+// Read a single user
+func readUser(tx execer, id int64) (*UserInterface, error) {
+	u, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Insert a user, the id is only used when keepId is set
+func insertUser(tx execer, u *UserInterface, keepId bool) (int64, error) {
+	var id interface{}
+	if keepId {
+		id = u.Id
+	}
+	var err error
+	u.Id, err = insertRow(tx, "users", userColumns, id, u.Team, u.Username, u.Password, u.Name, u.LastUsed)
+	return u.Id, err
+}
+
+// Update a user
+func updateUser(tx execer, u *UserInterface) error {
+	_, err := tx.Exec("UPDATE users SET team = ?, username = ?, password = ?, name = ?, lastused = ? WHERE id = ?",
+		u.Team, u.Username, u.Password, u.Name, u.LastUsed, u.Id)
+	return err
+}
+
+// Delete a user
+func deleteUser(tx execer, id int64) error {
+	_, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+// Store the password of the user used in a booking and remove users not used for 30 days
+func touchUser(tx execer, team string, username string, password string, name string) error {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM users WHERE team = ? AND LOWER(username) = LOWER(?)", team, username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = insertUser(tx, &UserInterface{Team: team, Username: username, Password: password,
+			Name: iif(name, username), LastUsed: timeNow().Unix()}, false)
+	} else if err == nil && password != "" {
+		_, err = tx.Exec("UPDATE users SET password = ?, lastused = ? WHERE id = ?", password, timeNow().Unix(), id)
+	} else if err == nil {
+		_, err = tx.Exec("UPDATE users SET lastused = ? WHERE id = ?", timeNow().Unix(), id)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE lastused < ?", timeNow().Add(-30*24*time.Hour).Unix())
+	return err
+}
+
+// Read the stored password of a user of the team, empty when not found
+func readUserPassword(tx execer, team string, username string) (string, error) {
+	var password string
+	err := tx.QueryRow("SELECT password FROM users WHERE team = ? AND LOWER(username) = LOWER(?)", team, username).Scan(&password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return password, err
+}
+
+// Scan a account row
+func scanAccount(row scanner) (AccountInterface, error) {
+	var a AccountInterface
+	err := row.Scan(&a.Id, &a.Team, &a.Username, &a.Password, &a.Name, &a.Role)
+	return a, err
+}
+
+// Read the accounts of a team, all teams when team is empty
+func readAccounts(team string) []AccountInterface {
+	b := []AccountInterface{}
+	rows, err := db.Query("SELECT "+accountColumns+" FROM accounts WHERE ? = '' OR team = ? ORDER BY id", team, team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, a)
+	}
+	return b
+}
+
+// Read a single account
+func readAccount(tx execer, id int64) (*AccountInterface, error) {
+	a, err := scanAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Read the account of the team by username
+func readAccountByName(tx execer, team string, username string) (*AccountInterface, error) {
+	a, err := scanAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE team = ? AND LOWER(username) = LOWER(?)",
+		team, username))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Insert a account
+func insertAccount(tx execer, a *AccountInterface) (int64, error) {
+	var err error
+	a.Id, err = insertRow(tx, "accounts", accountColumns, nil, a.Team, a.Username, a.Password, a.Name, a.Role)
+	return a.Id, err
+}
+
+// Update a account
+func updateAccount(tx execer, a *AccountInterface) error {
+	_, err := tx.Exec("UPDATE accounts SET team = ?, username = ?, password = ?, name = ?, role = ? WHERE id = ?",
+		a.Team, a.Username, a.Password, a.Name, a.Role, a.Id)
+	return err
+}
+
+// Delete a account
+func deleteAccount(tx execer, id int64) error {
+	_, err := tx.Exec("DELETE FROM accounts WHERE id = ?", id)
+	return err
+}
+
+// Read the whatsapp receivers of a team
+func readWhatsAppTo(team string) []WhatsAppToInterface {
+	var b []WhatsAppToInterface
+	var u WhatsAppToInterface = WhatsAppToInterface{To: "?"}
+	b = append(b, u)
+	rows, err := db.Query("SELECT "+whatsAppToColumns+" FROM whatsappto WHERE team = ? ORDER BY id", team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w WhatsAppToInterface
+		if err := rows.Scan(&w.Team, &w.To, &w.LastUsed); err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, w)
+	}
+	return b
+}
+
+// Mark the whatsapp receiver as used and remove receivers not used for 30 days
+func touchWhatsAppTo(tx execer, team string, to string) error {
+	if to == "" {
+		return nil
+	}
+	res, err := tx.Exec("UPDATE whatsappto SET lastused = ? WHERE team = ? AND LOWER(msgto) = LOWER(?)", timeNow().Unix(), team, to)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err = tx.Exec("INSERT INTO whatsappto ("+whatsAppToColumns+") VALUES (?, ?, ?)", team, to, timeNow().Unix()); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM whatsappto WHERE lastused < ?", timeNow().Add(-30*24*time.Hour).Unix())
+	return err
+}
+
+// Scan a booking row, without the logs
+func scanBooking(row scanner) (BookingInterface, error) {
+	var b BookingInterface
+	var fallbacks string
+	err := row.Scan(&b.Id, &b.Team, &b.Name, &fallbacks, &b.Date, &b.Time, &b.Duration, &b.Username, &b.Password,
+		&b.Comment, &b.Repeat, &b.State, &b.BookingId, &b.BoatId, &b.Message, &b.EpochNext, &b.Retry, &b.UserComment,
+		&b.WhatsAppTo, &b.BookStart, &b.BookDur, &b.BookedBoat, &b.FallbackIndex,
+		&b.BoatType, &b.WeightClass, &b.Location, &b.Permissions, &b.GroupId,
+		&b.RRule, &b.ExDates, &b.RepeatStart, &b.Version)
+	if fallbacks != "" {
+		b.Fallbacks = strings.Split(fallbacks, ",")
+	}
+	return b, err
+}
+
+// The values of a booking in the order of the booking columns, without the version
+func bookingValues(b *BookingInterface) []interface{} {
+	return []interface{}{b.Team, b.Name, strings.Join(b.Fallbacks, ","), b.Date, b.Time, b.Duration, b.Username, b.Password,
+		b.Comment, b.Repeat, b.State, b.BookingId, b.BoatId, b.Message, b.EpochNext, b.Retry, b.UserComment,
+		b.WhatsAppTo, b.BookStart, b.BookDur, b.BookedBoat, b.FallbackIndex,
+		b.BoatType, b.WeightClass, b.Location, b.Permissions, b.GroupId,
+		b.RRule, b.ExDates, b.RepeatStart}
+}
+
+// Read the logs of a booking
+func readBookingLogs(tx execer, id int64) LogListStruct {
+	var l LogListStruct
+	rows, err := tx.Query("SELECT date, state, log FROM booking_logs WHERE booking = ? ORDER BY id", id)
+	if err != nil {
+		log.Error(err)
+		return l
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e LogStruct
+		if err := rows.Scan(&e.Date, &e.State, &e.Log); err != nil {
+			log.Error(err)
+			continue
+		}
+		l = append(l, e)
+	}
+	return l
+}
+
+// Read the bookings including logs of a team, all teams when team is empty
+func readBookings(team string) BookingSlice {
+	b := BookingSlice{}
+	rows, err := db.Query("SELECT "+bookingColumns+" FROM bookings WHERE ? = '' OR team = ? ORDER BY id", team, team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	for rows.Next() {
+		booking, err := scanBooking(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, booking)
+	}
+	rows.Close()
+	for i := range b {
+		b[i].Logs = readBookingLogs(db, b[i].Id)
+	}
+	return b
+}
+
+// Read a single booking including logs
+func readBooking(tx execer, id int64) (*BookingInterface, error) {
+	b, err := scanBooking(tx.QueryRow("SELECT "+bookingColumns+" FROM bookings WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	b.Logs = readBookingLogs(tx, id)
+	return &b, nil
+}
+
+// Insert a booking without logs, the id is only used when keepId is set
+func insertBooking(tx execer, b *BookingInterface, keepId bool) (int64, error) {
+	var id interface{}
+	if keepId {
+		id = b.Id
+	}
+	b.Version = MaxInt64(b.Version, 1)
+	var err error
+	b.Id, err = insertRow(tx, "bookings", bookingColumns, id, append(bookingValues(b), b.Version)...)
+	return b.Id, err
+}
+
+// Update all fields of a booking when it still has the version it was read with, the logs are not changed.
+// Returns errBookingConflict when the booking has been changed or deleted in the meantime
+func updateBooking(tx execer, b *BookingInterface) error {
+	columns := strings.Split(bookingColumns, ", ")
+	columns = columns[1 : len(columns)-1]
+	res, err := tx.Exec("UPDATE bookings SET "+strings.Join(columns, " = ?, ")+" = ?, version = version + 1 WHERE id = ? AND version = ?",
+		append(bookingValues(b), b.Id, b.Version)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errBookingConflict
+	}
+	b.Version++
+	return nil
+}
+
+// Claim the version of the booking before it is removed, returns errBookingConflict when it has been changed
+func claimBooking(tx execer, b *BookingInterface) error {
+	res, err := tx.Exec("UPDATE bookings SET version = version + 1 WHERE id = ? AND version = ?", b.Id, b.Version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errBookingConflict
+	}
+	b.Version++
+	return nil
+}
+
+// Run the transaction again when a booking it reads and updates has been changed concurrently
+func withBookingRetry(fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := withTx(fn)
+		if !errors.Is(err, errBookingConflict) || attempt >= maxSaveRetries {
+			return err
+		}
+	}
+}
+
+// Delete a booking including logs
+func deleteBooking(tx execer, id int64) error {
+	if _, err := tx.Exec("DELETE FROM booking_logs WHERE booking = ?", id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM bookings WHERE id = ?", id)
+	return err
+}
+
+// Add a log entry to a booking
+func insertBookingLog(tx execer, id int64, l LogStruct) error {
+	_, err := tx.Exec("INSERT INTO booking_logs (booking, date, state, log) VALUES (?, ?, ?, ?)", id, l.Date, l.State, l.Log)
+	return err
+}
+
+// Save the changes made by the robot to a single booking, adding the new log entries. The booking is read as orig
+// before processing, when it has been changed in the meantime the changes of the robot are merged and saved again
+func saveBooking(orig *BookingInterface, b *BookingInterface, logs LogListStruct) error {
+	base := *orig
+	for attempt := 0; ; attempt++ {
+		deleted := false
+		err := withTx(func(tx *sql.Tx) error {
+			if attempt > 0 {
+				current, err := readBooking(tx, b.Id)
+				if errors.Is(err, sql.ErrNoRows) {
+					deleted = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+				mergeBooking(&base, b, current)
+				base = *current
+			}
+			return storeBooking(tx, b, logs)
+		})
+		if deleted {
+			log.WithField("id", b.Id).Info("Booking deleted while processing, changes dropped")
+			return nil
+		}
+		if !errors.Is(err, errBookingConflict) || attempt >= maxSaveRetries {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"id":      b.Id,
+			"boat":    b.Name,
+			"attempt": attempt + 1,
+		}).Info("Booking changed while processing, merging the changes")
+	}
+}
+
+// Store the booking and the new log entries, a booking in the state Delete is removed
+func storeBooking(tx execer, b *BookingInterface, logs LogListStruct) error {
+	if b.State == "Delete" {
+		log.WithFields(log.Fields{
+			"state":    b.State,
+			"boat":     b.Name,
+			"fallback": b.Fallbacks,
+			"booked":   b.BookedBoat,
+			"user":     b.Username,
+			"at":       shortDate(b.Date),
+			"from":     shortTime(b.Time),
+		}).Info("Deleting")
+		//A booking changed in the meantime is merged instead of deleted
+		if err := claimBooking(tx, b); err != nil {
+			return err
+		}
+		return deleteBooking(tx, b.Id)
+	}
+	if err := updateBooking(tx, b); err != nil {
+		return err
+	}
+	for _, l := range logs {
+		if err := insertBookingLog(tx, b.Id, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the changes of a single team
+func saveTeam(t *TeamInterface) {
+	err := withTx(func(tx *sql.Tx) error {
+		return updateTeam(tx, t)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Scan a notification channel row
+func scanNotifyChannel(row scanner) (NotifyChannel, error) {
+	var c NotifyChannel
+	err := row.Scan(&c.Id, &c.Team, &c.Type, &c.Target, &c.Secret, &c.States, &c.Enabled)
+	return c, err
+}
+
+// Read the notification channels of a team, all teams when team is empty
+func readNotifyChannels(team string) []NotifyChannel {
+	var b []NotifyChannel
+	rows, err := db.Query("SELECT "+notifyChannelColumns+" FROM notify_channels WHERE ? = '' OR team = ? ORDER BY id", team, team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanNotifyChannel(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// Read a single notification channel
+func readNotifyChannel(tx execer, id int64) (NotifyChannel, error) {
+	return scanNotifyChannel(tx.QueryRow("SELECT "+notifyChannelColumns+" FROM notify_channels WHERE id = ?", id))
+}
+
+// Insert a notification channel
+func insertNotifyChannel(tx execer, c *NotifyChannel) (int64, error) {
+	var err error
+	c.Id, err = storage.InsertId(tx, "INSERT INTO notify_channels (team, type, target, secret, states, enabled) VALUES (?, ?, ?, ?, ?, ?)",
+		c.Team, c.Type, c.Target, c.Secret, c.States, c.Enabled)
+	return c.Id, err
+}
+
+// Update a notification channel
+func updateNotifyChannel(tx execer, c *NotifyChannel) error {
+	_, err := tx.Exec("UPDATE notify_channels SET team = ?, type = ?, target = ?, secret = ?, states = ?, enabled = ? WHERE id = ?",
+		c.Team, c.Type, c.Target, c.Secret, c.States, c.Enabled, c.Id)
+	return err
+}
+
+// Delete a notification channel
+func deleteNotifyChannel(tx execer, id int64) error {
+	_, err := tx.Exec("DELETE FROM notify_channels WHERE id = ?", id)
+	return err
+}
+
+// Scan a booking group row
+func scanBookingGroup(row scanner) (BookingGroup, error) {
+	var g BookingGroup
+	err := row.Scan(&g.Id, &g.Team, &g.Name, &g.Minimum, &g.State, &g.Message)
+	return g, err
+}
+
+// Read the booking groups of a team, all teams when team is empty
+func readBookingGroups(team string) []BookingGroup {
+	var b []BookingGroup
+	rows, err := db.Query("SELECT "+bookingGroupColumns+" FROM booking_groups WHERE ? = '' OR team = ? ORDER BY id", team, team)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		g, err := scanBookingGroup(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, g)
+	}
+	return b
+}
+
+// Read a single booking group
+func readBookingGroup(tx execer, id int64) (BookingGroup, error) {
+	return scanBookingGroup(tx.QueryRow("SELECT "+bookingGroupColumns+" FROM booking_groups WHERE id = ?", id))
+}
+
+// Read the ids of the bookings in a group
+func readGroupBookingIds(tx execer, id int64) ([]int64, error) {
+	var ids []int64
+	rows, err := tx.Query("SELECT id FROM bookings WHERE groupid = ? ORDER BY id", id)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bid int64
+		if err := rows.Scan(&bid); err != nil {
+			return ids, err
+		}
+		ids = append(ids, bid)
+	}
+	return ids, rows.Err()
+}
+
+// Insert a booking group
+func insertBookingGroup(tx execer, g *BookingGroup) (int64, error) {
+	var err error
+	g.Id, err = storage.InsertId(tx, "INSERT INTO booking_groups (team, name, minimum, state, message) VALUES (?, ?, ?, ?, ?)",
+		g.Team, g.Name, g.Minimum, g.State, g.Message)
+	return g.Id, err
+}
+
+// Update a booking group
+func updateBookingGroup(tx execer, g *BookingGroup) error {
+	_, err := tx.Exec("UPDATE booking_groups SET team = ?, name = ?, minimum = ?, state = ?, message = ? WHERE id = ?",
+		g.Team, g.Name, g.Minimum, g.State, g.Message, g.Id)
+	return err
+}
+
+// Delete a booking group, the bookings are kept without group
+func deleteBookingGroup(tx execer, id int64) error {
+	if _, err := tx.Exec("UPDATE bookings SET groupid = 0, version = version + 1 WHERE groupid = ?", id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM booking_groups WHERE id = ?", id)
+	return err
+}
+
+// Scan a blackout row
+func scanBlackout(row scanner) (Blackout, error) {
+	var bo Blackout
+	err := row.Scan(&bo.Id, &bo.Start, &bo.End, &bo.Reason, &bo.Uid)
+	return bo, err
+}
+
+// Read all blackouts
+func readBlackouts() []Blackout {
+	b := []Blackout{}
+	rows, err := db.Query("SELECT " + blackoutColumns + " FROM blackouts ORDER BY startdate, id")
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		bo, err := scanBlackout(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, bo)
+	}
+	return b
+}
+
+// Read a single blackout
+func readBlackout(tx execer, id int64) (Blackout, error) {
+	return scanBlackout(tx.QueryRow("SELECT "+blackoutColumns+" FROM blackouts WHERE id = ?", id))
+}
+
+// Read the first blackout including the date
+func readBlackoutAt(tx execer, date string) (Blackout, error) {
+	return scanBlackout(tx.QueryRow("SELECT "+blackoutColumns+" FROM blackouts WHERE startdate <= ? AND enddate >= ? ORDER BY startdate, id LIMIT 1", date, date))
+}
+
+// Insert a blackout
+func insertBlackout(tx execer, bo *Blackout) (int64, error) {
+	var err error
+	bo.Id, err = storage.InsertId(tx, "INSERT INTO blackouts (startdate, enddate, reason, uid) VALUES (?, ?, ?, ?)",
+		bo.Start, bo.End, bo.Reason, bo.Uid)
+	return bo.Id, err
+}
+
+// Update a blackout
+func updateBlackout(tx execer, bo *Blackout) error {
+	_, err := tx.Exec("UPDATE blackouts SET startdate = ?, enddate = ?, reason = ?, uid = ? WHERE id = ?", bo.Start, bo.End, bo.Reason, bo.Uid, bo.Id)
+	return err
+}
+
+// Update the blackout with the same uid or insert it
+func upsertBlackout(tx execer, bo *Blackout) error {
+	if bo.Uid != "" {
+		res, err := tx.Exec("UPDATE blackouts SET startdate = ?, enddate = ?, reason = ? WHERE uid = ?", bo.Start, bo.End, bo.Reason, bo.Uid)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	_, err := insertBlackout(tx, bo)
+	return err
+}
+
+// Delete a blackout
+func deleteBlackout(tx execer, id int64) error {
+	_, err := tx.Exec("DELETE FROM blackouts WHERE id = ?", id)
+	return err
+}
+
+// Scan a notification delivery row
+func scanNotifyDelivery(row scanner) (NotifyDelivery, error) {
+	var d NotifyDelivery
+	err := row.Scan(&d.Id, &d.Channel, &d.Team, &d.Type, &d.Target, &d.State, &d.Message, &d.Body,
+		&d.Status, &d.Attempts, &d.LastError, &d.Created, &d.Next)
+	return d, err
+}
+
+// Read the notification deliveries with the query conditions
+func readNotifyDeliveries(where string, args ...interface{}) []NotifyDelivery {
+	var b []NotifyDelivery
+	rows, err := db.Query("SELECT "+notifyDeliveryColumns+" FROM notify_deliveries WHERE "+where, args...)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanNotifyDelivery(rows)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		b = append(b, d)
+	}
+	return b
+}
+
+// Insert a notification delivery
+func insertNotifyDelivery(tx execer, d *NotifyDelivery) (int64, error) {
+	var err error
+	d.Id, err = storage.InsertId(tx, "INSERT INTO notify_deliveries (channel, team, type, target, state, message, body, status, attempts, lasterror, created, next) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.Channel, d.Team, d.Type, d.Target, d.State, d.Message, d.Body, d.Status, d.Attempts, d.LastError, d.Created, d.Next)
+	return d.Id, err
+}
+
+// Update the status of a notification delivery, delivered items older than 30 days are removed
+func updateNotifyDelivery(tx execer, d *NotifyDelivery) error {
+	_, err := tx.Exec("UPDATE notify_deliveries SET status = ?, attempts = ?, lasterror = ?, next = ? WHERE id = ?",
+		d.Status, d.Attempts, d.LastError, d.Next, d.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM notify_deliveries WHERE status <> 'Pending' AND created < ?", timeNow().Add(-30*24*time.Hour).Unix())
+	return err
+}
+
+// Read a setting, returns a empty string when not found
+func readSetting(tx execer, name string) (string, error) {
+	var value string
+	err := tx.QueryRow("SELECT value FROM settings WHERE name = ?", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+// Write a setting
+func writeSetting(tx execer, name string, value string) error {
+	_, err := tx.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value", name, value)
+	return err
+}
+
+// Insert a audit entry, the audit log is append only
+func insertAudit(tx execer, a *AuditEntry) (int64, error) {
+	var err error
+	a.Id, err = insertRow(tx, "audit", auditColumns, nil, a.Time, a.Team, a.Actor, a.Role, a.Ip, a.Action, a.Target,
+		a.Status, a.Error, string(a.Diff))
+	return a.Id, err
+}
+
+// Read the audit entries matching the where clause, newest first
+func readAudit(where string, limit int, args ...interface{}) []AuditEntry {
+	b := []AuditEntry{}
+	rows, err := db.Query("SELECT "+auditColumns+" FROM audit WHERE "+where+" ORDER BY id DESC LIMIT "+strconv.Itoa(limit), args...)
+	if err != nil {
+		log.Error(err)
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a AuditEntry
+		var diff string
+		if err := rows.Scan(&a.Id, &a.Time, &a.Team, &a.Actor, &a.Role, &a.Ip, &a.Action, &a.Target, &a.Status,
+			&a.Error, &diff); err != nil {
+			log.Error(err)
+			continue
+		}
+		if diff != "" {
+			a.Diff = json.RawMessage(diff)
+		}
+		b = append(b, a)
+	}
+	return b
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Open a new SQLite database with all migrations applied
+func openTestDB(t *testing.T) {
+	t.Helper()
+	openTestStorage(t, "sqlite://"+filepath.Join(t.TempDir(), "robot.db"))
+}
+
+// Open the database of the source with all migrations applied, closed at the end of the test
+func openTestStorage(t *testing.T, source string) {
+	t.Helper()
+	storage = newStorage(source)
+	var err error
+	if db, err = storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read the team by name
+func readTestTeam(t *testing.T, name string) TeamInterface {
+	t.Helper()
+	team, err := scanTeam(db.QueryRow("SELECT "+teamColumns+" FROM teams WHERE team = ?", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return team
+}
+
+func TestUpsertEnvTeam(t *testing.T) {
+	openTestDB(t)
+	defer func(team, pwd string) { jsonTeam, jsonPwd = team, pwd }(jsonTeam, jsonPwd)
+	jsonTeam, jsonPwd = "admin", "first"
+	if err := upsertEnvTeam(); err != nil {
+		t.Fatal(err)
+	}
+	team := readTestTeam(t, "admin")
+	if !team.Admin || !passwordHashMatches(team.Password, "first") {
+		t.Fatalf("admin team not created with a hashed password: %+v", team)
+	}
+	//A restart with the same password keeps the team
+	if err := upsertEnvTeam(); err != nil {
+		t.Fatal(err)
+	}
+	if again := readTestTeam(t, "admin"); again.Password != team.Password || again.Id != team.Id {
+		t.Fatal("admin team changed without a new password")
+	}
+	//A changed JSONPWD resets the password and the admin flag
+	withTx(func(tx *sql.Tx) error {
+		team.Admin = false
+		return updateTeam(tx, &team)
+	})
+	jsonPwd = "second"
+	if err := upsertEnvTeam(); err != nil {
+		t.Fatal(err)
+	}
+	team = readTestTeam(t, "admin")
+	if !team.Admin || !passwordHashMatches(team.Password, "second") || passwordHashMatches(team.Password, "first") {
+		t.Fatalf("admin team not reset from the environment: %+v", team)
+	}
+}
+
+func TestDeleteTeamRemovesBookingLogs(t *testing.T) {
+	openTestDB(t)
+	team := TeamInterface{Team: "t1", Title: "Team 1"}
+	other := BookingInterface{Team: "t2", Name: "Other", Date: "2026-10-25", Time: "10:00", Duration: 60}
+	err := withTx(func(tx *sql.Tx) error {
+		if _, err := insertTeam(tx, &team, false); err != nil {
+			return err
+		}
+		b := BookingInterface{Team: "t1", Name: "Lynx", Date: "2026-10-25", Time: "10:00", Duration: 60}
+		for _, booking := range []*BookingInterface{&b, &other} {
+			if _, err := insertBooking(tx, booking, false); err != nil {
+				return err
+			}
+			if err := insertBookingLog(tx, booking.Id, LogStruct{Date: 1, Log: "Added"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = withTx(func(tx *sql.Tx) error { return deleteTeam(tx, &team) }); err != nil {
+		t.Fatal(err)
+	}
+	var logs int
+	if err = db.QueryRow("SELECT COUNT(*) FROM booking_logs").Scan(&logs); err != nil {
+		t.Fatal(err)
+	}
+	if logs != 1 {
+		t.Fatalf("%d booking logs left, only the log of the other team should be kept", logs)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+var dryRun bool = false               //Should we only record the reservations we would make, my-fleet is only read
+var dryRunRecorder *dryRunFleetClient //The recorder of the dry run, nil when disabled
+const maxDryRunActions = 1000         //The maximum number of recorded actions kept
+
+// A reservation action the robot would have done in my-fleet
+type DryRunAction struct {
+	Time    int64  `json:"time"`    //The last moment the action was decided
+	First   int64  `json:"first"`   //The first moment the action was decided
+	Count   int    `json:"count"`   //The number of times the action was decided
+	Booking int64  `json:"booking"` //The booking id
+	Team    string `json:"team"`
+	User    string `json:"user"`
+	Action  string `json:"action"` //Book, Update, Cancel or Confirm
+	Boat    string `json:"boat"`
+	Start   int64  `json:"start,omitempty"`
+	End     int64  `json:"end,omitempty"`
+}
+
+// The MyFleetClient reading the grid from my-fleet, but only recording the reservation changes
+type dryRunFleetClient struct {
+	next     MyFleetClient
+	mutex    sync.Mutex
+	actions  []DryRunAction
+	lastId   int64
+	bookings map[int64]BookingInterface //The simulated bookings, these are not stored in the database
+}
+
+// Create the dry run recorder around the client
+func newDryRunFleetClient(next MyFleetClient) *dryRunFleetClient {
+	return &dryRunFleetClient{next: next, bookings: map[int64]BookingInterface{}}
+}
+
+// Get the simulated booking, the stored booking is used when not simulated yet
+func (d *dryRunFleetClient) Simulated(stored *BookingInterface) *BookingInterface {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if b, ok := d.bookings[stored.Id]; ok {
+		b.Logs = stored.Logs
+		return &b
+	}
+	return stored
+}
+
+// Keep the simulated result of the booking
+func (d *dryRunFleetClient) Simulate(b *BookingInterface) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	sim := *b
+	sim.Changed = false
+	sim.Boats = nil
+	d.bookings[b.Id] = sim
+}
+
+// The simulated bookings of the team, all teams when empty
+func (d *dryRunFleetClient) Bookings(team string) BookingSlice {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	list := BookingSlice{}
+	for _, b := range d.bookings {
+		if team == "" || b.Team == team {
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return publicBookings(list)
+}
+
+// Forget the simulated booking, it has been changed by the api
+func (d *dryRunFleetClient) Forget(id int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.bookings, id)
+}
+
+// Find the name of the boat of the booking in the boat list
+func dryRunBoat(booking *BookingInterface) string {
+	if booking.Boats != nil {
+		for _, bs := range *booking.Boats {
+			if strconv.Itoa(bs.Id) == booking.BoatId {
+				return bs.Name
+			}
+		}
+	}
+	return booking.BoatLabel()
+}
+
+// Record the action, the same action decided again for a booking only updates the time and count
+func (d *dryRunFleetClient) record(booking *BookingInterface, action string, start int64, end int64) {
+	now := timeNow().Unix()
+	a := DryRunAction{Time: now, First: now, Count: 1, Booking: booking.Id, Team: booking.Team, User: booking.Username,
+		Action: action, Boat: dryRunBoat(booking), Start: start, End: end}
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	entry := log.WithFields(log.Fields{
+		"action":  action,
+		"boat":    a.Boat,
+		"user":    a.User,
+		"booking": a.Booking,
+	})
+	if start != 0 {
+		entry = entry.WithFields(log.Fields{
+			"at":   time.Unix(start, 0).In(loc).Format("2006-01-02"),
+			"from": time.Unix(start, 0).In(loc).Format("15:04"),
+			"to":   time.Unix(end, 0).In(loc).Format("15:04"),
+		})
+	}
+	entry.Info("Dry run, would " + action)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := len(d.actions) - 1; i >= 0; i-- {
+		p := &d.actions[i]
+		if p.Booking == a.Booking && p.Action == a.Action && p.Boat == a.Boat && p.Start == a.Start && p.End == a.End {
+			p.Time = now
+			p.Count++
+			return
+		}
+	}
+	d.actions = append(d.actions, a)
+	if len(d.actions) > maxDryRunActions {
+		d.actions = d.actions[len(d.actions)-maxDryRunActions:]
+	}
+}
+
+// The recorded actions of the team, all teams when empty
+func (d *dryRunFleetClient) Actions(team string) []DryRunAction {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	list := []DryRunAction{}
+	for _, a := range d.actions {
+		if team == "" || a.Team == team {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// Remove the recorded actions of the team, all teams when empty
+func (d *dryRunFleetClient) Clear(team string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	list := []DryRunAction{}
+	for _, a := range d.actions {
+		if team != "" && a.Team != team {
+			list = append(list, a)
+		}
+	}
+	d.actions = list
+}
+
+func (d *dryRunFleetClient) Session(booking *BookingInterface) error {
+	return d.next.Session(booking)
+}
+
+func (d *dryRunFleetClient) Login(booking *BookingInterface) error {
+	return d.next.Login(booking)
+}
+
+func (d *dryRunFleetClient) ListBoats(booking *BookingInterface) (BoatListStruct, error) {
+	return d.next.ListBoats(booking)
+}
+
+func (d *dryRunFleetClient) Book(booking *BookingInterface, startTime int64, endTime int64) error {
+	d.record(booking, "Book", startTime, endTime)
+	d.mutex.Lock()
+	d.lastId++
+	booking.BookingId = "dryrun-" + strconv.FormatInt(d.lastId, 10)
+	d.mutex.Unlock()
+	booking.BookDur = (endTime - startTime) / 60
+	booking.BookStart = startTime
+	return nil
+}
+
+func (d *dryRunFleetClient) Update(booking *BookingInterface, startTime int64, endTime int64) error {
+	d.record(booking, "Update", startTime, endTime)
+	booking.BookDur = (endTime - startTime) / 60
+	booking.BookStart = startTime
+	return nil
+}
+
+func (d *dryRunFleetClient) Cancel(booking *BookingInterface) error {
+	d.record(booking, "Cancel", booking.BookStart, booking.BookStart+booking.BookDur*60)
+	booking.State = "Canceled"
+	booking.BookDur = 0
+	booking.BookStart = 0
+	return nil
+}
+
+func (d *dryRunFleetClient) Confirm(booking *BookingInterface) error {
+	d.record(booking, "Confirm", booking.BookStart, booking.BookStart+booking.BookDur*60)
+	return nil
+}
+
+func (d *dryRunFleetClient) Logout(booking *BookingInterface) error {
+	return d.next.Logout(booking)
+}
+
+// The api of the dry run, showing what the robot would have done
+func dryRunRoutes(g *echo.Group) {
+	g.GET("/dryrun", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		if dryRunRecorder == nil {
+			return c.String(http.StatusNotFound, "Dry run not enabled.")
+		}
+		return c.JSON(http.StatusOK, dryRunRecorder.Actions(teamFilter(team)))
+	})
+
+	//The bookings with the state they would have
+	g.GET("/dryrun/bookings", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		if dryRunRecorder == nil {
+			return c.String(http.StatusNotFound, "Dry run not enabled.")
+		}
+		return c.JSON(http.StatusOK, dryRunRecorder.Bookings(teamFilter(team)))
+	})
+
+	g.DELETE("/dryrun", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RolePlanner) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		if dryRunRecorder == nil {
+			return c.String(http.StatusNotFound, "Dry run not enabled.")
+		}
+		dryRunRecorder.Clear(teamFilter(team))
+		return c.JSON(http.StatusOK, dryRunRecorder.Actions(teamFilter(team)))
+	})
+}
@@ -0,0 +1,36 @@
+//go:build embedpg
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	log "github.com/sirupsen/logrus"
+)
+
+// Start a embedded postgres server in the db path, used by -dsn=embedded to test against postgres
+// without a installed server or container. The binaries are downloaded once on the first start
+func init() {
+	startEmbedded = func() (string, error) {
+		dir, err := filepath.Abs(filepath.Join(dbPath, "postgres"))
+		if err != nil {
+			return "", err
+		}
+		config := embeddedpostgres.DefaultConfig().Port(15432).
+			RuntimePath(filepath.Join(dir, "runtime")).DataPath(filepath.Join(dir, "data")).
+			CachePath(filepath.Join(dir, "cache")).Logger(log.StandardLogger().WriterLevel(log.DebugLevel))
+		os.RemoveAll(filepath.Join(dir, "data"))
+		pg := embeddedpostgres.NewDatabase(config)
+		if err = pg.Start(); err != nil {
+			return "", err
+		}
+		stopEmbedded = func() {
+			if err := pg.Stop(); err != nil {
+				log.Error(err)
+			}
+		}
+		return config.GetConnectionURL() + "?sslmode=disable", nil
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// A event pushed to the browsers
+type Event struct {
+	Type string      //booking, log, deleted or boats
+	Team string      //The team of the event, empty for all teams
+	Data interface{} //The json data of the event
+}
+
+// The log entry of a booking in a event
+type BookingLogEvent struct {
+	Id  int64     `json:"id"`
+	Log LogStruct `json:"log"`
+}
+
+// A browser listening to the event stream
+type eventClient struct {
+	team  string
+	admin bool
+	ch    chan Event
+}
+
+// EventHub distributes the events to the connected browsers
+type EventHub struct {
+	mutex   sync.Mutex
+	clients map[*eventClient]bool
+}
+
+const eventKeepAlive = 30 * time.Second
+
+var events = &EventHub{clients: map[*eventClient]bool{}}
+
+// Add a listening browser for the team
+func (h *EventHub) subscribe(team *Principal) *eventClient {
+	c := &eventClient{team: team.Team, admin: team.ClubAdmin(), ch: make(chan Event, 64)}
+	h.mutex.Lock()
+	h.clients[c] = true
+	h.mutex.Unlock()
+	return c
+}
+
+// Remove a browser
+func (h *EventHub) unsubscribe(c *eventClient) {
+	h.mutex.Lock()
+	delete(h.clients, c)
+	h.mutex.Unlock()
+}
+
+// Publish a event to all browsers allowed to see the team, slow browsers will miss events
+func (h *EventHub) Publish(eventType string, team string, data interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for c := range h.clients {
+		if team != "" && !c.admin && c.team != team {
+			continue
+		}
+		select {
+		case c.ch <- Event{Type: eventType, Team: team, Data: data}:
+		default:
+			log.WithField("team", c.team).Debug("Event dropped for slow client")
+		}
+	}
+}
+
+// Publish the changed booking including the new log entries
+func (h *EventHub) PublishBooking(b *BookingInterface, logs LogListStruct) {
+	if b.State == "Delete" {
+		h.Publish("deleted", b.Team, b.Id)
+		return
+	}
+	pb := *b
+	pb.Password = ""
+	h.Publish("booking", b.Team, pb)
+	for _, l := range logs {
+		h.Publish("log", b.Team, BookingLogEvent{Id: b.Id, Log: l})
+	}
+}
+
+// Publish the stored booking after a api change, including the last log entry
+func (h *EventHub) PublishStored(id int64, team string) {
+	b, err := readBooking(db, id)
+	if err != nil {
+		h.Publish("deleted", team, id)
+		return
+	}
+	var logs LogListStruct
+	if len(b.Logs) > 0 {
+		logs = b.Logs[len(b.Logs)-1:]
+	}
+	h.PublishBooking(b, logs)
+}
+
+// Stream the events of the team as server sent events
+func eventStream(c echo.Context) error {
+	team, err := getTeamByContext(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err)
+	}
+	client := events.subscribe(team)
+	defer events.unsubscribe(client)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	w.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			w.Flush()
+		case e := <-client.ch:
+			b, err := json.Marshal(e.Data)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+			w.Flush()
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var fakeFleet string = ""      //The address of the fake my-fleet server, empty=disabled
+var fakeFleetServer *FakeFleet //The running fake my-fleet server
+
+// A member known by the fake my-fleet server
+type FakeFleetUser struct {
+	Id       int64
+	Username string
+	Password string
+	Name     string
+}
+
+// A boat known by the fake my-fleet server
+type FakeFleetBoat struct {
+	Id          int
+	Name        string
+	Type        string
+	Location    string
+	WeightClass string
+	Permission  string
+}
+
+// A reservation on the fake my-fleet server
+type FakeFleetReservation struct {
+	Id        int64
+	BoatId    int
+	UserId    int64
+	Start     int64
+	End       int64
+	Comment   string
+	Info      string
+	Confirmed bool
+}
+
+// The state of a single browser session on the fake my-fleet server
+type fakeFleetSession struct {
+	userId    int64
+	uniq      string
+	extraInfo url.Values
+}
+
+// FakeFleet is an in memory my-fleet server, serving the same markup the
+// scraping client depends on. Used for development and end-to-end tests.
+type FakeFleet struct {
+	mutex        sync.Mutex
+	Users        map[string]*FakeFleetUser    //The known users by username
+	Boats        []*FakeFleetBoat             //The boats shown in the grid
+	AcceptAll    bool                         //Accept any login and create the user on the fly
+	Sunrise      int                          //Minutes after midnight boats become available
+	Sunset       int                          //Minutes after midnight boats are no longer available
+	BookWindow   int                          //Hours ahead reservations are allowed
+	Days         int                          //The number of days shown in the grid
+	GridWidth    float64                      //The number of pixels for 15 min
+	ConfirmTime  int                          //Minutes before the start a reservation can be confirmed, 0=any time
+	sessions     map[string]*fakeFleetSession //The sessions by cookie
+	reservations map[int64]*FakeFleetReservation
+	nextId       int64
+}
+
+// Create a new fake my-fleet server with some default boats
+func NewFakeFleet() *FakeFleet {
+	f := &FakeFleet{
+		Users:        map[string]*FakeFleetUser{},
+		AcceptAll:    true,
+		Sunrise:      6 * 60,
+		Sunset:       22 * 60,
+		BookWindow:   bookWindow,
+		Days:         4,
+		GridWidth:    12,
+		ConfirmTime:  60,
+		sessions:     map[string]*fakeFleetSession{},
+		reservations: map[int64]*FakeFleetReservation{},
+		nextId:       1000,
+	}
+	f.AddBoat("Amalthea", "2x", "Loods", "70-85kg", "")
+	f.AddBoat("Argus", "2x", "Loods", "85-100kg", "")
+	f.AddBoat("Artemis", "4x+", "Loods", "75-90kg", "")
+	f.AddBoat("Lynx", "1x", "Vlot", "70-85kg", "")
+	f.AddBoat("Hermes", "4x+", "Loods", "75-90kg", "Wedstrijd")
+	return f
+}
+
+// Start a fake my-fleet server on the address and return its base url
+func startFakeFleet(addr string) string {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fakeFleetServer = NewFakeFleet()
+	go http.Serve(listener, fakeFleetServer)
+	port := listener.Addr().(*net.TCPAddr).Port
+	log.Info("Fake my-fleet server started on port ", port)
+	return "http://localhost:" + strconv.Itoa(port) + "/"
+}
+
+// Add a user to the fake server
+func (f *FakeFleet) AddUser(username string, password string, name string) *FakeFleetUser {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.addUser(username, password, name)
+}
+
+func (f *FakeFleet) addUser(username string, password string, name string) *FakeFleetUser {
+	f.nextId++
+	u := &FakeFleetUser{Id: f.nextId, Username: username, Password: password, Name: iif(name, username)}
+	f.Users[strings.ToLower(username)] = u
+	return u
+}
+
+// Add a boat to the fake server
+func (f *FakeFleet) AddBoat(name, boatType, location, weightClass, permission string) *FakeFleetBoat {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	b := &FakeFleetBoat{Id: len(f.Boats) + 1, Name: name, Type: boatType, Location: location,
+		WeightClass: weightClass, Permission: permission}
+	f.Boats = append(f.Boats, b)
+	return b
+}
+
+// Reserve a boat outside of the robot, like another member would do
+func (f *FakeFleet) Reserve(boatName string, start int64, end int64, info string) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, b := range f.Boats {
+		if strings.EqualFold(b.Name, boatName) {
+			return f.reserve(b.Id, 0, start, end, "", info)
+		}
+	}
+	return 0, fmt.Errorf("boat %s not found", boatName)
+}
+
+// Remove a reservation outside of the robot
+func (f *FakeFleet) Remove(id int64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, found := f.reservations[id]
+	delete(f.reservations, id)
+	return found
+}
+
+// Change the period of a reservation outside of the robot, like the boathouse manager would do
+func (f *FakeFleet) Modify(id int64, start int64, end int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.modify(id, start, end)
+}
+
+func (f *FakeFleet) modify(id int64, start int64, end int64) error {
+	r, found := f.reservations[id]
+	if !found {
+		return fmt.Errorf("reservation %d not found", id)
+	}
+	if end <= start {
+		return fmt.Errorf("invalid period")
+	}
+	r.Start, r.End = start, end
+	return nil
+}
+
+// Get a copy of all reservations
+func (f *FakeFleet) Reservations() []FakeFleetReservation {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var list []FakeFleetReservation
+	for _, r := range f.reservations {
+		list = append(list, *r)
+	}
+	return list
+}
+
+// The start of the grid, midnight of today in the club time zone
+func (f *FakeFleet) gridStart() int64 {
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	now := timeNow().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).Unix()
+}
+
+// Check if the period is free and allowed for the boat, lock should be held
+func (f *FakeFleet) available(boatId int, start int64, end int64, skip int64) error {
+	if end <= start {
+		return fmt.Errorf("invalid period")
+	}
+	if end > timeNow().Add(time.Duration(f.BookWindow)*time.Hour).Unix() {
+		return fmt.Errorf("outside book window")
+	}
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	day := time.Unix(start, 0).In(loc)
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc).Unix()
+	if start < midnight+int64(f.Sunrise)*60 || end > midnight+int64(f.Sunset)*60 {
+		return fmt.Errorf("outside daylight")
+	}
+	for _, r := range f.reservations {
+		if r.Id != skip && r.BoatId == boatId && start < r.End && end > r.Start {
+			return fmt.Errorf("blocked by %s", r.Info)
+		}
+	}
+	return nil
+}
+
+// Create a reservation, lock should be held
+func (f *FakeFleet) reserve(boatId int, userId int64, start int64, end int64, comment string, info string) (int64, error) {
+	if err := f.available(boatId, start, end, 0); err != nil {
+		return 0, err
+	}
+	f.nextId++
+	f.reservations[f.nextId] = &FakeFleetReservation{Id: f.nextId, BoatId: boatId, UserId: userId,
+		Start: start, End: end, Comment: comment, Info: info}
+	return f.nextId, nil
+}
+
+// Get or create the session of the request, lock should be held
+func (f *FakeFleet) session(w http.ResponseWriter, r *http.Request) *fakeFleetSession {
+	if c, err := r.Cookie("PHPSESSID"); err == nil {
+		if s, ok := f.sessions[c.Value]; ok {
+			return s
+		}
+	}
+	f.nextId++
+	id := "fake" + strconv.FormatInt(f.nextId, 10)
+	s := &fakeFleetSession{uniq: "myfleet" + strconv.FormatInt(time.Now().UnixNano(), 16)}
+	f.sessions[id] = s
+	http.SetCookie(w, &http.Cookie{Name: "PHPSESSID", Value: id, Path: "/"})
+	return s
+}
+
+// Expire all sessions, like my-fleet does after being idle
+func (f *FakeFleet) ExpireSessions() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, s := range f.sessions {
+		s.userId = 0
+	}
+}
+
+// Find the user by id, lock should be held
+func (f *FakeFleet) user(id int64) *FakeFleetUser {
+	for _, u := range f.Users {
+		if u.Id == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// Serve the text, authenticate and gui pages
+func (f *FakeFleet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	r.ParseForm()
+	s := f.session(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/text/authenticate.php"):
+		f.serveAuthenticate(w, r, s)
+	case strings.HasSuffix(r.URL.Path, "/text/index.php"):
+		if s.userId != 0 {
+			fmt.Fprintf(w, "<html><body>\n<frame src=\"../gui/index.php?brsuser=%d\">\n</body></html>\n", s.userId)
+		} else {
+			fmt.Fprint(w, "<html><body><form method=\"post\" action=\"authenticate.php\"></form></body></html>\n")
+		}
+	case strings.HasSuffix(r.URL.Path, "/gui/index.php"):
+		f.serveGui(w, r, s)
+	case strings.HasSuffix(r.URL.Path, "/fake/reservations"):
+		f.serveExternal(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Serve the authentication, a get will kill the session
+func (f *FakeFleet) serveAuthenticate(w http.ResponseWriter, r *http.Request, s *fakeFleetSession) {
+	s.userId = 0
+	if r.Method != http.MethodPost {
+		fmt.Fprint(w, "<html><body>Login</body></html>\n")
+		return
+	}
+	un, pw := r.PostFormValue("un"), r.PostFormValue("pw")
+	u, found := f.Users[strings.ToLower(un)]
+	if !found && f.AcceptAll && un != "" && pw != "" {
+		u = f.addUser(un, pw, un)
+	}
+	if u == nil || u.Password != pw {
+		fmt.Fprint(w, "<html><body>Invalid username or password</body></html>\n")
+		return
+	}
+	s.userId = u.Id
+	fmt.Fprint(w, "<html><body>\n<a href=\"index.php\">Exit Page</a>\n</body></html>\n")
+}
+
+// Serve the gui pages
+func (f *FakeFleet) serveGui(w http.ResponseWriter, r *http.Request, s *fakeFleetSession) {
+	query := r.URL.Query()
+	switch query.Get("a") {
+	case "b":
+		fmt.Fprintf(w, "<script>\nvar starttime_unix = \"%d\";\n</script>\n", f.gridStart())
+	case "c":
+		fmt.Fprintf(w, "<script>\nvar info=%s;\nvar grid_width = %g;\n</script>\n", f.gridInfo(), f.GridWidth)
+	case "e":
+		f.serveReservation(w, r, s)
+	default:
+		loc, _ := time.LoadLocation(timeZoneLoc)
+		fmt.Fprintf(w, "<html><head>\n<link rel=\"stylesheet\" media=\"screen\" href=\"index.php?a=i&uniq=%s\">\n</head>\n", s.uniq)
+		fmt.Fprintf(w, "<body><form><input name=\"start\" value=\"%s\"></form></body></html>\n",
+			time.Unix(f.gridStart(), 0).In(loc).Format("2006-01-02 15:04"))
+	}
+}
+
+// Create the var info json of the grid, lock should be held
+func (f *FakeFleet) gridInfo() string {
+	type gridReservation struct {
+		P  string  `json:"p"`
+		S  string  `json:"s"`
+		X  float64 `json:"x"`
+		W  float64 `json:"w"`
+		U  string  `json:"u"`
+		C  string  `json:"c"`
+		ID string  `json:"id"`
+	}
+	type gridBoat struct {
+		M struct {
+			BoatId   int      `json:"i"`
+			BoatInfo []string `json:"c"`
+		} `json:"m"`
+		R []gridReservation `json:"r"`
+	}
+	start := f.gridStart()
+	end := start + int64(f.Days)*24*60*60
+	pixels := func(epoch int64) float64 {
+		return float64((epoch-start)/(15*60)) * f.GridWidth
+	}
+	block := func(from int64, to int64, color string) gridReservation {
+		return gridReservation{S: "B", X: pixels(from), W: pixels(to) - pixels(from), C: color}
+	}
+	window := timeNow().Add(time.Duration(f.BookWindow) * time.Hour).Truncate(15 * time.Minute).Unix()
+	var grid []gridBoat
+	for _, b := range f.Boats {
+		gb := gridBoat{}
+		gb.M.BoatId = b.Id
+		gb.M.BoatInfo = []string{b.Name, b.Type, b.Location, b.WeightClass, b.Permission}
+		//The sunrise and sunset blocks of each day
+		for d := 0; d < f.Days; d++ {
+			midnight := time.Unix(start, 0).AddDate(0, 0, d).Unix()
+			gb.R = append(gb.R, block(midnight, midnight+int64(f.Sunrise)*60, "#ffffff"))
+			gb.R = append(gb.R, block(midnight+int64(f.Sunset)*60, midnight+24*60*60, "#ffffff"))
+		}
+		//The period beyond the book window is not available
+		if window < end {
+			gb.R = append(gb.R, block(window, end, "#404040"))
+		}
+		for _, r := range f.reservations {
+			if r.BoatId == b.Id && r.End > start {
+				info := r.Info
+				if u := f.user(r.UserId); u != nil {
+					info = u.Name
+				}
+				gb.R = append(gb.R, gridReservation{S: "R", X: pixels(r.Start), W: pixels(r.End) - pixels(r.Start),
+					U: info, C: "#00ff00", ID: strconv.FormatInt(r.Id, 10)})
+			}
+		}
+		grid = append(grid, gb)
+	}
+	b, _ := json.Marshal(grid)
+	return string(b)
+}
+
+// Serve the reservation pages, the get stores the reference the post executes it
+func (f *FakeFleet) serveReservation(w http.ResponseWriter, r *http.Request, s *fakeFleetSession) {
+	if s.userId == 0 {
+		//My-fleet shows the login page when the session is gone
+		fmt.Fprint(w, "<html><body><form method=\"post\" action=\"../text/authenticate.php\"></form></body></html>\n")
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.extraInfo, _ = url.ParseQuery(r.URL.Query().Get("extrainfo"))
+		fmt.Fprint(w, "<html><body>Reservation</body></html>\n")
+		return
+	}
+	if s.extraInfo == nil {
+		http.Error(w, "No reservation reference", http.StatusBadRequest)
+		return
+	}
+	page := iif(r.URL.Query().Get("page"), r.PostFormValue("page"))
+	start, _ := strconv.ParseInt(r.PostFormValue("newStart"), 10, 64)
+	end, _ := strconv.ParseInt(r.PostFormValue("newEnd"), 10, 64)
+	start, end = f.gridStart()+start*15*60, f.gridStart()+end*15*60
+	boatId, _ := strconv.Atoi(s.extraInfo.Get("mid"))
+	rid, _ := strconv.ParseInt(s.extraInfo.Get("rid"), 10, 64)
+	res := f.reservations[rid]
+	if page != "1_single" && (res == nil || res.UserId != s.userId) {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	switch page {
+	case "1_single":
+		id, err := f.reserve(boatId, s.userId, start, end, r.PostFormValue("comment"), "")
+		if err != nil {
+			fmt.Fprintf(w, "<html><body>Reservation failed: %s</body></html>\n", err)
+			return
+		}
+		fmt.Fprintf(w, "<script>\nvar ReservationId = %d \n</script>\n", id)
+	case "1_modifylogbook":
+		fmt.Fprint(w, "<html><body>Modify</body></html>\n")
+	case "3_commit":
+		if err := f.available(res.BoatId, start, end, res.Id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		res.Start, res.End = start, end
+		res.Comment = r.PostFormValue("comment")
+		fmt.Fprint(w, "<html><body>Ok</body></html>\n")
+	case "1_confirm":
+		if f.ConfirmTime != 0 && timeNow().Unix() < res.Start-int64(f.ConfirmTime)*60 {
+			fmt.Fprint(w, "<html><body>"+confirmRefused+"</body></html>\n")
+			return
+		}
+		res.Confirmed = true
+		fmt.Fprint(w, "<html><body>Confirmed</body></html>\n")
+	case "1_cancel":
+		delete(f.reservations, res.Id)
+		fmt.Fprint(w, "<html><body>Canceled</body></html>\n")
+	default:
+		http.Error(w, "Unknown page", http.StatusBadRequest)
+	}
+	if page != "1_modifylogbook" {
+		s.extraInfo = nil
+	}
+}
+
+// Serve the changes outside of the robot for testing, a get lists the reservations,
+// a delete with id removes it and a post with id, start and end (unix) changes the period
+func (f *FakeFleet) serveExternal(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	switch r.Method {
+	case http.MethodGet:
+		var list []FakeFleetReservation
+		for _, res := range f.reservations {
+			list = append(list, *res)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodDelete:
+		if _, found := f.reservations[id]; !found {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.reservations, id)
+	case http.MethodPost:
+		start, _ := strconv.ParseInt(r.FormValue("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.FormValue("end"), 10, 64)
+		if err := f.modify(id, start, end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// A group of bookings for one training session, booked all or nothing or with a minimum number of boats
+type BookingGroup struct {
+	Id       int64        `db:"id" json:"id"`
+	Team     string       `db:"team" json:"team"`
+	Name     string       `db:"name" json:"name"`
+	Minimum  int          `db:"minimum" json:"minimum"` //The minimum number of boats, 0=all boats
+	State    string       `db:"state" json:"state"`     //Pending, Finished, Failed or Canceled
+	Message  string       `db:"message" json:"message"`
+	Bookings BookingSlice `db:"-" json:"bookings,omitempty"`
+}
+
+// The booking states holding a boat and the states the boat is lost
+var securedStates = map[string]bool{"Finished": true, "Moving": true, "Confirmed": true, "ConfirmRetry": true, "ExternallyModified": true}
+var lostStates = map[string]bool{"Failed": true, "Canceled": true, "Cancel": true, "ConfirmFailed": true, "Delete": true}
+
+// The number of boats needed for the group
+func (g *BookingGroup) needed(total int) int {
+	if g.Minimum > 0 && g.Minimum < total {
+		return g.Minimum
+	}
+	return total
+}
+
+// Evaluate the combined state of the group from its bookings
+func evaluateGroup(g *BookingGroup, bookings BookingSlice) (string, string) {
+	secured, lost := 0, 0
+	for _, b := range bookings {
+		if securedStates[b.State] {
+			secured++
+		} else if lostStates[b.State] || reconcileTerminal(b.State) {
+			lost++
+		}
+	}
+	total := len(bookings)
+	need := g.needed(total)
+	switch {
+	case total-lost < need:
+		return "Failed", "Only " + strconv.Itoa(total-lost) + " of " + strconv.Itoa(total) + " boats available, " + strconv.Itoa(need) + " needed"
+	case secured >= need && secured+lost == total:
+		return "Finished", "Booked " + strconv.Itoa(secured) + " of " + strconv.Itoa(total) + " boats"
+	default:
+		return "Pending", strconv.Itoa(secured) + " of " + strconv.Itoa(total) + " boats booked, " + strconv.Itoa(need) + " needed"
+	}
+}
+
+// Read the group including the bookings
+func readGroupWithBookings(tx execer, id int64) (BookingGroup, error) {
+	g, err := readBookingGroup(tx, id)
+	if err != nil {
+		return g, err
+	}
+	ids, err := readGroupBookingIds(tx, id)
+	if err != nil {
+		return g, err
+	}
+	for _, bid := range ids {
+		b, err := readBooking(tx, bid)
+		if err != nil {
+			return g, err
+		}
+		g.Bookings = append(g.Bookings, *b)
+	}
+	return g, nil
+}
+
+// Stop a booking of the group, a booked boat is canceled by the robot otherwise the booking gets the state
+func stopGroupBooking(tx execer, b *BookingInterface, state string, message string) error {
+	b.State = cif(b.BookingId != "", "Cancel", state)
+	b.Message = message
+	b.EpochNext = 0
+	if err := updateBooking(tx, b); err != nil {
+		return err
+	}
+	return insertBookingLog(tx, b.Id, LogStruct{Date: timeNow().Unix(), State: b.State, Log: message})
+}
+
+// Update the groups of the changed bookings, when too few boats can be obtained the secured boats are released
+func updateGroups(bookingSlice BookingSlice) {
+	groups := map[int64]bool{}
+	for _, b := range bookingSlice {
+		if b.Changed && b.GroupId != 0 {
+			groups[b.GroupId] = true
+		}
+	}
+	for id := range groups {
+		var g BookingGroup
+		var released []int64
+		changed, stateChanged := false, false
+		err := withBookingRetry(func(tx *sql.Tx) error {
+			var err error
+			released, changed, stateChanged = nil, false, false
+			if g, err = readGroupWithBookings(tx, id); err != nil {
+				return err
+			}
+			if len(g.Bookings) == 0 {
+				return deleteBookingGroup(tx, g.Id)
+			}
+			if g.State == "Canceled" {
+				return nil
+			}
+			state, message := evaluateGroup(&g, g.Bookings)
+			if state == g.State && message == g.Message {
+				return nil
+			}
+			//Release the boats of the failed group
+			if state == "Failed" && g.State != "Failed" {
+				for i := range g.Bookings {
+					b := &g.Bookings[i]
+					if lostStates[b.State] {
+						continue
+					}
+					if err := stopGroupBooking(tx, b, "Failed", "Released, group "+g.Name+" failed"); err != nil {
+						return err
+					}
+					released = append(released, b.Id)
+				}
+			}
+			stateChanged = state != g.State
+			g.State, g.Message = state, message
+			changed = true
+			return updateBookingGroup(tx, &g)
+		})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, bid := range released {
+			scheduler.Notify(bid)
+			events.PublishStored(bid, g.Team)
+		}
+		if changed {
+			log.WithFields(log.Fields{
+				"group": g.Name,
+				"team":  g.Team,
+				"state": g.State,
+			}).Info(g.Message)
+			events.Publish("group", g.Team, publicGroup(g))
+		}
+		if stateChanged {
+			notifyGroup(&g)
+		}
+	}
+}
+
+// Queue a single combined notification of the group
+func notifyGroup(g *BookingGroup) {
+	var boats BookingSlice
+	for _, b := range g.Bookings {
+		if g.State != "Finished" || securedStates[b.State] {
+			boats = append(boats, b)
+		}
+	}
+	if len(boats) == 0 {
+		return
+	}
+	message := "Group " + g.Name + " " + strings.ToLower(g.State) + ", " + strings.ToLower(g.Message[:1]) + g.Message[1:] + ". " +
+		bookingMessage(cif(g.State == "Failed", "released", g.State), boats)
+	queued := false
+	for _, c := range teamChannels(g.Team) {
+		if !c.notifies(g.State) {
+			continue
+		}
+		//Whatsapp is send to every receiver of the group, the other channels have a fixed receiver
+		receivers := []string{}
+		for _, b := range g.Bookings {
+			if to := c.receiver(&b); to != "" && !slices.Contains(receivers, to) {
+				receivers = append(receivers, to)
+			}
+		}
+		for _, to := range receivers {
+			n := Notification{Team: g.Team, Group: g.Id, State: g.State, Message: message, Time: timeNow().Unix()}
+			n.addBookings(g.Bookings)
+			queued = queueNotification(&c, to, &n) || queued
+		}
+	}
+	if queued {
+		wakeNotifier()
+	}
+}
+
+// Remove the passwords of the bookings in the group
+func publicGroup(g BookingGroup) BookingGroup {
+	g.Bookings = publicBookings(g.Bookings)
+	return g
+}
+
+// Read the groups of the team including the bookings
+func readGroupsWithBookings(team string) []BookingGroup {
+	groups := []BookingGroup{}
+	for _, g := range readBookingGroups(team) {
+		full, err := readGroupWithBookings(db, g.Id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		groups = append(groups, publicGroup(full))
+	}
+	return groups
+}
+
+// The api of the booking groups
+func groupRoutes(g *echo.Group) {
+	g.GET("/groups", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		return c.JSON(http.StatusOK, readGroupsWithBookings(teamFilter(team)))
+	})
+
+	g.GET("/groups/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		group, err := readGroupWithBookings(db, id)
+		if err == nil && (team.Allowed(group.Team, RoleViewer)) {
+			return c.JSON(http.StatusOK, publicGroup(group))
+		}
+		return c.String(http.StatusNotFound, "Not found.")
+	})
+
+	//Create a group including the bookings of the session
+	g.POST("/groups", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RolePlanner) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		group := new(BookingGroup)
+		if err = c.Bind(group); err != nil || len(group.Bookings) == 0 || group.Minimum < 0 {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		group.Team = team.teamOf(group.Team)
+		group.State = "Pending"
+		group.Message = "0 of " + strconv.Itoa(len(group.Bookings)) + " boats booked, " + strconv.Itoa(group.needed(len(group.Bookings))) + " needed"
+		for i := range group.Bookings {
+			group.Bookings[i].Team = group.Team
+			if err = prepareNewBooking(team, &group.Bookings[i]); err != nil {
+				return c.JSON(http.StatusInternalServerError, err)
+			}
+			group.Bookings[i].RepeatStart = ""
+			if err = prepareRecurrence(&group.Bookings[i]); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			if _, err := insertBookingGroup(tx, group); err != nil {
+				return err
+			}
+			for i := range group.Bookings {
+				group.Bookings[i].GroupId = group.Id
+				if err := storeNewBooking(tx, &group.Bookings[i], team); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.WithFields(log.Fields{
+			"group": group.Name,
+			"team":  group.Team,
+			"boats": len(group.Bookings),
+		}).Info("Added group")
+		for _, b := range group.Bookings {
+			scheduler.Notify(b.Id)
+			events.PublishStored(b.Id, b.Team)
+		}
+		return c.JSON(http.StatusOK, readGroupsWithBookings(teamFilter(team)))
+	})
+
+	//Update the name and minimum of a group, the bookings are changed by the booking api
+	g.PUT("/groups/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RolePlanner) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		updated := new(BookingGroup)
+		if err = c.Bind(updated); err != nil || updated.Minimum < 0 {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		group, err := readBookingGroup(db, id)
+		if err != nil || !team.Allowed(group.Team, RolePlanner) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		group.Name = updated.Name
+		group.Minimum = updated.Minimum
+		err = withTx(func(tx *sql.Tx) error {
+			return updateBookingGroup(tx, &group)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		//Evaluate the group again with the new minimum
+		updateGroups(BookingSlice{{GroupId: group.Id, Changed: true}})
+		return c.JSON(http.StatusOK, readGroupsWithBookings(teamFilter(team)))
+	})
+
+	//Cancel all bookings of the group, a canceled group is removed
+	g.DELETE("/groups/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RolePlanner) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		group, err := readGroupWithBookings(db, id)
+		if err != nil || !team.Allowed(group.Team, RolePlanner) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			if group.State == "Canceled" {
+				log.WithFields(log.Fields{
+					"group": group.Name,
+					"team":  group.Team,
+				}).Info("Deleting group")
+				return deleteBookingGroup(tx, group.Id)
+			}
+			for i := range group.Bookings {
+				if b := &group.Bookings[i]; !lostStates[b.State] {
+					if err := stopGroupBooking(tx, b, "Canceled", "Canceled by "+team.Actor()); err != nil {
+						return err
+					}
+				}
+			}
+			group.State = "Canceled"
+			group.Message = "Canceled by " + team.Actor()
+			return updateBookingGroup(tx, &group)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		for _, b := range group.Bookings {
+			scheduler.Notify(b.Id)
+			events.PublishStored(b.Id, b.Team)
+		}
+		return c.JSON(http.StatusOK, readGroupsWithBookings(teamFilter(team)))
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+)
+
+func TestEvaluateGroup(t *testing.T) {
+	cases := []struct {
+		name    string
+		minimum int
+		rebook  bool
+		states  []string
+		want    string
+	}{
+		{"all boats booked", 0, false, []string{"Finished", "Confirmed"}, "Finished"},
+		{"all or nothing waiting", 0, false, []string{"Finished", "Waiting"}, "Pending"},
+		{"all or nothing failed", 0, false, []string{"Finished", "Failed"}, "Failed"},
+		{"minimum reached with a lost boat", 2, false, []string{"Finished", "ConfirmRetry", "Failed"}, "Finished"},
+		{"minimum still possible", 2, false, []string{"Finished", "Retry", "Failed"}, "Pending"},
+		{"minimum pending", 2, false, []string{"", "Waiting", "Retry"}, "Pending"},
+		{"minimum not possible", 2, false, []string{"Finished", "Canceled", "ConfirmFailed"}, "Failed"},
+		{"external cancel is lost", 0, false, []string{"Finished", "ExternallyCanceled"}, "Failed"},
+		{"external cancel is booked again", 0, true, []string{"Finished", "ExternallyCanceled"}, "Pending"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(value bool) { rebook = value }(rebook)
+			rebook = c.rebook
+			var bookings BookingSlice
+			for _, state := range c.states {
+				bookings = append(bookings, BookingInterface{State: state})
+			}
+			g := BookingGroup{Minimum: c.minimum}
+			if state, message := evaluateGroup(&g, bookings); state != c.want {
+				t.Fatalf("state %s: %s, expected %s", state, message, c.want)
+			}
+		})
+	}
+}
+
+// Store a group with a booking in each of the states, the bookings in a secured state have a reservation
+func insertTestGroup(t *testing.T, minimum int, states ...string) (BookingGroup, BookingSlice) {
+	t.Helper()
+	g := BookingGroup{Team: "t1", Name: "Training", Minimum: minimum, State: "Pending"}
+	var bookings BookingSlice
+	err := withTx(func(tx *sql.Tx) error {
+		if _, err := insertBookingGroup(tx, &g); err != nil {
+			return err
+		}
+		for i, state := range states {
+			b := BookingInterface{Team: "t1", Name: "Boat" + string(rune('A'+i)), Date: "2030-06-01", Time: "10:00", Duration: 60,
+				Username: "u1", State: state, GroupId: g.Id, Changed: true}
+			if securedStates[state] {
+				b.BookingId = strconv.Itoa(1001 + i)
+			}
+			if _, err := insertBooking(tx, &b, false); err != nil {
+				return err
+			}
+			bookings = append(bookings, b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, bookings
+}
+
+func TestUpdateGroupsReleasesBoats(t *testing.T) {
+	openTestDB(t)
+	g, bookings := insertTestGroup(t, 0, "Finished", "Waiting", "Failed")
+	updateGroups(bookings)
+	got, err := readGroupWithBookings(db, g.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != "Failed" {
+		t.Fatalf("group %s: %s", got.State, got.Message)
+	}
+	//The booked boat is canceled by the robot, the waiting booking stops
+	want := []string{"Cancel", "Failed", "Failed"}
+	for i, b := range got.Bookings {
+		if b.State != want[i] {
+			t.Fatalf("booking %d state %s, expected %s", i, b.State, want[i])
+		}
+	}
+	if msg := got.Bookings[1].Message; msg != "Released, group Training failed" {
+		t.Fatalf("released booking message %q", msg)
+	}
+}
+
+func TestUpdateGroupsFinished(t *testing.T) {
+	openTestDB(t)
+	g, bookings := insertTestGroup(t, 2, "Finished", "Confirmed", "Failed")
+	updateGroups(bookings)
+	got, err := readGroupWithBookings(db, g.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != "Finished" || got.Message != "Booked 2 of 3 boats" {
+		t.Fatalf("group %s: %s", got.State, got.Message)
+	}
+	for i, b := range got.Bookings {
+		if b.State != bookings[i].State {
+			t.Fatalf("booking %d of a finished group changed to %s", i, b.State)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const icalTime = "20060102T150405" //The local time format of the calendar, with the time zone of the club
+
+// Read the calendar token of the team, a new token is created when not found or when renew is set
+func icalToken(team string, renew bool) (string, error) {
+	var token string
+	err := withTx(func(tx *sql.Tx) error {
+		var err error
+		if token, err = readSetting(tx, "ical:"+team); err != nil || (token != "" && !renew) {
+			return err
+		}
+		b := make([]byte, 16)
+		if _, err = rand.Read(b); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(b)
+		return writeSetting(tx, "ical:"+team, token)
+	})
+	return token, err
+}
+
+// Escape a text value of the calendar
+func icalText(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// Write a calendar line, folded at 75 octets
+func icalLine(sb *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		//Do not split a utf-8 character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		sb.WriteString(line[:cut] + "\r\n")
+		line = " " + line[cut:]
+	}
+	sb.WriteString(line + "\r\n")
+}
+
+// The recurrence rule of the booking for the calendar, a count is replaced by the date of the last occurrence
+func icalRule(b *BookingInterface) string {
+	rule, err := b.recurrence()
+	if err != nil || rule == nil {
+		return ""
+	}
+	value := iif(b.RRule, repeatRules[b.Repeat])
+	if rule.Count == 0 {
+		return value
+	}
+	start, err1 := time.Parse(ruleDate, shortDate(iif(b.RepeatStart, b.Date)))
+	from, err2 := time.Parse(ruleDate, shortDate(b.Date))
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+	list := rule.Occurrences(start, nil, from, rule.Count)
+	if len(list) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, p := range strings.Split(value, ";") {
+		if !strings.HasPrefix(p, "COUNT=") {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(append(parts, "UNTIL="+list[len(list)-1].Format("20060102")+"T235959Z"), ";")
+}
+
+// Render the bookings as a iCalendar, the booked start and duration are used when booked
+func renderIcal(team string, bookings BookingSlice) string {
+	var sb strings.Builder
+	icalLine(&sb, "BEGIN:VCALENDAR")
+	icalLine(&sb, "VERSION:2.0")
+	icalLine(&sb, "PRODID:-//MyBoats//Robot "+AppVersion+"//EN")
+	icalLine(&sb, "CALSCALE:GREGORIAN")
+	icalLine(&sb, "X-WR-CALNAME:"+icalText("Boats "+team))
+	now := timeNow().UTC().Format(icalTime) + "Z"
+	loc, _ := time.LoadLocation(timeZoneLoc)
+	tzid := ";TZID=" + timeZoneLoc + ":"
+	for i := range bookings {
+		b := &bookings[i]
+		if b.State == "Delete" || setBookingEpochs(b) != nil {
+			continue
+		}
+		start, end := b.EpochStart, b.EpochEnd
+		if b.BookStart > 0 && b.BookDur > 0 {
+			start, end = b.BookStart, b.BookStart+b.BookDur*60
+		}
+		status := "TENTATIVE"
+		switch b.State {
+		case "Finished", "Moving", "Confirmed", "ConfirmRetry", "ExternallyModified":
+			status = "CONFIRMED"
+		case "Canceled", "Cancel", "Skipped", "ExternallyCanceled":
+			status = "CANCELLED"
+		}
+		description := "State: " + iif(b.State, "New")
+		if b.Message != "" {
+			description += "\n" + b.Message
+		}
+		if b.Comment != "" {
+			description += "\n" + b.Comment
+		}
+		icalLine(&sb, "BEGIN:VEVENT")
+		icalLine(&sb, "UID:booking-"+strconv.FormatInt(b.Id, 10)+"@myboats")
+		icalLine(&sb, "DTSTAMP:"+now)
+		icalLine(&sb, "DTSTART"+tzid+time.Unix(start, 0).In(loc).Format(icalTime))
+		icalLine(&sb, "DTEND"+tzid+time.Unix(end, 0).In(loc).Format(icalTime))
+		summary := b.BoatLabel()
+		if b.Username != "" {
+			summary += " (" + b.Username + ")"
+		}
+		icalLine(&sb, "SUMMARY:"+icalText(summary))
+		icalLine(&sb, "DESCRIPTION:"+icalText(description))
+		icalLine(&sb, "STATUS:"+status)
+		if rule := icalRule(b); rule != "" && status != "CANCELLED" {
+			icalLine(&sb, "RRULE:"+rule)
+			if exdates, err := parseExDates(b.ExDates); err == nil {
+				dates := make([]string, 0, len(exdates))
+				for d := range exdates {
+					dates = append(dates, d)
+				}
+				sort.Strings(dates)
+				for _, d := range dates {
+					if t, err := time.ParseInLocation("2006-01-02T15:04", d+"T"+shortTime(b.Time), loc); err == nil {
+						icalLine(&sb, "EXDATE"+tzid+t.Format(icalTime))
+					}
+				}
+			}
+		}
+		icalLine(&sb, "END:VEVENT")
+	}
+	icalLine(&sb, "END:VCALENDAR")
+	return sb.String()
+}
+
+// Serve the calendar feed /ical/<team>.ics?token=<token> of a team
+func icalFeed(c echo.Context) error {
+	name := strings.TrimSuffix(c.Param("file"), ".ics")
+	team, err := getTeamByName(name)
+	if err != nil {
+		return c.String(http.StatusNotFound, "Not found.")
+	}
+	token, err := icalToken(team.Team, false)
+	if err != nil {
+		log.Error(err)
+		return c.String(http.StatusInternalServerError, "Internal error.")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.QueryParam("token")), []byte(token)) != 1 {
+		return c.String(http.StatusUnauthorized, "Unauthorized")
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `inline; filename="`+team.Team+`.ics"`)
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(renderIcal(team.Team, readBookings(team.Team))))
+}
+
+// The api of the calendar feed, the url including the token is only visible for the team
+func icalRoutes(g *echo.Group) {
+	g.GET("/ical", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		token, err := icalToken(team.Team, false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		return c.JSON(http.StatusOK, map[string]string{"url": "/ical/" + team.Team + ".ics?token=" + token})
+	})
+
+	//Create a new token, the old feed url stops working
+	g.POST("/ical", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		token, err := icalToken(team.Team, true)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.WithField("team", team.Team).Info("Renewed calendar token")
+		return c.JSON(http.StatusOK, map[string]string{"url": "/ical/" + team.Team + ".ics?token=" + token})
+	})
+}
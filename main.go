@@ -10,23 +10,21 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 
 	"math"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/mdp/qrterminal"
@@ -54,7 +52,7 @@ const userFile = dbPath + "users.json"        //The json file to store users
 const whatsAppFile = dbPath + "whatsapp.json" //The json file to store whatsapp info
 const teamFile = dbPath + "teams.json"        //The json file to store group info
 const dbFile = dbPath + "myfleetrobot.db"     //The db file to store whatsapp sessions
-const versionFile = dbPath + "version.json"   //The  file to store version info
+const versionFile = dbPath + "version.json"   //The file used to store version info before the database
 var timeZoneLoc = "Europe/Amsterdam"          //The time zone location for the club
 var timeZone = ""                             //The time zone in hour, is also calculated
 var minDuration = 60                          //The minimal duration required to book
@@ -62,7 +60,7 @@ var maxDuration = 120                         //The maximal duration allowed to
 var bookWindow = 48                           //The number of hours allowed to book
 var confirmTime = 0                           //Time in Min before before starting time to confirm booking, 0=Disabled
 var maxRetry int = 10                         //The maximum numbers of retry before we give up, 0=disabled
-var refreshInterval int = 1                   //We do a check of the database every 1 minute
+var refreshInterval int = 1                   //The minimal interval in seconds between two checks of a booking
 var logLevel string = "Info"                  //Default loglevel is info
 var logFile string                            //Should we log to file
 var whatsApp bool = true                      //Should we enable watchapp
@@ -70,12 +68,15 @@ var planner bool = false                      //Should we enable planner
 var addTime bool = false                      //Should we add time comment
 var sleepOffset int = 0                       //Time in seconds we use as sleep offset
 
-// Used to map specify when to send a whatsapp message
-var sendWhatsAppMsg = map[string]bool{
-	"Finished":  true,
-	"Blocked":   true,
-	"Failed":    true,
-	"Confirmed": true,
+// The default booking states we notify, when not set for the notification channel
+var notifyStates = map[string]bool{
+	"Finished":           true,
+	"Blocked":            true,
+	"Failed":             true,
+	"Confirmed":          true,
+	"ConfirmFailed":      true,
+	"ExternallyCanceled": true,
+	"ExternallyModified": true,
 	/*
 		"Canceled": false,
 		"Retry":    false,
@@ -83,6 +84,8 @@ var sendWhatsAppMsg = map[string]bool{
 		"Waiting":  false,
 		"Cancel":   false,
 		"Moving":   false,
+		"ConfirmRetry": false,
+		"Skipped":  false,
 	*/
 }
 
@@ -101,16 +104,19 @@ const (
 type UserInterface struct {
 	Id       int64  `db:"id" json:"id"`
 	Team     string `db:"team" json:"team"`
-	Username string `db:"user" json:"user"`
-	Password string `db:"password" json:"password"`
+	Username string `db:"username" json:"user"`
+	Password string `db:"password" json:"password,omitempty"`
 	Name     string `db:"name" json:"name"`
 	LastUsed int64  `db:"lastused" json:"lastused"`
 }
 
 type LoginInterface struct {
 	Team     string `db:"team" json:"team"`
-	Password string `db:"password" json:"password"`
+	Account  string `db:"-" json:"account,omitempty"` //The account of the team, empty to login with the team password
+	Password string `db:"password" json:"password,omitempty"`
 	Status   string `db:"-" json:"status,omitempty"`
+	Token    string `db:"-" json:"token,omitempty"`
+	Expires  int64  `db:"-" json:"expires,omitempty"`
 }
 
 // Struc used to store user info
@@ -124,7 +130,7 @@ type TeamInterface struct {
 	Id         int64  `db:"id" json:"id"`
 	Team       string `db:"team" json:"team"`
 	Admin      bool   `db:"admin" json:"admin"`
-	Password   string `db:"password" json:"password"`
+	Password   string `db:"password" json:"password,omitempty"`
 	Title      string `db:"title" json:"title"`
 	AddTime    bool   `db:"addtime" json:"addtime"`
 	WhatsApp   bool   `db:"whatsapp" json:"whatsapp"`
@@ -133,11 +139,7 @@ type TeamInterface struct {
 	QRCode     string `db:"-" json:"qrcode"`
 	Prefix     string `db:"prefix" json:"prefix"`
 	Planner    bool   `db:"planner" json:"planner"`
-}
-
-// Used to store version info
-type VersionInterface struct {
-	Version string `db:"version" json:"version"`
+	Accounts   bool   `db:"accountsonly" json:"accountsonly"` //Only the accounts can login, the team password is refused
 }
 
 type ActivityInterface struct {
@@ -180,16 +182,28 @@ type LogListStruct []LogStruct
 // Struc used to store boat and session info
 type BookingInterface struct {
 	Id            int64           `db:"id" json:"id"`
+	Version       int64           `db:"version" json:"version"` //Increased by every update, used as ETag of the booking
 	Team          string          `db:"team" json:"team"`
 	Name          string          `db:"boat" json:"boat"`
-	Fallback      string          `db:"fallback" json:"fallback,omitempty"`
+	Fallbacks     []string        `db:"fallback" json:"fallbacks,omitempty"`
+	Fallback      string          `db:"-" json:"fallback,omitempty"` //Single fallback of older clients, merged into Fallbacks
+	BookedBoat    string          `db:"bookedboat" json:"bookedboat,omitempty"`
+	FallbackIndex int             `db:"fallbackindex" json:"fallbackindex,omitempty"`
+	BoatType      string          `db:"boattype" json:"boattype,omitempty"`       //Book any boat of this type when boat is empty
+	WeightClass   string          `db:"weightclass" json:"weightclass,omitempty"` //Book any boat of this weight class when boat is empty
+	Location      string          `db:"location" json:"location,omitempty"`       //Book any boat at this location when boat is empty
+	Permissions   string          `db:"permissions" json:"permissions,omitempty"` //The comma separated boat permissions of the crew
+	GroupId       int64           `db:"groupid" json:"groupid,omitempty"`         //The booking group, 0=none
 	Date          string          `db:"date" json:"date"`
 	Time          string          `db:"time" json:"time"`
 	Duration      int64           `db:"duration" json:"duration"`
-	Username      string          `db:"user" json:"user"`
-	Password      string          `db:"password" json:"password"`
+	Username      string          `db:"username" json:"user"`
+	Password      string          `db:"password" json:"password,omitempty"`
 	Comment       string          `db:"comment" json:"comment"`
 	Repeat        RepeatType      `db:"repeat" json:"repeat,omitempty"`
+	RRule         string          `db:"rrule" json:"rrule,omitempty"`             //RFC 5545 recurrence rule, replaces repeat
+	ExDates       string          `db:"exdates" json:"exdates,omitempty"`         //Comma separated dates skipped by the recurrence
+	RepeatStart   string          `db:"repeatstart" json:"repeatstart,omitempty"` //The first date of the recurrence
 	State         string          `db:"state" json:"state,omitempty"`
 	BookingId     string          `db:"bookingid" json:"bookingid,omitempty"`
 	BoatId        string          `db:"boatid" json:"boatid,omitempty"`
@@ -205,7 +219,7 @@ type BookingInterface struct {
 	Boats         *BoatListStruct `db:"-" json:"-"`
 	GuiEpochStart int64           `db:"-" json:"-"`
 	GuiFleetId    string          `db:"-" json:"-"`
-	Cookies       []*http.Cookie  `db:"-" json:"-"`
+	Jar           http.CookieJar  `db:"-" json:"-"`
 	EpochDate     int64           `db:"-" json:"-"`
 	EpochStart    int64           `db:"-" json:"-"`
 	EpochEnd      int64           `db:"-" json:"-"`
@@ -216,15 +230,37 @@ type BookingInterface struct {
 // The list of bookings
 type BookingSlice []BookingInterface
 
+// The boat we are trying to book, the requested boat or the current fallback
+func (b *BookingInterface) CurrentBoat() string {
+	if b.FallbackIndex > 0 && b.FallbackIndex <= len(b.Fallbacks) {
+		return b.Fallbacks[b.FallbackIndex-1]
+	}
+	return b.Name
+}
+
+// Merge the single fallback of older clients and clean the ordered fallback list
+func (b *BookingInterface) normalizeFallbacks() {
+	list := append([]string{}, b.Fallbacks...)
+	if b.Fallback != "" {
+		list = append(list, strings.Split(b.Fallback, ",")...)
+	}
+	b.Fallback = ""
+	b.Fallbacks = nil
+	for _, f := range list {
+		f = strings.TrimSpace(f)
+		if f == "" || strings.EqualFold(f, b.Name) || slices.ContainsFunc(b.Fallbacks, func(s string) bool { return strings.EqualFold(s, f) }) {
+			continue
+		}
+		b.Fallbacks = append(b.Fallbacks, f)
+	}
+}
+
 var singleRun bool = false                //Should we do a single runonly = nowebserver
 var commentPrefix string = ""             //The prefix we use as a comment indicator the booking is ours
 var bindAddress string = ":1323"          //The default bind port of web server
 var jsonTeam string                       //The Basic Auth team of webserer
 var jsonPwd string                        //The Basic Auth password of webserver
 var jsonProtect bool                      //Should the web server use Basic Auth
-var textUrl string                        //Default backend url
-var guiUrl string                         //The gui url towards the fleet.eu backend
-var authUrl string                        //Backend url towards authentication
 var test string = ""                      //The test we should be running, means allways single ru
 var title string = ""                     //The title string
 var mutex *sync.Mutex = &sync.Mutex{}     //The lock used where writing files
@@ -232,7 +268,6 @@ var whatsAppLog waLog.Logger              //WhatsApp logger
 var teams []TeamInterface                 //The security teams
 var db *sql.DB                            //The Database
 var whatsAppContainer *sqlstore.Container //The whatsapp datacontainer
-var dbType string = "sqlite3"             //The Database type
 
 // Simple iif function to select value
 func iif(a, b string) string {
@@ -339,29 +374,13 @@ func TeamFilter(arr interface{}, teamName string) interface{} {
 	return newContent.Interface()
 }
 
-func Upgrade() {
-	var v VersionInterface = VersionInterface{Version: AppVersion}
-	if _, err := os.Stat(versionFile); !errors.Is(err, os.ErrNotExist) {
-		file, _ := os.ReadFile(bookingFile)
-		json.Unmarshal(file, &v)
-	}
-	if v.Version != AppVersion {
-		//Add code here to do a upgrade, step by step for each version
-
-		//Upgrade finished Write the new version number
-		v.Version = AppVersion
-		json_to_file, _ := json.Marshal(v)
-		os.WriteFile(versionFile, json_to_file, 0755)
-	}
-}
-
 func updateTimeZone() {
 	//Get the local time zone
 	loc, err := time.LoadLocation(timeZoneLoc)
 	if err != nil {
 		log.Fatal(err)
 	}
-	tz := time.Now().In(loc).Format("-07:00")
+	tz := timeNow().In(loc).Format("-07:00")
 	if tz != timeZone {
 		log.Info("TimeZone: " + tz)
 		timeZone = tz
@@ -378,6 +397,13 @@ func Init() {
 	setEnvValue("FLEETVERSION", &myFleetVersion)
 	setEnvValue("LOGLEVEL", &logLevel)
 	setEnvValue("TITLE", &title)
+	setEnvValue("FLEETURL", &fleetUrl)
+	setEnvValue("SMTPHOST", &smtpHost)
+	setEnvValue("SMTPUSER", &smtpUser)
+	setEnvValue("SMTPPWD", &smtpPwd)
+	setEnvValue("SMTPFROM", &smtpFrom)
+	setEnvValue("METRICSTOKEN", &metricsToken)
+	setEnvValue("DSN", &dsn)
 	setEnvBoolValue("WHATSAPP", &whatsApp)
 	setEnvBoolValue("PLANNER", &planner)
 
@@ -387,8 +413,14 @@ func Init() {
 	flag.StringVar(&timeZoneLoc, "timezone", timeZoneLoc, "The timezone location used by user")
 	flag.IntVar(&refreshInterval, "refresh", refreshInterval, "The iterval in seconds used for refeshing")
 	flag.IntVar(&bookWindow, "bookWindow", bookWindow, "The interval in hours for allowed bookings")
+	flag.IntVar(&minDuration, "minDuration", minDuration, "The minimal duration in minutes required to book")
 	flag.IntVar(&maxRetry, "maxRetry", maxRetry, "The maximum retry's before failing, 0=disabled")
 	flag.IntVar(&confirmTime, "confirmTime", confirmTime, "The time before confirming, 0=disabled")
+	flag.IntVar(&reconcileInterval, "reconcile", reconcileInterval, "The interval in minutes our reservations are compared with my-fleet, 0=disabled")
+	flag.BoolVar(&rebook, "rebook", rebook, "Should we book again when a reservation is canceled outside the robot")
+	flag.StringVar(&recordGrid, "recordGrid", recordGrid, "The directory the scraped boat grids are recorded in for the replay")
+	flag.StringVar(&timeShift, "timeShift", timeShift, "Run at a shifted time, a duration like 36h or a start time like 2006-01-02T15:04:05+01:00")
+	flag.BoolVar(&dryRun, "dryRun", dryRun, "Should we only record the reservations we would make, without changing my-fleet")
 	flag.IntVar(&sleepOffset, "sleepOffset", sleepOffset, "The time used as sleepoffset")
 	flag.StringVar(&bindAddress, "bind", bindAddress, "The bind address to be used for webserver")
 	flag.StringVar(&jsonTeam, "jsonTeam", jsonTeam, "The team name to protect jsondata")
@@ -398,10 +430,22 @@ func Init() {
 	flag.StringVar(&logLevel, "logLevel", logLevel, "The log level to use")
 	flag.StringVar(&title, "title", title, "The title to use in app")
 	flag.StringVar(&logFile, "logFile", logFile, "The logFile where we should write log information to")
+	flag.IntVar(&sessionTimeout, "sessionTimeout", sessionTimeout, "The time in minutes an idle my-fleet session is reused")
 	flag.BoolVar(&whatsApp, "whatsApp", whatsApp, "Should we use WhatsApp to send a message")
 	flag.BoolVar(&planner, "planner", planner, "Should we use planner")
 	flag.BoolVar(&addTime, "addTime", planner, "Should we enable AddTime")
+	flag.IntVar(&tokenLifetime, "tokenLifetime", tokenLifetime, "The time in hours a session token is valid")
+	flag.StringVar(&vaultKeyFile, "vaultKeyFile", vaultKeyFile, "The file holding the key used to encrypt the stored passwords")
+	flag.StringVar(&rotateVaultKey, "rotateVaultKey", rotateVaultKey, "Rotate the vault to the key in this file and exit, a new key is created when the file does not exist")
+	flag.StringVar(&smtpHost, "smtpHost", smtpHost, "The smtp server used to send email notifications")
+	flag.StringVar(&smtpPort, "smtpPort", smtpPort, "The port of the smtp server")
+	flag.StringVar(&smtpUser, "smtpUser", smtpUser, "The user of the smtp server")
+	flag.StringVar(&smtpFrom, "smtpFrom", smtpFrom, "The from address of email notifications")
+	flag.IntVar(&notifyRetry, "notifyRetry", notifyRetry, "The number of delivery attempts of a notification")
 	flag.StringVar(&test, "test", test, "The test action to perform")
+	flag.StringVar(&fleetUrl, "fleetUrl", fleetUrl, "The base url of the my-fleet server")
+	flag.StringVar(&fakeFleet, "fakeFleet", fakeFleet, "Start a fake my-fleet server on this address and use it")
+	flag.StringVar(&dsn, "dsn", dsn, "The database, a postgres:// url or a sqlite:// file, empty for the default SQLite file")
 
 	flag.Parse() // after declaring flags we need to call it
 	if *version {
@@ -429,447 +473,117 @@ func Init() {
 
 	//Only enable jsonProtection if we have a username and password
 	jsonProtect = (jsonTeam != "" && jsonPwd != "")
-	guiUrl = "https://my-fleet.eu/" + myFleetVersion + "/gui/index.php"
-	textUrl = "https://my-fleet.eu/" + myFleetVersion + "/text/index.php"
-	authUrl = "https://my-fleet.eu/" + myFleetVersion + "/text/authenticate.php"
+	//Shift the clock of the booking logic
+	if err := setTimeShift(timeShift); err != nil {
+		log.Fatal(err)
+	}
+	if timeShift != "" {
+		log.Warn("Running at shifted time ", timeNow().Format(time.RFC3339))
+	}
+	//Start the fake my-fleet server when requested and use it as backend
+	if fakeFleet != "" {
+		fleetUrl = startFakeFleet(fakeFleet)
+	}
+	fleetClient = metricsFleetClient{next: auditFleetClient{next: newMyFleetWeb(strings.TrimRight(fleetUrl, "/") + "/" + myFleetVersion)}}
+	//A dry run only reads my-fleet and records the reservation changes
+	if dryRun {
+		dryRunRecorder = newDryRunFleetClient(fleetClient)
+		fleetClient = dryRunRecorder
+		log.Warn("Dry run enabled, reservations are only recorded")
+	}
 
 	//Get the local time zone
 	updateTimeZone()
 
-	//Create the db path if it does not exists
+	//Create the db path if it does not exists, it also holds the cached boat list
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		err := os.MkdirAll(filepath.Dir(dbPath), 0755)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	//Read the teams once, are also read on every login
-	teams = readTeamJson()
-	//If we have a teams file enable jsonProtect
-	if len(teams) != 0 {
-		jsonProtect = true
-	}
-
-	//Log the version
-	log.Info(AppName + " v" + AppVersion)
-}
-
-// Logout for the specified booking
-func logout(booking *BookingInterface) error {
-	//Just check if we have a session
-	if booking.Cookies != nil {
-		var random string = fmt.Sprint(time.Now().Nanosecond())
-		//Calling auth with new random will kill the sessie
-		request, _ := http.NewRequest(http.MethodGet, authUrl+"?random="+random, nil)
-		for _, o := range booking.Cookies {
-			request.AddCookie(o)
-		}
-		client := &http.Client{}
-		client.Do(request)
-	}
-	booking.Cookies = nil
-	return nil
-}
-
-func session(booking *BookingInterface) error {
-	//We use the textUrl and guiUrl to get the session cookie
-	response, err := http.Get(textUrl + "?clubname=" + clubId + "&variant=")
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	booking.Cookies = response.Cookies()
-	response, err = http.Get(guiUrl + "?clubname=" + clubId + "&variant=")
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	booking.Cookies = append(booking.Cookies, response.Cookies()...)
-
-	//Get the GuiStartEpoch and GuiFleetId
-	request, _ := http.NewRequest(http.MethodGet, guiUrl+"?clubname="+clubId, nil)
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	client := &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	b, _ := io.ReadAll(response.Body)
-	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(string(b)))
-	// Find the sunrise, sunset, min and max times allowed
-	doc.Find("form").Each(func(base int, basehtml *goquery.Selection) {
-		basehtml.Find("input").Each(func(baseint int, basein *goquery.Selection) {
-			val, exists := basein.Attr("name")
-			if exists && val == "start" {
-				val, exists = basein.Attr("value")
-				if exists {
-					theTime, err := time.Parse(time.RFC3339, (strings.Fields(val)[0])+"T"+(strings.Fields(val)[1])+":00"+timeZone)
-					if err == nil {
-						booking.GuiEpochStart = theTime.Unix()
-					}
-				}
-			}
-		})
-	})
-
-	doc.Find("link").Each(func(base int, basehtml *goquery.Selection) {
-		_, exists := basehtml.Attr("media")
-		val, exists2 := basehtml.Attr("href")
-		if exists && exists2 { //href=index.php?a=i&uniq=myfleet62e7e8ea838ba
-			re := regexp.MustCompile(`.*uniq=(.*)$`)
-			booking.GuiFleetId = re.FindStringSubmatch(val)[1]
+	//Open the database of the storage backend and upgrade it to the latest schema
+	if dsn == "embedded" {
+		if dsn, err = startEmbedded(); err != nil {
+			log.Fatal(err)
 		}
-	})
-	if booking.GuiFleetId == "" || booking.GuiEpochStart == 0 {
-		return errors.New("GuiFleetId or GuiEpochStart not found")
-	}
-	//log.Info("GuiEpochStart:", booking.GuiEpochStart)
-	return nil
-}
-
-// Login for the specified booking and save the required cookie
-func login(booking *BookingInterface) error {
-	random := fmt.Sprint(time.Now().Nanosecond())
-	if err := session(booking); err != nil {
-		return err
-	}
-
-	//First get authentication killling old session
-	request, _ := http.NewRequest(http.MethodGet, authUrl+"?random="+random, nil)
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-	//Now post the our info to login
-	data := url.Values{}
-	data.Set("un", booking.Username)
-	data.Set("pw", booking.Password)
-	request, _ = http.NewRequest(http.MethodPost, authUrl+"?random="+random,
-		strings.NewReader(data.Encode()))
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		log.Error(err)
-		return err
 	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-	b, _ := io.ReadAll(response.Body)
-	//Correct loging
-	if !strings.Contains(string(b), "Exit Page") {
-		return errors.New("Login response invalid:" + string(b))
-	}
-
-	//Now get the user ID
-	request, _ = http.NewRequest(http.MethodGet, textUrl+"?clubname="+clubId+"&variant=", nil)
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	client = &http.Client{}
-	response, err = client.Do(request)
+	storage = newStorage(dsn)
+	db, err = storage.Open()
 	if err != nil {
-		log.Error(err)
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-	b, _ = io.ReadAll(response.Body)
-	re := regexp.MustCompile(`brsuser=(.*)"`)
-	rem := re.FindStringSubmatch(string(b))
-	booking.UserId = 0
-	if len(rem) > 0 {
-		booking.UserId, _ = strconv.ParseInt(rem[1], 10, 64)
-	}
-	if booking.UserId == 0 {
-		return errors.New("User id not found")
-	}
-
-	//Get the new GuiFleedId
-	request, _ = http.NewRequest(http.MethodGet, guiUrl+"?language=NL&brsuser="+strconv.FormatInt(booking.UserId, 10)+"&clubname="+clubId, nil)
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
+		log.Fatal(err)
 	}
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		log.Error(err)
-		return err
+	log.Info("Using database ", storage)
+	if err = Upgrade(); err != nil {
+		log.Fatal(err)
 	}
-	defer response.Body.Close()
-	bs, _ := io.ReadAll(response.Body)
-	booking.Cookies = append(booking.Cookies, response.Cookies()...)
-
-	re = regexp.MustCompile(`&uniq=(.*)"`)
-	rem = re.FindStringSubmatch(string(bs))
-	if len(rem) == 0 {
-		return errors.New("GuiFleedId not found")
+	if err = loadTokenSecret(); err != nil {
+		log.Fatal(err)
 	}
-	booking.GuiFleetId = rem[1]
-
-	return nil
-
-}
-
-// Cancel a booking
-func boatCancel(booking *BookingInterface) error {
-	var err error
-	//STEP: Create Reference to the booking
-	request, err := http.NewRequest(http.MethodGet, guiUrl, nil)
-	values := request.URL.Query()
-	values.Set("a", "e")
-	values.Set("menu", "Omenu")
-	values.Set("extrainfo", "mid="+booking.BoatId+
-		"&co=0&rid="+booking.BookingId+
-		"&from="+strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10)+
-		"&dur="+strconv.FormatInt(int64(booking.BookDur/15), 10)+"&rec=0&user="+strconv.FormatInt(booking.UserId, 10))
-	request.URL.RawQuery = values.Encode()
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
+	//Load the credential vault, rotate the key when requested and encrypt the plain text passwords
+	if err = loadVaultKey(); err != nil {
+		log.Fatal(err)
 	}
-	if err != nil {
-		return err
+	if rotateVaultKey != "" {
+		if err = rotateVault(rotateVaultKey); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
 	}
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return err
+	if err = migrateSecrets(); err != nil {
+		log.Fatal(err)
 	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-
-	//Step 2: Login to the reference
-	data := url.Values{}
-	data.Set("newStart", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10))
-	data.Set("newEnd", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart+booking.BookDur*60)/(15*60)), 10))
-	//	data.Set("clubcode", "")
-	//	data.Set("username", booking.Username)
-	//	data.Set("password", booking.Password)
-	request, _ = http.NewRequest(http.MethodPost, guiUrl+"?a=e&menu=Rmenu&page=1_cancel", strings.NewReader(data.Encode()))
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		return err
+	if jsonProtect {
+		if err = upsertEnvTeam(); err != nil {
+			log.Fatal(err)
+		}
 	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
+	//Read the teams once, are also read on every login
+	teams = readTeams()
+	//If we have a teams file enable jsonProtect
+	if len(teams) != 0 {
+		jsonProtect = true
 	}
 
-	booking.State = "Canceled"
-	booking.BookDur = 0
-	booking.BookStart = 0
-	return err
+	//Log the version
+	log.Info(AppName + " v" + AppVersion)
 }
 
 // Confirm a booking
 func confirmBoat(booking *BookingInterface) error {
-	log.Error("Confirm Boat not implemented")
-	return nil
-}
-
-// Update a boat booking start and end time
-func boatBook(booking *BookingInterface, startTime int64, endTime int64) error {
-	//STEP: Session
-	booking.BookingId = ""
-
-	//STEP: Create Reference to the booking
-	request, err := http.NewRequest(http.MethodGet, guiUrl, nil)
-	values := request.URL.Query()
-	values.Set("a", "e")
-	values.Set("menu", "Amenu")
-	values.Set("extrainfo", "mid="+booking.BoatId+
-		"&from="+strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10)+
-		"&dur="+strconv.FormatInt(int64(((endTime-startTime)/60)/15), 10))
-	request.URL.RawQuery = values.Encode()
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	if err != nil {
-		return err
-	}
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-
-	//Step 2: Login to the reference
-	data := url.Values{}
-	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
-	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
-	team, err := getTeamByName(booking.Team)
-	c := cif(err == nil, iif(team.Prefix, commentPrefix), commentPrefix) + booking.Comment
-	if c != "" {
-		data.Set("comment", c)
-	}
-	data.Set("act", "Verder\n>>")
-	request, _ = http.NewRequest(http.MethodPost, guiUrl+"?a=e&menu=Amenu&page=1_single", strings.NewReader(data.Encode()))
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	//request.Header.Set("Referer", guiUrl+"?"+values.Encode())
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-	//Check if the boat is the boat we where looking for
-	//Read the booking id form the reponse
-	b, _ := io.ReadAll(response.Body)
-	re := regexp.MustCompile(`ReservationId = (.*) `)
-	rem := re.FindStringSubmatch(string(b))
-	if len(rem) > 0 {
-		booking.BookingId = strings.Trim(rem[1], " ")
-	}
 	if booking.BookingId == "" {
-		return errors.New("Failed to create reservation")
-	}
-	//Save the real booking start and duration
-	booking.BookDur = (endTime - startTime) / 60
-	booking.BookStart = startTime
-	return nil
-}
-
-// Update a boat booking start and end time
-func boatUpdate(booking *BookingInterface, startTime int64, endTime int64) error {
-
-	//STEP: Create Reference to the booking
-	request, err := http.NewRequest(http.MethodGet, guiUrl, nil)
-	values := request.URL.Query()
-	values.Set("a", "e")
-	values.Set("menu", "Rmenu")
-	values.Set("extrainfo", "mid="+booking.BoatId+
-		"&co=0&rid="+booking.BookingId+
-		"&from="+strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10)+
-		"&dur="+strconv.FormatInt(int64(((startTime-endTime)/60)/15), 10)+"&rec=0")
-	request.URL.RawQuery = values.Encode()
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	if err != nil {
-		return err
+		return errors.New("No reservation to confirm")
 	}
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-
-	//Step 2: Login to the reference
-	data := url.Values{}
-	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
-	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
-	data.Set("clubcode", "")
-	data.Set("username", booking.Username)
-	data.Set("password", booking.Password)
-	request, _ = http.NewRequest(http.MethodPost, guiUrl+"?a=e&menu=Rmenu&page=1_modifylogbook", strings.NewReader(data.Encode()))
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
+	if err := fleetSessions.Acquire(booking); err != nil {
 		return err
 	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
-	}
-	//Check if the boat is the boat we where looking for
-
-	//STEP: Update the booking
-	data = url.Values{}
-	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
-	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
-	team, err := getTeamByName(booking.Team)
-	c := cif(err == nil, iif(team.Prefix, commentPrefix), commentPrefix) + booking.Comment
-	if c != "" {
-		data.Set("comment", c)
-	}
-	data.Set("page", "3_commit")
-	data.Set("act", "Ok")
-	request, _ = http.NewRequest(http.MethodPost, guiUrl+"?a=e&menu=Amenu", strings.NewReader(data.Encode()))
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client = &http.Client{}
-	response, err = client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return errors.New("HTTP Status is out of the 2xx range")
+	defer fleetSessions.Release(booking)
+	err := fleetClient.Confirm(booking)
+	//Retry once with a new login when the session has expired
+	if errors.Is(err, errSessionExpired) {
+		if err = fleetSessions.Renew(booking); err != nil {
+			return err
+		}
+		err = fleetClient.Confirm(booking)
 	}
-	//Save the real booking start and duration
-	booking.BookDur = (endTime - startTime) / 60
-	booking.BookStart = startTime
-	return nil
+	return err
 }
 
-func guiAction(booking *BookingInterface, action string) (string, error) {
-	request, _ := http.NewRequest(http.MethodGet, guiUrl, nil)
-	values := request.URL.Query()
-	values.Set("a", action)
-	values.Set("uniq", booking.GuiFleetId)
-	request.URL.RawQuery = values.Encode()
-	for _, o := range booking.Cookies {
-		request.AddCookie(o)
-	}
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return "", err
+// Cancel the reservation of the booking in my-fleet
+func cancelBoat(booking *BookingInterface) error {
+	if err := fleetSessions.Acquire(booking); err != nil {
+		return err
 	}
-	defer response.Body.Close()
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		return "", err
+	defer fleetSessions.Release(booking)
+	err := fleetClient.Cancel(booking)
+	//Retry once with a new login when the session has expired
+	if errors.Is(err, errSessionExpired) {
+		if err = fleetSessions.Renew(booking); err != nil {
+			return err
+		}
+		err = fleetClient.Cancel(booking)
 	}
-	bd, _ := io.ReadAll(response.Body)
-	return string(bd), nil
+	return err
 }
 
 // Read the boat list and create it if not found
@@ -882,7 +596,7 @@ func readBoatJson(book *BookingInterface, maxAge int) ([]string, BoatListStruct)
 	boats := BoatListStruct{}
 	if book == nil {
 		booking = &BookingInterface{}
-		if err := session(booking); err != nil {
+		if err := fleetClient.Session(booking); err != nil {
 			log.Error("Read boat no booking", err)
 			return blist, boats
 		}
@@ -892,95 +606,28 @@ func readBoatJson(book *BookingInterface, maxAge int) ([]string, BoatListStruct)
 		fs, err = os.Stat(boatFile)
 	}
 	//We need to check if we have the boat file, load it for the first authorized
+	//The file times are on the system clock, so the age is not measured by the clock of the booking logic
 	if errors.Is(err, os.ErrNotExist) || fs.ModTime().Before(time.Now().Add(-time.Duration(maxAge)*time.Second)) {
-		//Get the unix start time of screen
-		str, err := guiAction(booking, "b")
+		//Scrape the boat grid
+		list, err := fleetClient.ListBoats(booking)
 		if err != nil {
-			log.Error("GuiSession Failed", err)
+			log.Error("Boat list error", err)
 			return blist, boats
 		}
-		epochStart := int64(0)
-		re := regexp.MustCompile(`var starttime_unix = "(.*)";`)
-		rem := re.FindStringSubmatch(str)
-		if len(rem) > 0 {
-			epochStart, _ = strconv.ParseInt(rem[1], 10, 64)
-		}
-
-		//Get the content of screen
-		str, err = guiAction(booking, "c")
-		if err != nil {
-			log.Error("GuiSession Failed", err)
-			return blist, boats
+		boats = list
+		blist = []string{}
+		for _, b := range boats {
+			blist = append(blist, b.Name)
 		}
-		re = regexp.MustCompile(`var info=(.*);`)
-		rem = re.FindStringSubmatch(str)
-		if len(rem) > 0 {
-			/* Parse the boat list*/
-			type BoatStruct []struct {
-				M struct {
-					BoatId   int      `json:"i"`
-					BoatInfo []string `json:"c"` //  [name,type,location,weigth,spacer,permision]
-				} `json:"m"`
-				R []struct {
-					P  string  `json:"p"`
-					S  string  `json:"s"`
-					X  float64 `json:"x"`
-					W  float64 `json:"w"`
-					U  string  `json:"u"`
-					C  string  `json:"c"`
-					ID string  `json:"id"`
-				} `json:"r"`
-			}
-			webboats := BoatStruct{}
-			err := json.Unmarshal([]byte(rem[1]), &webboats)
-			if err == nil {
-				blist = []string{}
-				re = regexp.MustCompile(`var grid_width = (.*);`)
-				rem = re.FindStringSubmatch(str)
-				pixelToMin := float64(12)
-				if len(rem) > 0 {
-					pixelToMin, _ = strconv.ParseFloat(rem[1], 64)
-				}
-				for _, b := range webboats {
-					//Create a new boat
-					bname := strings.Split(b.M.BoatInfo[0], "\u0026")[0]
-					bc := BoatElementStruct{Id: b.M.BoatId, Name: bname, Type: b.M.BoatInfo[1],
-						Location: b.M.BoatInfo[2], WeigthClass: b.M.BoatInfo[3],
-						Permission: strings.Split(b.M.BoatInfo[4], "\u0026")[0]}
-					//Add all bookings
-					for _, bb := range b.R {
-						if (bb.S == "B" || bb.S == "R") && bb.W > 0 {
-							//The color code indicaties a window not available
-							bbb := BoatElementBookingStruct{
-								Type:        cif(bb.C == "#404040", "N", cif(bb.ID == "", "S", bb.S)),
-								EpochStart:  epochStart + int64((bb.X/pixelToMin)*(15*60)),
-								EpochEnd:    epochStart + int64((bb.X+bb.W)/pixelToMin)*(15*60),
-								Duration:    int64(bb.W/pixelToMin) * 15,
-								BookingId:   bb.ID,
-								BookingInfo: bb.U,
-							}
-							//Add the booking
-							bc.Bookings = append(bc.Bookings, bbb)
-						}
-					}
-					//Save it to the boats list
-					boats = append(boats, bc)
-					blist = append(blist, bname)
-				}
-				json_to_file, _ := json.Marshal(boats)
-				mutex.Lock()
-				if book != nil {
-					os.WriteFile(boatFile, json_to_file, 0755)
-				}
-				json_to_file, _ = json.Marshal(blist)
-				os.WriteFile(boatNameFile, json_to_file, 0755)
-				mutex.Unlock()
-
-			}
-			if err != nil {
-				log.Error("Boat list error", err)
-			}
+		json_to_file, _ := json.Marshal(boats)
+		mutex.Lock()
+		if book != nil {
+			os.WriteFile(boatFile, json_to_file, 0755)
 		}
+		json_to_file, _ = json.Marshal(blist)
+		os.WriteFile(boatNameFile, json_to_file, 0755)
+		mutex.Unlock()
+		events.Publish("boats", "", blist)
 		return blist, boats
 	}
 
@@ -1003,194 +650,59 @@ func readBoatJson(book *BookingInterface, maxAge int) ([]string, BoatListStruct)
 	return blist, boats
 }
 
-// Read the  user info
-func readWhatsAppJson() []WhatsAppToInterface {
-	var b []WhatsAppToInterface
-	var u WhatsAppToInterface = WhatsAppToInterface{To: "?"}
-	b = append(b, u)
-	if _, err := os.Stat(whatsAppFile); errors.Is(err, os.ErrNotExist) {
-		return b
-	}
-	file, err := os.ReadFile(whatsAppFile)
-	if err == nil {
-		err = json.Unmarshal(file, &b)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	return b
-}
-
-// Write the user info to file
-func writeWhatsAppJson(data []WhatsAppToInterface) {
-	for i := len(data) - 1; i >= 0; i-- {
-		if data[i].To == "?" || data[i].LastUsed < time.Now().Add(-30*24*time.Hour).Unix() {
-			data = append(data[:i], data[i+1:]...)
-		}
-	}
-	json_to_file, _ := json.Marshal(data)
-	mutex.Lock()
-	err := os.WriteFile(whatsAppFile, json_to_file, 0755)
-	mutex.Unlock()
-	if err != nil {
-		log.Error(err)
-	}
-}
-
-// Read the  group info
-func readTeamJson() []TeamInterface {
-	var b []TeamInterface
-	if jsonProtect {
-		b = append(b, TeamInterface{Id: 0, Admin: true, Team: jsonTeam, Password: jsonPwd, Title: title, Prefix: commentPrefix, Planner: false})
-	}
-	if _, err := os.Stat(teamFile); errors.Is(err, os.ErrNotExist) {
-		return b
-	}
-	file, err := os.ReadFile(teamFile)
-	if err == nil {
-		err = json.Unmarshal(file, &b)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	return b
-}
-
-// Write the group info to file
-func writeTeamJson(data []TeamInterface) {
-	json_to_file, _ := json.Marshal(data)
-	mutex.Lock()
-	err := os.WriteFile(teamFile, json_to_file, 0755)
-	mutex.Unlock()
-	if err != nil {
-		log.Error(err)
-	}
-}
-
-// Read the  user info
-func readUsersJson() []UserInterface {
-	var b []UserInterface
-	var u UserInterface = UserInterface{Username: "?", Password: "?"}
-	b = append(b, u)
-	if _, err := os.Stat(userFile); errors.Is(err, os.ErrNotExist) {
-		return b
-	}
-	file, err := os.ReadFile(userFile)
-	if err == nil {
-		err = json.Unmarshal(file, &b)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	return b
-}
-
-// Write the user info to file
-func writeUsersJson(data []UserInterface) {
-	for i := len(data) - 1; i >= 0; i-- {
-		if data[i].Username == "?" || data[i].LastUsed < time.Now().Add(-30*24*time.Hour).Unix() {
-			data = append(data[:i], data[i+1:]...)
-		}
-	}
-	json_to_file, _ := json.Marshal(data)
-	mutex.Lock()
-	err := os.WriteFile(userFile, json_to_file, 0755)
-	mutex.Unlock()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// Read the booking informatio
-func readBookingJson() BookingSlice {
-	b := BookingSlice{}
-	if _, err := os.Stat(bookingFile); errors.Is(err, os.ErrNotExist) {
-		return b
-	}
-	mutex.Lock()
-	file, err := os.ReadFile(bookingFile)
-	mutex.Unlock()
-	if err != nil {
-		log.Error(err)
-	} else {
-		err = json.Unmarshal(file, &b)
-		if err != nil {
-			//We have a error try to recover the backup file
-			log.Error(err)
-			if _, err := os.Stat(bookingFile + ".bak"); errors.Is(err, os.ErrNotExist) {
-				writeBookingJson(b)
-			} else {
-				mutex.Lock()
-				file, _ = os.ReadFile(bookingFile + ".bak")
-				mutex.Unlock()
-				err = json.Unmarshal(file, &b)
-				if err != nil {
-					writeBookingJson(b)
-				}
-			}
-		}
-	}
-	return b
-}
-
-// Write the data to the booking file, removing expired data
-func writeBookingJson(data BookingSlice) {
-	for i := len(data) - 1; i >= 0; i-- {
-		if data[i].State == "Delete" {
-			log.WithFields(log.Fields{
-				"state":    data[i].State,
-				"boat":     data[i].Name,
-				"fallback": data[i].Fallback,
-				"user":     data[i].Username,
-				"at":       shortDate(data[i].Date),
-				"from":     shortTime(data[i].Time),
-			}).Info("Deleting")
-			data = append(data[:i], data[i+1:]...)
-		}
-	}
-	json_to_file, _ := json.Marshal(data)
-	mutex.Lock()
-	os.Rename(bookingFile, bookingFile+".bak")
-	err := os.WriteFile(bookingFile, json_to_file, 0755)
-	mutex.Unlock()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 // Function where al checks are done for a single booking and make the booking
 func doBooking(b *BookingInterface) (changed bool, err error) {
 
 	//Check thif booking should be canceled
 	if b.State == "Cancel" {
-		return true, boatCancel(b)
+		//Nothing is reserved in my-fleet
+		if b.BookingId == "" {
+			b.State = "Canceled"
+			return true, nil
+		}
+		err = fleetClient.Cancel(b)
+		return !errors.Is(err, errSessionExpired), err
 	}
 
 	//Check if we should mark record for removal, after 12 hours
-	if b.EpochEnd < time.Now().Add(-time.Hour*24).Unix() {
-		log.Debug("Delete", b.EpochEnd, "<", time.Now().Add(-time.Hour*12).Unix())
+	if b.EpochEnd < timeNow().Add(-time.Hour*24).Unix() {
+		log.Debug("Delete", b.EpochEnd, "<", timeNow().Add(-time.Hour*12).Unix())
 		b.State = "Delete"
 		b.Message = "Booking marked for Delete"
 		return true, nil
 	}
 
 	//Check fail a booking in the past
-	if b.EpochStart < time.Now().Unix() {
+	if b.EpochStart < timeNow().Unix() {
 		b.State = "Failed"
 		b.Message = "Booking in the past"
 		return true, nil
 	}
 
-	//Check if we have a blocked item and a fallback is set
+	//Check if we have a blocked item and try the next fallback, each attempt is added to the logs
 	if b.State == "Blocked" {
-		if b.Fallback != "" {
-			b.Message = "using fallback " + b.Fallback + " for boat " + b.Name
-			b.Name = b.Fallback
-			b.Fallback = ""
+		if b.byCriteria() && b.FallbackIndex < len(matchingBoats(b)) {
+			//Select the next best matching boat
+			b.FallbackIndex++
+			b.Message = "Attempt " + strconv.Itoa(b.FallbackIndex+1) + ": selecting an other boat matching " + b.BoatLabel()
+			b.Logs = append(b.Logs, LogStruct{Date: timeNow().Unix(), State: b.State, Log: b.Message})
 			b.State = "Retry"
-			return true, nil
+			b.Retry = 0
+		} else if !b.byCriteria() && b.FallbackIndex < len(b.Fallbacks) {
+			bookingFallbacks.WithLabelValues(b.Team).Inc()
+			blocked := b.CurrentBoat()
+			b.FallbackIndex++
+			b.Message = "Attempt " + strconv.Itoa(b.FallbackIndex+1) + " of " + strconv.Itoa(len(b.Fallbacks)+1) +
+				": " + blocked + " is blocked, using fallback " + b.CurrentBoat()
+			b.Logs = append(b.Logs, LogStruct{Date: timeNow().Unix(), State: b.State, Log: b.Message})
+			b.State = "Retry"
+			b.Retry = 0
 		} else {
 			b.State = "Failed"
+			b.Message = "All " + strconv.Itoa(b.FallbackIndex+1) + " boats blocked, last " + b.CurrentBoat()
+			if b.byCriteria() {
+				b.Message = "No boat matching " + b.BoatLabel() + " available after " + strconv.Itoa(b.FallbackIndex+1) + " attempts"
+			}
 			return true, err
 		}
 	}
@@ -1198,9 +710,21 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 	//Create local time zone for printing
 	loc, _ := time.LoadLocation(timeZoneLoc)
 
-	//Check if we have a booking for the requested boat date and time
+	//Check if we have a booking for the requested, fallback or selected boat date and time
+	boat, exact := b.CurrentBoat(), false
+	if b.BookingId != "" && b.BookedBoat != "" {
+		boat, exact = b.BookedBoat, true //Locked onto the booked boat
+	} else if b.byCriteria() {
+		selected := selectBoat(b)
+		if selected == nil {
+			b.State = "Blocked"
+			b.Message = "No boat matching " + b.BoatLabel() + " available"
+			return true, err
+		}
+		boat, exact = selected.Name, true
+	}
 	for _, bs := range *b.Boats { //Find the boat in the BoatsList
-		if strings.Contains(strings.ToLower(bs.Name), strings.ToLower(b.Name)) {
+		if (exact && strings.EqualFold(bs.Name, boat)) || (!exact && strings.Contains(strings.ToLower(bs.Name), strings.ToLower(boat))) {
 			var sunrise int64 = 0            //EpochData is good enough for Sunrise
 			var sunset int64 = math.MaxInt64 //EpochEnd is good enough for Sunset
 			var sunsetWindow int64 = sunset
@@ -1242,16 +766,17 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 						if b.State == "Moving" {
 							log.WithFields(log.Fields{
 								"state": b.State,
-								"boat":  b.Name,
+								"boat":  boat,
 								"user":  b.Username,
 								"at":    shortDate(b.Date),
 								"from":  shortTime(b.Time),
 							}).Info("Canceled because of blocked by " + bb.BookingInfo)
-							err = boatCancel(b)
+							err = fleetClient.Cancel(b)
 						}
 						b.State = "Blocked"
-						b.Message = "booking blocked by " + bb.BookingInfo
+						b.Message = "booking of " + boat + " blocked by " + bb.BookingInfo
 						b.BookingId = ""
+						b.BookedBoat = ""
 						return true, err
 					}
 					//Skip to next boat because we are not looking for this one
@@ -1311,7 +836,10 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 
 					//Check if their is a reason to update the booking
 					if starttime > bb.EpochStart || endtime > bb.EpochEnd {
-						err = boatUpdate(b, starttime, endtime)
+						err = fleetClient.Update(b, starttime, endtime)
+						if errors.Is(err, errSessionExpired) {
+							return false, err //Retry with a new session
+						}
 						if err != nil {
 							b.State = "Blocked" //Try fallback to do
 						} else {
@@ -1334,8 +862,13 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 
 			//Get the boat ID and start the booking process
 			b.BoatId = strconv.Itoa(bs.Id)
-			err := boatBook(b, starttime, endtime)
+			err := fleetClient.Book(b, starttime, endtime)
+			if errors.Is(err, errSessionExpired) {
+				return false, err //Retry with a new session
+			}
 			if err == nil { //We found the boat and could book it
+				observeBooked(b)
+				b.BookedBoat = bs.Name
 				loc, _ := time.LoadLocation(timeZoneLoc)
 				if b.EpochStart == starttime && b.EpochEnd == endtime {
 					b.State = "Finished"
@@ -1346,7 +879,7 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 				b.Retry = 0
 			} else {
 				b.State = "Blocked"
-				b.Message = "Boat not bookable " + b.Name
+				b.Message = "Boat not bookable " + boat
 			}
 			return true, err
 		} //If boat found
@@ -1355,266 +888,135 @@ func doBooking(b *BookingInterface) (changed bool, err error) {
 	//Boat not found in the list
 	log.WithFields(log.Fields{
 		"state": b.State,
-		"boat":  b.Name,
+		"boat":  boat,
 		"user":  b.Username,
 		"at":    shortDate(b.Date),
 		"from":  shortTime(b.Time),
 		"boats": b.Boats,
 	}).Info("Boat not found")
 	b.State = "Blocked"
-	b.Message = "Boat not found " + b.Name
+	b.Message = "Boat not found " + boat
 	return true, err
 
 }
 
-// The main loop in which we do all the booking processing
-func bookLoop() {
-	log.Info("Start processing")
-	var changed bool = false
-	//Timing loop
-	for {
-		//Read de bookings
-		bookingSlice := readBookingJson()
-		wg := sync.WaitGroup{}
-		for i := range bookingSlice {
-			wg.Add(1)
-			//We process a booking in parallel
-			go func(booking *BookingInterface, changed *bool, wg *sync.WaitGroup) {
-				var err error
-				//At return of parallel task we changed decrease WaitGroup and log if changed
-				defer func() {
-					//If data has been changed update the booking array
-					if booking.Changed {
-						*changed = true
-						if booking.State == "Retry" {
-							booking.EpochNext = 0 //On Retry Item we will not wait
-							booking.Retry++
-							if maxRetry == 0 || booking.Retry > maxRetry {
-								booking.State = "Blocked"
-							}
-						}
-						//Sleep the booking for at least 15 min, if we are not instructed to skip
-						if booking.State == "Blocked" {
-							booking.EpochNext = 0 //On Blocked  Item we will not wait
-							booking.Retry = 0
-						} else if booking.EpochNext <= time.Now().Unix() {
-							booking.EpochNext = MaxInt64(booking.EpochNext, time.Now().Add(15*time.Minute).Truncate(15*time.Minute).Unix())
-						}
-						loc, _ := time.LoadLocation(timeZoneLoc)
-						nextStr := time.Unix(booking.EpochNext, 0).In(loc).Format("15:04")
-						if err != nil {
-							log.WithFields(log.Fields{
-								"state": booking.State,
-								"boat":  booking.Name,
-								"user":  booking.Username,
-								"at":    shortDate(booking.Date),
-								"from":  shortTime(booking.Time),
-								"next":  shortTime(nextStr),
-								"unix":  time.Now().Unix(),
-							}).Error(err)
-						} else {
-							log.WithFields(log.Fields{
-								"state": booking.State,
-								"boat":  booking.Name,
-								"user":  booking.Username,
-								"at":    shortDate(booking.Date),
-								"from":  shortTime(booking.Time),
-								"next":  shortTime(nextStr),
-								"unix":  time.Now().Unix(),
-							}).Info(booking.Message)
-						}
-					}
-					wg.Done()
-				}()
-				//Set the timezone
-				booking.TimeZone = timeZone
-
-				//Correct the duration automaticly
-				//Set the minimal duration
-				if booking.Duration < int64(minDuration) {
-					booking.Duration = int64(minDuration)
-				}
-				//Set the maximal duration
-				if booking.Duration > int64(maxDuration) {
-					booking.Duration = int64(maxDuration)
-				}
+// The ETag of a booking, the quoted version
+func bookingETag(b *BookingInterface) string {
+	return `"` + strconv.FormatInt(b.Version, 10) + `"`
+}
 
-				//Set the correct EpochDatas
-				thetime, err := time.Parse(time.RFC3339, shortDate(booking.Date)+"T00:00:00+00:00")
-				if err != nil {
-					log.Error("date not valid yyyy-MM-dd")
-					booking.State = "Failed"
-					booking.Message = "date not valid yyyy-MM-dd"
-					booking.Changed = true
-					return
-				}
-				booking.EpochDate = thetime.Unix()
-				thetime, err = time.Parse(time.RFC3339, shortDate(booking.Date)+"T"+shortTime(booking.Time)+":00"+booking.TimeZone)
-				if err != nil {
-					log.Error("time not valid hh:mm")
-					booking.State = "Failed"
-					booking.Message = "time not valid hh:mm"
-					booking.Changed = true
-					return
-				}
-
-				//Save the real start time and end time of booking
-				booking.EpochStart = thetime.Unix()
-				thetime = thetime.Add(time.Minute * time.Duration(booking.Duration))
-				booking.EpochEnd = thetime.Unix()
-
-				//Check if we should confirm the booking
-				if booking.State == "Finished" && confirmTime != 0 &&
-					time.Now().Unix() >= time.Unix(booking.EpochStart, 0).Add(-time.Duration(confirmTime)*time.Minute).Unix() && time.Now().Unix() <= time.Unix(booking.EpochStart, 0).Unix() {
-					err = confirmBoat(booking)
-					if err == nil {
-						booking.State = "Confirmed"
-						booking.Message = "Booking confirmed"
-						booking.Changed = true
-						return
-					}
-				}
-
-				//Check if have allready processed the booking, if so skip it
-				if booking.State == "Finished" || booking.State == "Confirmed" || booking.State == "Canceled" ||
-					booking.State == "Failed" || booking.EpochNext > time.Now().Unix() {
-					//Check if we should repeat this item
-					if booking.Repeat != None && booking.EpochEnd < time.Now().Unix() {
-						booking.State = "Repeat"
-						booking.Message = "Booking is repeated"
-						booking.Changed = true
-						booking.BookingId = ""
-						rs := func(c bool) int {
-							if c {
-								return 1
-							}
-							return 0
-						}
-						booking.Date = time.Unix(booking.EpochStart, 0).AddDate(rs(booking.Repeat == Yearly), rs(booking.Repeat == Monthly), rs(booking.Repeat == Daily)+(7*rs(booking.Repeat == Weekly))).Format("2006-01-02")
-
-					} else
-					//log.Println(booking.State, booking.Name, booking.Username, booking.Date, booking.Time)
-					//Check if we should mark record for removal, after 24 hours
-					if booking.EpochEnd < time.Now().Add(-time.Hour*24).Unix() {
-						log.Debug("Delete", booking.EpochEnd, "<", time.Now().Add(-time.Hour*12).Unix())
-						booking.State = "Delete"
-						booking.Message = "Booking marked for Delete"
-						booking.Changed = true
-					}
-					//Nothing to do more with this booking
-					return
-				}
-
-				//Check if comment is set, if not fill default
-				team, err := getTeamByName(booking.Team)
-				if !booking.UserComment && team.AddTime {
-					booking.Comment = shortTime(booking.Time) + " - " + thetime.Format("15:04")
-				}
-
-				// doBooking
-				//Step 1: Login
-				err = login(booking)
-				if err != nil {
-					log.Error(err)
-					return
-				}
+// The version of the booking the client expects, from the If-Match header or else the version in the body.
+// Returns 0 when the client does not check the version and -1 for a invalid If-Match header
+func expectedVersion(c echo.Context, body int64) int64 {
+	match := strings.TrimPrefix(strings.TrimSpace(c.Request().Header.Get("If-Match")), "W/")
+	if match == "" || match == "*" {
+		return body
+	}
+	version, err := strconv.ParseInt(strings.Trim(match, `"`), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return version
+}
 
-				//Step 2: Read all boat data if older than 60 seconds
-				_, boats := readBoatJson(booking, 60)
-				booking.Boats = &boats
-				if len(boats) == 0 {
-					log.Error("ReadBoatJson returned empty list")
-					readBoatJson(booking, 0) //Fore a reload before retrying
-					booking.State = "Retry"
-					booking.Message = "Boat list empty"
-					booking.Changed = true
-				} else {
-					//Step 3: Do the real Booking
-					booking.Changed, err = doBooking(booking)
-					if err != nil {
-						if maxRetry != 0 {
-							booking.State = "Retry"
-						} else {
-							booking.State = "Blocked"
-							booking.Message = err.Error()
-							booking.Changed = true
-						}
-					}
-				}
+// Reply a conflict with the ETag of the current booking
+func bookingConflict(c echo.Context, id int64) error {
+	if current, err := readBooking(db, id); err == nil {
+		c.Response().Header().Set("ETag", bookingETag(current))
+	}
+	return c.String(http.StatusConflict, "Conflict, the booking has been changed.")
+}
 
-				//Step 4: Logout
-				logout(booking)
+// Check if the boats of the bookings are the same
+func sameBoats(a *BookingInterface, b *BookingInterface) bool {
+	return a.Name == b.Name && slices.Equal(a.Fallbacks, b.Fallbacks) && a.BoatType == b.BoatType &&
+		a.WeightClass == b.WeightClass && a.Location == b.Location
+}
 
-				//Step 5: On Changed append the message to the log
-				if booking.Changed {
-					booking.Logs = append(booking.Logs, LogStruct{Date: time.Now().Unix(), State: booking.State, Log: booking.Message})
-				}
+// The booking with the changes of the user, only the fields a user may change are taken from the request.
+// The reservation, the fallback progress and the retries of the robot are kept from the current booking
+func userBookingUpdate(current *BookingInterface, r *BookingInterface) (*BookingInterface, error) {
+	b := *current
+	b.Team, b.Name, b.Fallbacks = r.Team, r.Name, r.Fallbacks
+	b.BoatType, b.WeightClass, b.Location, b.Permissions = r.BoatType, r.WeightClass, r.Location, r.Permissions
+	b.Date, b.Time, b.Duration, b.Username, b.Comment = r.Date, r.Time, r.Duration, r.Username, r.Comment
+	b.Repeat, b.RRule, b.ExDates, b.WhatsAppTo = r.Repeat, r.RRule, r.ExDates, r.WhatsAppTo
+	//Keep the fallback progress and booked boat, unless the boats are changed
+	if !sameBoats(current, &b) {
+		b.FallbackIndex, b.BookedBoat = 0, ""
+	}
+	//Keep the start of the recurrence, unless the recurrence is changed
+	if b.RRule != current.RRule || b.Repeat != current.Repeat {
+		b.RepeatStart = ""
+	}
+	if err := prepareRecurrence(&b); err != nil {
+		return nil, err
+	}
+	//The password is write only, keep the current one when not set
+	b.Password = r.Password
+	if r.Password == "" && strings.EqualFold(r.Username, current.Username) {
+		b.Password = current.Password
+	}
+	//Do whe have a updated using user comment
+	b.UserComment = current.UserComment || current.Comment != r.Comment
+	//The robot processes the changed booking again
+	b.State, b.Message, b.EpochNext = "", "", 0
+	return &b, nil
+}
 
-			}(&bookingSlice[i], &changed, &wg)
-		}
+// Check if the reservation of the booked boat must be canceled to change the date, duration or boat
+func cancelToUpdate(current *BookingInterface, updated *BookingInterface) bool {
+	return current.BookingId != "" && (current.State == "Finished" || current.State == "Confirmed" ||
+		current.State == "ConfirmRetry" || current.State == "ConfirmFailed") &&
+		(shortDate(current.Date) != shortDate(updated.Date) || current.Duration != updated.Duration || !sameBoats(current, updated))
+}
 
-		//Wait for all bookings to have finished
-		wg.Wait()
-		//Save the change to the bookingFile on changed data
-		if changed {
+// Forget the reservation of a canceled booking
+func (b *BookingInterface) clearReservation() {
+	b.BookingId, b.BoatId, b.BookStart, b.BookDur = "", "", 0, 0
+	b.FallbackIndex, b.BookedBoat = 0, ""
+}
 
-			writeBookingJson(bookingSlice)
-			//Check if we should send a whatsapp message
-			if whatsApp {
-				//Send a message for all bookings with same to
-				var list = map[string][]BookingInterface{}
-				for _, b := range bookingSlice {
-					if b.Changed && b.WhatsAppTo != "" {
-						list[b.State+":"+b.Team+"-"+b.WhatsAppTo] =
-							append(list[b.State+":"+b.Team+"-"+b.WhatsAppTo], b)
-					}
-				}
-				//Finished: booking Amalthea, Argus, Artemis and Lynx at 9:30.
-				for k, v := range list {
-					var msg string
-					var ks = strings.Split(k, ":") //Get the state, team-whatsappto
-					if len(v) == 1 {
-						msg = v[0].Name
-					} else {
-						for i, b := range v {
-							if i == len(v)-1 {
-								msg = msg + " and "
-							} else if i > 0 {
-								msg = msg + ", "
-							}
-							msg = msg + b.Name
-						}
-					}
-					msg = "Booking " + strings.ToLower(ks[0]) + " for " + msg + " at " + shortDate(v[0].Date) + " " + shortTime(v[0].Time) + " hour."
-					if sendWhatsAppMsg[ks[0]] { //Check for which states we should send message
-						sendWhatsApp(v[0].Team, v[0].WhatsAppTo, msg)
-					}
-				}
-			}
-		}
+// Prepare a new booking received by the api before it is stored
+func prepareNewBooking(team *Principal, b *BookingInterface) (err error) {
+	b.State = ""
+	b.Message = ""
+	b.EpochNext = -1
+	b.Team = team.teamOf(b.Team)
+	b.UserComment = strings.Trim(b.Comment, " ") != ""
+	b.normalizeFallbacks()
+	b.FallbackIndex = 0
+	b.BookedBoat = ""
+
+	//Round the time to the closed one
+	if strings.Contains(b.Time, "T") {
+		thetime, _ := time.Parse(time.RFC3339, b.Time)
+		b.Time = thetime.Round(15 * time.Minute).Format(time.RFC3339)
+	}
+
+	//The password is write only and stored encrypted
+	b.Password, err = encryptSecret(b.Password)
+	return err
+}
 
-		//Exit if we are in single run mode
-		if singleRun {
-			break
-		}
-		//Get the local time zone
-		updateTimeZone()
-		//We sleep before we restart, where we align as close as possible to interval
-		var sleep int64 = math.MaxInt64
-		//We loop through all bookings to check if we should sleep at all
-		for _, booking := range bookingSlice {
-			if booking.EpochNext <= 0 {
-				sleep = 0
-				break
-			}
-		}
-		if sleep == math.MaxInt64 {
-			sleep = time.Now().Add(time.Duration(refreshInterval)*time.Second).Round(time.Duration(refreshInterval)*time.Second).Unix() - time.Now().
-				Add(time.Duration(sleepOffset)*time.Second).Unix()
-			time.Sleep(time.Duration(sleep) * time.Second)
+// Store a new booking, the stored password of the user is used when not set
+func storeNewBooking(tx *sql.Tx, b *BookingInterface, team *Principal) (err error) {
+	if b.Password == "" {
+		if b.Password, err = readUserPassword(tx, b.Team, b.Username); err != nil {
+			return err
 		}
-		//log.Println("Awake from Sleep", refreshInterval)
 	}
+	if _, err := insertBooking(tx, b, false); err != nil {
+		return err
+	}
+	if err := insertBookingLog(tx, b.Id, LogStruct{Date: timeNow().Unix(), State: b.State, Log: "Created by " + team.Actor()}); err != nil {
+		return err
+	}
+	//Add password to the users and the whatsapp receiver
+	if err := touchUser(tx, b.Team, b.Username, b.Password, b.Username); err != nil {
+		return err
+	}
+	return touchWhatsAppTo(tx, b.Team, b.WhatsAppTo)
 }
 
 // Indicate which CORS sites are allowed
@@ -1674,51 +1076,84 @@ func getTeamByName(teamName string) (*TeamInterface, error) {
 	return nil, errors.New("team not found")
 }
 
-func getTeamByContext(c echo.Context) (*TeamInterface, error) {
-	var gt TeamInterface
+// The team filter used when reading data, a club admin can see the data of all teams
+func teamFilter(team *Principal) string {
+	return cif(team.ClubAdmin(), "", team.Team)
+}
+
+// Get the team and account of the request, by session token, token cookie or basic authentication.
+// The basic authentication of a account uses team/account as username
+func getTeamByContext(c echo.Context) (*Principal, error) {
+	gt := &Principal{TeamInterface: &TeamInterface{}}
+	if t, ok := c.Get("team").(*Principal); ok {
+		return t, nil
+	}
 	auth := c.Request().Header["Authorization"]
-	if jsonProtect && len(auth) != 0 {
-		s := strings.Fields(auth[0])
-		if s[0] == "Basic" {
-			//log.Debug("Basic",  base64.StdEncoding.DecodeToString((c.Request().Header["Authorization"]))
-			k, err := base64.StdEncoding.DecodeString(s[1])
-			if err != nil {
-				return &gt, err
-			}
-			a := strings.Split(string(k), ":")
-			for i, t := range teams {
-				if t.Team == a[0] && t.Password == a[1] {
-					return &teams[i], nil
+	if jsonProtect {
+		var token string
+		if cookie, err := c.Cookie(tokenCookie); err == nil {
+			token = cookie.Value
+		}
+		if len(auth) != 0 {
+			s := strings.Fields(auth[0])
+			if len(s) == 2 && s[0] == "Bearer" {
+				token = s[1]
+			} else if len(s) == 2 && s[0] == "Basic" {
+				k, err := base64.StdEncoding.DecodeString(s[1])
+				if err != nil {
+					return gt, err
+				}
+				a := strings.SplitN(string(k), ":", 2)
+				if len(a) == 2 {
+					if name, account, ok := strings.Cut(a[0], "/"); ok {
+						if t, err := authenticateAccount(name, account, a[1]); err == nil {
+							c.Set("team", t)
+							return t, nil
+						}
+					} else if t, err := authenticateTeam(a[0], a[1]); err == nil {
+						c.Set("team", teamPrincipal(t))
+						return teamPrincipal(t), nil
+					}
 				}
+				return gt, errors.New("invalid Authorization Header")
 			}
 		}
-	} else if !jsonProtect {
+		if token != "" {
+			t, err := parseToken(token)
+			if err != nil {
+				return gt, err
+			}
+			c.Set("team", t)
+			return t, nil
+		}
+	} else {
 		for i, t := range teams {
 			if t.Id == 0 {
-				return &teams[i], nil
+				return teamPrincipal(&teams[i]), nil
 			}
 		}
 	}
-	return &gt, errors.New("invalid Authorization Header")
+	return gt, errors.New("invalid Authorization Header")
 }
 
 // The basic web server
 func jsonServer() error {
+	e := newServer()
+	log.Printf("Start jsonserver on %s", bindAddress)
+	return e.Start(bindAddress)
+}
+
+// Create the web server with all routes
+func newServer() *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 	e.Use(middlewareLogging)
+	e.Use(auditMiddleware)
 	e.HTTPErrorHandler = errorHandler
 	g := e.Group("/data")
 	if jsonProtect {
-		g.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
-			for _, g := range teams {
-				if g.Team == username && g.Password == password {
-					return true, nil
-				}
-			}
-			return false, nil
-		}))
+		g.Use(teamAuth)
 	}
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -1729,7 +1164,7 @@ func jsonServer() error {
 
 	e.GET("data/config", func(c echo.Context) error {
 		//For config we allways want to have the latest team info
-		teams = readTeamJson()
+		teams = readTeams()
 		g, _ := getTeamByContext(c)
 		configData := map[string]interface{}{
 			"version":        AppVersion,
@@ -1738,7 +1173,9 @@ func jsonServer() error {
 			"interval":       refreshInterval,
 			"prefix":         iif(g.Prefix, commentPrefix),
 			"clubid":         clubId,
-			"admin":          g.Admin,
+			"admin":          g.ClubAdmin(),
+			"role":           g.Role.String(),
+			"account":        accountName(g),
 			"myfleetVersion": myFleetVersion,
 			"timezone":       timeZoneLoc,
 			"title":          iif(g.Title, iif(g.Team, title)),
@@ -1764,10 +1201,11 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		if team.Admin {
-			return c.JSON(http.StatusOK, teams)
+		teams = readTeams()
+		if team.ClubAdmin() {
+			return c.JSON(http.StatusOK, publicTeams(teams))
 		} else {
-			return c.JSON(http.StatusOK, TeamFilter(teams, team.Team))
+			return c.JSON(http.StatusOK, TeamFilter(publicTeams(teams), team.Team))
 		}
 	})
 
@@ -1776,9 +1214,9 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		t := readTeamJson()
-		for _, tt := range t {
-			if c.Param("id") == strconv.FormatInt(tt.Id, 10) && (team.Admin || tt.Team == team.Team) {
+		for _, tt := range readTeams() {
+			if c.Param("id") == strconv.FormatInt(tt.Id, 10) && team.Allowed(tt.Team, RoleViewer) {
+				tt.Password = ""
 				return c.JSON(http.StatusOK, tt)
 			}
 		}
@@ -1787,63 +1225,88 @@ func jsonServer() error {
 
 	g.POST("/teams", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
-		}
-		teams = readTeamJson()
-		//Autoincrement booking id
-		var id int64 = 0
-		for _, t := range teams {
-			id = MaxInt64(id, t.Id+1)
+		if err != nil || !team.ClubAdmin() {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
 		new_team := new(TeamInterface)
 		err = c.Bind(new_team)
-		new_team.Id = id
+		if err != nil || new_team.Team == "" {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		if new_team.Accounts && !hasAdminAccount(new_team) {
+			return c.String(http.StatusBadRequest, "A admin account is required to turn the team password off.")
+		}
+		if new_team.Password != "" {
+			if new_team.Password, err = hashPassword(new_team.Password); err != nil {
+				return c.String(http.StatusBadRequest, "Bad request.")
+			}
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			_, err := insertTeam(tx, new_team, false)
+			return err
+		})
 		if err != nil {
+			log.Error(err)
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
-
-		teams = append(teams, *new_team)
-		writeTeamJson(teams)
 		log.WithFields(log.Fields{
 			"team":  new_team.Team,
 			"title": new_team.Title,
 		}).Info("Added team")
 
-		if team.Admin {
-			return c.JSON(http.StatusOK, teams)
+		teams = readTeams()
+		if team.ClubAdmin() {
+			return c.JSON(http.StatusOK, publicTeams(teams))
 		} else {
-			return c.JSON(http.StatusOK, TeamFilter(teams, team.Team))
+			return c.JSON(http.StatusOK, TeamFilter(publicTeams(teams), team.Team))
 		}
 	})
 
 	g.PUT("/teams/:id", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
-		teams = readTeamJson()
-
 		updated_team := new(TeamInterface)
 		err = c.Bind(updated_team)
 		if err != nil {
 			log.Error(err, updated_team)
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
-		log.WithFields(log.Fields{
-			"team":  updated_team.Team,
-			"title": updated_team.Title,
-		}).Info("Updated team")
 
-		for i, t := range teams {
-			if strconv.FormatInt(t.Id, 10) == c.Param("id") && (team.Admin || t.Team == team.Team) {
-				teams = append(teams[:i], teams[i+1:]...)
-				teams = append(teams, *updated_team)
-				writeTeamJson(teams)
-				if team.Admin {
-					return c.JSON(http.StatusOK, teams)
+		for _, t := range readTeams() {
+			if strconv.FormatInt(t.Id, 10) == c.Param("id") && team.Allowed(t.Team, RoleTeamAdmin) {
+				updated_team.Id = t.Id
+				//Only a club admin can make a team admin
+				if !team.ClubAdmin() {
+					updated_team.Admin = t.Admin
+				}
+				//The team password can only be turned off when a account can still manage the team
+				if updated_team.Accounts && !t.Accounts && !hasAdminAccount(&t) {
+					return c.String(http.StatusBadRequest, "A admin account is required to turn the team password off.")
+				}
+				//The password is write only, keep the current one when not set
+				if updated_team.Password == "" {
+					updated_team.Password = t.Password
+				} else if updated_team.Password, err = hashPassword(updated_team.Password); err != nil {
+					return c.String(http.StatusBadRequest, "Bad request.")
+				}
+				err = withTx(func(tx *sql.Tx) error {
+					return updateTeam(tx, updated_team)
+				})
+				if err != nil {
+					log.Error(err)
+					return c.String(http.StatusBadRequest, "Bad request.")
+				}
+				log.WithFields(log.Fields{
+					"team":  updated_team.Team,
+					"title": updated_team.Title,
+				}).Info("Updated team")
+				teams = readTeams()
+				if team.ClubAdmin() {
+					return c.JSON(http.StatusOK, publicTeams(teams))
 				} else {
-					return c.JSON(http.StatusOK, TeamFilter(teams, team.Team))
+					return c.JSON(http.StatusOK, TeamFilter(publicTeams(teams), team.Team))
 				}
 			}
 		}
@@ -1852,22 +1315,20 @@ func jsonServer() error {
 
 	g.DELETE("/teams/:id", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
-		teams = readTeamJson()
 
-		for i, t := range teams {
-			if strconv.FormatInt(t.Id, 10) == c.Param("id") && (team.Admin || t.Team == team.Team) {
-				teams = append(teams[:i], teams[i+1:]...)
+		for _, t := range readTeams() {
+			if strconv.FormatInt(t.Id, 10) == c.Param("id") && team.Allowed(t.Team, RoleTeamAdmin) {
 				//Disconnect the whatsapp if set
-				if team.WhatsAppId != "" {
+				if t.WhatsAppId != "" && whatsAppContainer != nil {
 					devices, err := whatsAppContainer.GetAllDevices()
 					if err != nil {
 						return c.JSON(http.StatusInternalServerError, err)
 					}
 					for _, dd := range devices {
-						if dd.ID.String() == team.WhatsAppId {
+						if dd.ID.String() == t.WhatsAppId {
 							client := whatsmeow.NewClient(dd, whatsAppLog)
 							if client.Store.ID != nil {
 								client.Connect()
@@ -1877,38 +1338,21 @@ func jsonServer() error {
 						}
 					}
 				}
-				writeTeamJson(teams)
-				//Delete all users of team
-				users := readUsersJson()
-				for i, u := range users {
-					if u.Team == team.Team {
-						users = append(users[:i], users[i+1:]...)
-					}
-				}
-				writeUsersJson(users)
-
-				//Delete all whatsappto of team
-				whatsappto := readWhatsAppJson()
-				for i, w := range whatsappto {
-					if w.Team == team.Team {
-						whatsappto = append(whatsappto[:i], whatsappto[i+1:]...)
-					}
-				}
-				writeWhatsAppJson(whatsappto)
-
-				//Delete all bookings of
-				bookings := readBookingJson()
-				for i, b := range bookings {
-					if b.Team == team.Team {
-						bookings = append(bookings[:i], bookings[i+1:]...)
-					}
+				//Delete the team including all users, whatsappto and bookings of team
+				err = withTx(func(tx *sql.Tx) error {
+					return deleteTeam(tx, &t)
+				})
+				if err != nil {
+					return c.JSON(http.StatusInternalServerError, err)
 				}
-				writeBookingJson(bookings)
+				log.WithField("team", t.Team).Info("Deleted team")
+				scheduler.Reload()
 
-				if team.Admin {
-					return c.JSON(http.StatusOK, teams)
+				teams = readTeams()
+				if team.ClubAdmin() {
+					return c.JSON(http.StatusOK, publicTeams(teams))
 				} else {
-					return c.JSON(http.StatusOK, TeamFilter(teams, team.Team))
+					return c.JSON(http.StatusOK, TeamFilter(publicTeams(teams), team.Team))
 				}
 			}
 		}
@@ -1916,16 +1360,11 @@ func jsonServer() error {
 	})
 
 	g.GET("/booking", func(c echo.Context) error {
-		bookings := readBookingJson()
 		team, err := getTeamByContext(c)
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		if team.Admin {
-			return c.JSON(http.StatusOK, bookings)
-		} else {
-			return c.JSON(http.StatusOK, TeamFilter(bookings, team.Team))
-		}
+		return c.JSON(http.StatusOK, publicBookings(readBookings(teamFilter(team))))
 	})
 
 	g.GET("/booking/:id", func(c echo.Context) error {
@@ -1933,11 +1372,12 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		bookings := readBookingJson()
-		for _, booking := range bookings {
-			if c.Param("id") == strconv.FormatInt(booking.Id, 10) && (team.Admin || team.Team == booking.Team) {
-				return c.JSON(http.StatusOK, booking)
-			}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		booking, err := readBooking(db, id)
+		if err == nil && team.Allowed(booking.Team, RoleViewer) {
+			booking.Password = ""
+			c.Response().Header().Set("ETag", bookingETag(booking))
+			return c.JSON(http.StatusOK, booking)
 		}
 		return c.String(http.StatusNotFound, "Not found.")
 	})
@@ -1947,81 +1387,37 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		bookings := readBookingJson()
-		//Autoincrement booking id
-		var id int64 = 0
-		for _, booking := range bookings {
-			id = MaxInt64(id, booking.Id+1)
-		}
 		new_booking := new(BookingInterface)
 		err = c.Bind(new_booking)
-		new_booking.Id = id
-		new_booking.State = ""
-		new_booking.Message = ""
-		new_booking.EpochNext = -1
-		new_booking.Team = cif(team.Admin, iif(new_booking.Team, team.Team), team.Team)
-		new_booking.UserComment = strings.Trim(new_booking.Comment, " ") != ""
-		new_booking.Logs = append(new_booking.Logs, LogStruct{Date: time.Now().Unix(), State: new_booking.State, Log: "Created by " + team.Title})
-
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
-
-		//Round the time to the closed one
-		if strings.Contains(new_booking.Time, "T") {
-			thetime, _ := time.Parse(time.RFC3339, new_booking.Time)
-			new_booking.Time = thetime.Round(15 * time.Minute).Format(time.RFC3339)
+		if err = prepareNewBooking(team, new_booking); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		if !team.CanChange(new_booking) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		new_booking.RepeatStart = ""
+		if err = prepareRecurrence(new_booking); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return storeNewBooking(tx, new_booking, team)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
 		}
-
-		bookings = append(bookings, *new_booking)
-		writeBookingJson(bookings)
 		log.WithFields(log.Fields{
 			"boat": new_booking.Name,
 			"user": new_booking.Username,
 			"at":   shortDate(new_booking.Date),
 			"from": shortTime(new_booking.Time),
 		}).Info("Added boat")
+		scheduler.Notify(new_booking.Id)
+		events.PublishStored(new_booking.Id, new_booking.Team)
 
-		//Add password to user file
-		users := readUsersJson()
-		var found bool = false
-		for i, usr := range users {
-			if strings.EqualFold(usr.Username, new_booking.Username) && usr.Team == team.Team {
-				users[i].Password = new_booking.Password
-				users[i].LastUsed = time.Now().Unix()
-				found = true
-				break
-			}
-		}
-		if !found {
-			var id int64 = 0
-			for _, t := range users {
-				id = MaxInt64(id, t.Id+1)
-			}
-			users = append(users, UserInterface{Id: id, Name: new_booking.Username, Username: new_booking.Username, Password: new_booking.Password, LastUsed: time.Now().Unix(), Team: new_booking.Team})
-		}
-		writeUsersJson(users)
-
-		//Add whatsapp to whatsapp file
-		whatsappData := readWhatsAppJson()
-		found = false
-		for i, d := range whatsappData {
-			if strings.EqualFold(d.To, new_booking.WhatsAppTo) && d.Team == team.Team {
-				whatsappData[i].LastUsed = time.Now().Unix()
-				found = true
-				break
-			}
-		}
-
-		if !found && new_booking.WhatsAppTo != "" {
-			whatsappData = append(whatsappData, WhatsAppToInterface{To: new_booking.WhatsAppTo, LastUsed: time.Now().Unix(), Team: new_booking.Team})
-		}
-		writeWhatsAppJson(whatsappData)
-		if team.Admin {
-			return c.JSON(http.StatusOK, bookings)
-		} else {
-			return c.JSON(http.StatusOK, TeamFilter(bookings, team.Team))
-		}
+		return c.JSON(http.StatusOK, publicBookings(readBookings(teamFilter(team))))
 	})
 
 	g.PUT("/booking/:id", func(c echo.Context) error {
@@ -2029,93 +1425,135 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		bookings := readBookingJson()
 
-		updated_booking := new(BookingInterface)
-		err = c.Bind(updated_booking)
+		request := new(BookingInterface)
+		err = c.Bind(request)
 		if err != nil {
-			log.Error(err, updated_booking)
+			log.Error(err, request)
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
-		updated_booking.EpochNext = 0
-		updated_booking.State = ""
-		updated_booking.Message = ""
-		updated_booking.Team = cif(team.Admin, iif(updated_booking.Team, team.Team), team.Team)
+		request.Team = team.teamOf(request.Team)
+		request.normalizeFallbacks()
 		//Round the time to the closed one
-		if strings.Contains(updated_booking.Time, "T") {
-			thetime, _ := time.Parse(time.RFC3339, updated_booking.Time)
-			updated_booking.Time = thetime.Round(15 * time.Minute).Format(time.RFC3339)
+		if strings.Contains(request.Time, "T") {
+			thetime, _ := time.Parse(time.RFC3339, request.Time)
+			request.Time = thetime.Round(15 * time.Minute).Format(time.RFC3339)
 		}
-		log.WithFields(log.Fields{
-			"boat": updated_booking.Name,
-			"user": updated_booking.Username,
-			"at":   shortDate(updated_booking.Date),
-			"from": shortTime(updated_booking.Time),
-		}).Info("Updated boat")
 
-		//Add password to user file
-		users := readUsersJson()
-		var found bool = false
-		for i, usr := range users {
-			if strings.EqualFold(usr.Username, updated_booking.Username) && usr.Team == team.Team {
-				users[i].Password = updated_booking.Password
-				users[i].LastUsed = time.Now().Unix()
-				found = true
-				break
-			}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		booking, err := readBooking(db, id)
+		if err != nil || !team.Allowed(booking.Team, RoleViewer) {
+			return c.String(http.StatusNotFound, "Not found.")
 		}
-		if !found {
-			var id int64 = 0
-			for _, t := range users {
-				id = MaxInt64(id, t.Id+1)
-			}
-			users = append(users, UserInterface{Id: id, Name: iif(updated_booking.Name, updated_booking.Username), Username: updated_booking.Username, Password: updated_booking.Password, LastUsed: time.Now().Unix(), Team: updated_booking.Team})
+		if !team.CanChange(booking) || !team.CanChange(request) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		if _, err = userBookingUpdate(booking, request); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		//The password is write only, a new one is stored encrypted
+		if request.Password, err = encryptSecret(request.Password); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		expected := expectedVersion(c, request.Version)
+		//Without a version the update is retried on the current booking, so it is never lost to a robot write
+		run := withBookingRetry
+		if expected != 0 {
+			run = withTx
 		}
-		writeUsersJson(users)
 
-		//Add whatsapp to whatsapp file
-		whatsappData := readWhatsAppJson()
-		found = false
-		for i, d := range whatsappData {
-			if strings.EqualFold(d.To, updated_booking.WhatsAppTo) && d.Team == team.Team {
-				whatsappData[i].LastUsed = time.Now().Unix()
-				found = true
-				break
+		//A booked boat changed in date, duration or boat is canceled first, the booking is claimed before the cancel
+		var claimed *BookingInterface
+		err = run(func(tx *sql.Tx) error {
+			current, err := readBooking(tx, id)
+			if err != nil {
+				return err
+			}
+			if expected != 0 && expected != current.Version {
+				return errBookingConflict
+			}
+			updated, err := userBookingUpdate(current, request)
+			if err != nil || !cancelToUpdate(current, updated) {
+				return err
+			}
+			if err = claimBooking(tx, current); err != nil {
+				return err
 			}
+			claimed = current
+			return nil
+		})
+		if errors.Is(err, errBookingConflict) {
+			return bookingConflict(c, id)
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
 		}
-
-		if !found && updated_booking.WhatsAppTo != "" {
-			whatsappData = append(whatsappData, WhatsAppToInterface{To: updated_booking.WhatsAppTo, LastUsed: time.Now().Unix(), Team: updated_booking.Team})
+		if claimed != nil {
+			if err = cancelBoat(claimed); err != nil {
+				log.WithFields(log.Fields{
+					"boat": claimed.Name,
+					"user": claimed.Username,
+					"at":   shortDate(claimed.Date),
+					"from": shortTime(claimed.Time),
+				}).Error("Cancel to update failed ", err)
+				return c.String(http.StatusBadGateway, "Cancel of the reservation in my-fleet failed: "+err.Error())
+			}
+			//The version was checked by the claim, the canceled reservation must now be removed from the booking
+			expected, run = 0, withBookingRetry
 		}
-		writeWhatsAppJson(whatsappData)
-
-		for i, booking := range bookings {
-			if strconv.FormatInt(booking.Id, 10) == c.Param("id") && (team.Admin || booking.Team == team.Team) {
-				bookings = append(bookings[:i], bookings[i+1:]...)
-				//Do whe have a updated using user comment
-				updated_booking.UserComment = booking.UserComment ||
-					booking.Comment != updated_booking.Comment
 
-				//Cancel a Boat when you update it, while it is finished
-				if (booking.State == "Finished" || booking.State == "Confirmed") &&
-					(shortDate(booking.Date) != shortDate(updated_booking.Date) ||
-						booking.Duration != updated_booking.Duration ||
-						booking.Name != updated_booking.Name) {
-					boatCancel(&booking)
-					updated_booking.Logs = append(booking.Logs, LogStruct{Date: time.Now().Unix(), State: booking.State, Log: "Canceled to update by " + team.Title})
-				} else {
-					updated_booking.Logs = append(booking.Logs, LogStruct{Date: time.Now().Unix(), Log: "Updated by " + team.Title})
-				}
-				bookings = append(bookings, *updated_booking)
-				writeBookingJson(bookings)
-				if team.Admin {
-					return c.JSON(http.StatusOK, bookings)
-				} else {
-					return c.JSON(http.StatusOK, TeamFilter(bookings, team.Team))
+		var updated_booking *BookingInterface
+		err = run(func(tx *sql.Tx) error {
+			current, err := readBooking(tx, id)
+			if err != nil {
+				return err
+			}
+			if expected != 0 && expected != current.Version {
+				return errBookingConflict
+			}
+			if updated_booking, err = userBookingUpdate(current, request); err != nil {
+				return err
+			}
+			entry := LogStruct{Date: timeNow().Unix(), Log: "Updated by " + team.Actor()}
+			//The canceled reservation is gone, the robot books the changed booking again
+			if claimed != nil && current.BookingId == claimed.BookingId {
+				updated_booking.clearReservation()
+				entry = LogStruct{Date: timeNow().Unix(), State: current.State, Log: "Canceled to update by " + team.Actor()}
+			}
+			if updated_booking.Password == "" {
+				if updated_booking.Password, err = readUserPassword(tx, updated_booking.Team, updated_booking.Username); err != nil {
+					return err
 				}
 			}
+			if err := updateBooking(tx, updated_booking); err != nil {
+				return err
+			}
+			if err := insertBookingLog(tx, updated_booking.Id, entry); err != nil {
+				return err
+			}
+			//Add password to the users and the whatsapp receiver
+			if err := touchUser(tx, updated_booking.Team, updated_booking.Username, updated_booking.Password, updated_booking.Username); err != nil {
+				return err
+			}
+			return touchWhatsAppTo(tx, updated_booking.Team, updated_booking.WhatsAppTo)
+		})
+		if errors.Is(err, errBookingConflict) {
+			return bookingConflict(c, id)
+		} else if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "Not found.")
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
 		}
-		return c.String(http.StatusNotFound, "Not found.")
+		log.WithFields(log.Fields{
+			"boat": updated_booking.Name,
+			"user": updated_booking.Username,
+			"at":   shortDate(updated_booking.Date),
+			"from": shortTime(updated_booking.Time),
+		}).Info("Updated boat")
+		scheduler.Notify(updated_booking.Id)
+		events.PublishStored(updated_booking.Id, updated_booking.Team)
+		c.Response().Header().Set("ETag", bookingETag(updated_booking))
+
+		return c.JSON(http.StatusOK, publicBookings(readBookings(teamFilter(team))))
 	})
 
 	g.DELETE("/booking/:id", func(c echo.Context) error {
@@ -2123,36 +1561,58 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		bookings := readBookingJson()
-
-		for i, booking := range bookings {
-			if strconv.FormatInt(booking.Id, 10) == c.Param("id") && (team.Admin || booking.Team == team.Team) {
-				if booking.State == "Canceled" {
-					log.WithFields(log.Fields{
-						"state": booking.State,
-						"boat":  booking.Name,
-						"user":  booking.Username,
-						"at":    shortDate(booking.Date),
-						"from":  shortTime(booking.Time),
-					}).Info("Deleting")
-					bookings = append(bookings[:i], bookings[i+1:]...)
-					writeBookingJson(bookings)
-				} else if booking.State != "Cancel" {
-					booking.State = "Cancel"
-					booking.Message = "Canceled"
-					booking.EpochNext = 0
-					booking.Logs = append(booking.Logs, LogStruct{Date: time.Now().Unix(), State: booking.State, Log: "Canceled by " + team.Title})
-					bookings[i] = booking
-					writeBookingJson(bookings)
-				}
-				if team.Admin {
-					return c.JSON(http.StatusOK, bookings)
-				} else {
-					return c.JSON(http.StatusOK, TeamFilter(bookings, team.Team))
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		booking, err := readBooking(db, id)
+		if err != nil || !team.Allowed(booking.Team, RoleViewer) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		if !team.CanChange(booking) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		expected := expectedVersion(c, 0)
+		//Without If-Match the cancel is retried on the current booking, so it is never lost to a robot write
+		run := withBookingRetry
+		if expected != 0 {
+			run = withTx
+		}
+		err = run(func(tx *sql.Tx) error {
+			booking, err = readBooking(tx, id)
+			if err != nil {
+				return err
+			}
+			if expected != 0 && expected != booking.Version {
+				return errBookingConflict
+			}
+			if booking.State == "Canceled" {
+				log.WithFields(log.Fields{
+					"state": booking.State,
+					"boat":  booking.Name,
+					"user":  booking.Username,
+					"at":    shortDate(booking.Date),
+					"from":  shortTime(booking.Time),
+				}).Info("Deleting")
+				return deleteBooking(tx, booking.Id)
+			} else if booking.State != "Cancel" {
+				booking.State = "Cancel"
+				booking.Message = "Canceled"
+				booking.EpochNext = 0
+				if err := updateBooking(tx, booking); err != nil {
+					return err
 				}
+				return insertBookingLog(tx, booking.Id, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: "Canceled by " + team.Actor()})
 			}
+			return nil
+		})
+		if errors.Is(err, errBookingConflict) {
+			return bookingConflict(c, id)
+		} else if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "Not found.")
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
 		}
-		return c.String(http.StatusNotFound, "Not found.")
+		scheduler.Notify(booking.Id)
+		events.PublishStored(booking.Id, booking.Team)
+		return c.JSON(http.StatusOK, publicBookings(readBookings(teamFilter(team))))
 	})
 
 	g.GET("/users", func(c echo.Context) error {
@@ -2160,11 +1620,7 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		if team.Admin {
-			return c.JSON(http.StatusOK, readUsersJson())
-		} else {
-			return c.JSON(http.StatusOK, TeamFilter(readUsersJson(), team.Team))
-		}
+		return c.JSON(http.StatusOK, publicUsers(readUsers(teamFilter(team))))
 	})
 
 	g.GET("/users/:id", func(c echo.Context) error {
@@ -2172,103 +1628,104 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		u := readUsersJson()
-		for _, uu := range u {
-			if c.Param("id") == strconv.FormatInt(uu.Id, 10) && (team.Admin || uu.Team == team.Team) {
-				return c.JSON(http.StatusOK, uu)
-			}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		u, err := readUser(db, id)
+		if err == nil && team.Allowed(u.Team, RoleViewer) {
+			u.Password = ""
+			return c.JSON(http.StatusOK, u)
 		}
 		return c.String(http.StatusNotFound, "Not found.")
 	})
 
 	g.POST("/users", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
-		}
-		u := readUsersJson()
-		//Autoincrement booking id
-		var id int64 = 0
-		for _, t := range u {
-			id = MaxInt64(id, t.Id+1)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
 		new_user := new(UserInterface)
 		err = c.Bind(new_user)
-		new_user.Team = cif(team.Admin, iif(new_user.Team, team.Team), team.Team)
-		new_user.Name = iif(new_user.Name, new_user.Username)
-		new_user.Id = id
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
-
-		u = append(u, *new_user)
-		writeUsersJson(u)
+		new_user.Team = team.teamOf(new_user.Team)
+		new_user.Name = iif(new_user.Name, new_user.Username)
+		new_user.LastUsed = timeNow().Unix()
+		if new_user.Password, err = encryptSecret(new_user.Password); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			_, err := insertUser(tx, new_user, false)
+			return err
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
 		log.WithFields(log.Fields{
 			"team":     new_user.Team,
 			"username": new_user.Username,
 		}).Info("Added user")
 
-		if team.Admin {
-			return c.JSON(http.StatusOK, u)
-		} else {
-			return c.JSON(http.StatusOK, TeamFilter(u, team.Team))
-		}
+		return c.JSON(http.StatusOK, publicUsers(readUsers(teamFilter(team))))
 	})
 
 	g.PUT("/users/:id", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
-		u := readUsersJson()
 
 		updated_user := new(UserInterface)
 		err = c.Bind(updated_user)
-		updated_user.Team = cif(team.Admin, iif(updated_user.Team, team.Team), team.Team)
 		if err != nil {
 			log.Error(err, updated_user)
 			return c.String(http.StatusBadRequest, "Bad request.")
 		}
+		updated_user.Team = team.teamOf(updated_user.Team)
+
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		u, err := readUser(db, id)
+		if err != nil || !team.Allowed(u.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		updated_user.Id = u.Id
+		updated_user.LastUsed = timeNow().Unix()
+		//The password is write only, keep the current one when not set
+		if updated_user.Password == "" {
+			updated_user.Password = u.Password
+		} else if updated_user.Password, err = encryptSecret(updated_user.Password); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return updateUser(tx, updated_user)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
 		log.WithFields(log.Fields{
 			"team":     updated_user.Team,
 			"username": updated_user.Username,
 		}).Info("Updated user")
 
-		for i, uu := range u {
-			if strconv.FormatInt(uu.Id, 10) == c.Param("id") && (team.Admin || uu.Team == team.Team) {
-				u = append(u[:i], u[i+1:]...)
-				u = append(u, *updated_user)
-				writeUsersJson(u)
-				if team.Admin {
-					return c.JSON(http.StatusOK, u)
-				} else {
-					return c.JSON(http.StatusOK, TeamFilter(u, team.Team))
-				}
-			}
-		}
-
-		return c.String(http.StatusNotFound, "Not found.")
+		return c.JSON(http.StatusOK, publicUsers(readUsers(teamFilter(team))))
 	})
 
 	g.DELETE("/users/:id", func(c echo.Context) error {
 		team, err := getTeamByContext(c)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, err)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
 		}
-		u := readUsersJson()
-
-		for i, uu := range u {
-			if strconv.FormatInt(uu.Id, 10) == c.Param("id") && (team.Admin || uu.Team == team.Team) {
-				u = append(u[:i], u[i+1:]...)
-				writeUsersJson(u)
-				if team.Admin {
-					return c.JSON(http.StatusOK, u)
-				} else {
-					return c.JSON(http.StatusOK, TeamFilter(u, team.Team))
-				}
-			}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		u, err := readUser(db, id)
+		if err != nil || !team.Allowed(u.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
 		}
-		return c.String(http.StatusNotFound, "Not found.")
+		err = withTx(func(tx *sql.Tx) error {
+			return deleteUser(tx, u.Id)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		return c.JSON(http.StatusOK, publicUsers(readUsers(teamFilter(team))))
 	})
 
 	g.GET("/whatsappto", func(c echo.Context) error {
@@ -2276,7 +1733,7 @@ func jsonServer() error {
 		if err != nil {
 			return c.JSON(http.StatusForbidden, err)
 		}
-		return c.JSON(http.StatusOK, TeamFilter(readWhatsAppJson(), team.Team))
+		return c.JSON(http.StatusOK, readWhatsAppTo(team.Team))
 	})
 
 	//Request a new whatsapp connection for specified string
@@ -2285,12 +1742,15 @@ func jsonServer() error {
 			return c.JSON(http.StatusForbidden, errors.New("WhatsApp is disabled"))
 		}
 		//Find or create the store device
-		team, _ := getTeamByContext(c)
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
 		devices, err := whatsAppContainer.GetAllDevices()
 		if err != nil {
 			team.WhatsAppId = ""
 			team.QRCode = ""
-			writeTeamJson(teams)
+			saveTeam(team.TeamInterface)
 			return c.JSON(http.StatusInternalServerError, err)
 		}
 
@@ -2306,7 +1766,7 @@ func jsonServer() error {
 					team.WhatsAppId = ""
 					team.QRCode = ""
 					//TODO: Fix this
-					writeTeamJson(teams)
+					saveTeam(team.TeamInterface)
 					return c.JSON(http.StatusOK, "Connection deleted")
 				}
 			}
@@ -2318,7 +1778,10 @@ func jsonServer() error {
 		if !whatsApp {
 			return c.JSON(http.StatusForbidden, errors.New("WhatsApp is disabled"))
 		}
-		team, _ := getTeamByContext(c)
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
 		devices, err := whatsAppContainer.GetAllDevices()
 		if err != nil {
 			log.Debug(err)
@@ -2347,8 +1810,8 @@ func jsonServer() error {
 			team.QRCode = ""
 			team.WhatsAppId = d.ID.String()
 			//TODO: Not the nices way to update, whe should find it
-			writeTeamJson(teams)
-			if err := enc.Encode(*team); err != nil {
+			saveTeam(team.TeamInterface)
+			if err := enc.Encode(*team.TeamInterface); err != nil {
 				return err
 			}
 			c.Response().Flush()
@@ -2370,7 +1833,7 @@ func jsonServer() error {
 				// Render the QR code here
 				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, log.New().WriterLevel(log.InfoLevel))
 				team.QRCode = evt.Code
-				if err := enc.Encode(*team); err != nil {
+				if err := enc.Encode(*team.TeamInterface); err != nil {
 					return err
 				}
 				c.Response().Flush()
@@ -2380,9 +1843,9 @@ func jsonServer() error {
 				if evt.Event == "success" && d.ID != nil {
 					team.WhatsAppId = d.ID.String()
 					//TODO: Not the nices way to update, whe should find it
-					writeTeamJson(teams)
+					saveTeam(team.TeamInterface)
 					log.WithField("WhatsAppId", team.WhatsAppId).Debug("Created whatsapp id")
-					if err := enc.Encode(*team); err != nil {
+					if err := enc.Encode(*team.TeamInterface); err != nil {
 						return err
 					}
 					c.Response().Flush()
@@ -2399,22 +1862,64 @@ func jsonServer() error {
 		err := c.Bind(new_login)
 		new_login.Status = "Error"
 		if err == nil {
-			teams = readTeamJson()
-			for _, t := range teams {
-				if t.Team == new_login.Team && t.Password == new_login.Password {
+			teams = readTeams()
+			//The app logs in a account as team/account
+			if name, account, ok := strings.Cut(new_login.Team, "/"); ok && new_login.Account == "" {
+				new_login.Team, new_login.Account = name, account
+			}
+			if new_login.Account != "" {
+				if p, err := authenticateAccount(new_login.Team, new_login.Account, new_login.Password); err == nil {
 					new_login.Status = "ok"
-					break
+					new_login.Token, new_login.Expires = issueToken(p)
+					setTokenCookie(c, new_login.Token, new_login.Expires)
 				}
+			} else if t, err := authenticateTeam(new_login.Team, new_login.Password); err == nil {
+				new_login.Status = "ok"
+				new_login.Token, new_login.Expires = issueToken(teamPrincipal(t))
+				setTokenCookie(c, new_login.Token, new_login.Expires)
 			}
 		}
+		new_login.Password = ""
 		return c.JSON(http.StatusOK, new_login)
 	})
 
+	//Remove the session token cookie, the token itself stays valid until it expires
+	e.POST("/data/logout", func(c echo.Context) error {
+		setTokenCookie(c, "", 0)
+		return c.JSON(http.StatusOK, LoginInterface{Status: "ok"})
+	})
+
+	//The accounts of the teams and the audit log
+	accountRoutes(g)
+	auditRoutes(g)
+
+	//Notification channels
+	notifyRoutes(g)
+
+	//Booking groups
+	groupRoutes(g)
+
+	//Recurrence preview and the blackout calendar
+	recurrenceRoutes(g)
+	blackoutRoutes(g)
+
+	//The actions recorded by the dry run
+	dryRunRoutes(g)
+
+	//The calendar feed of the team, protected by the token of the team
+	icalRoutes(g)
+	e.GET("/ical/:file", icalFeed)
+
+	//Live booking updates
+	g.GET("/events", eventStream)
+
+	//Prometheus metrics
+	e.GET("/metrics", metricsHandler())
+
 	//Serve the app
 	g.Static("/", "public")
 	e.Static("/", "public")
-	log.Printf("Start jsonserver on %s", bindAddress)
-	return e.Start(bindAddress)
+	return e
 }
 
 // Whatsapp logger stuff
@@ -2427,94 +1932,87 @@ func (s *stdoutLogger) Debugf(msg string, args ...interface{}) { log.Debugf(msg,
 func (s *stdoutLogger) Sub(_ string) waLog.Logger              { return s }
 
 // Send a whatsapp message
-func sendWhatsApp(teamName string, name string, msg string) {
+func sendWhatsApp(teamName string, name string, msg string) (err error) {
+	defer func() {
+		a := AuditEntry{Team: teamName, Actor: robotActor, Action: "WhatsApp", Target: name,
+			Diff: auditDiff(nil, map[string]interface{}{"message": msg})}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		audit(&a)
+	}()
 	if !whatsApp {
-		log.Error("Trying to send WhatsApp message when disabled")
-		return
+		return errors.New("Trying to send WhatsApp message when disabled")
 	}
 	team, err := getTeamByName(teamName)
 	if err != nil {
-		log.WithField("Team", teamName).Error("Failed sending WhatsApp message to unknown team")
-		return
+		return errors.New("Failed sending WhatsApp message to unknown team " + teamName)
 	}
 	if team.WhatsAppId == "" {
-		log.WithField("Team", teamName).Error("Cannot send WhatsApp message, because team Has no WhatsAppId")
-		return
+		return errors.New("Cannot send WhatsApp message, because team " + teamName + " has no WhatsAppId")
 	}
 	jid, err := types.ParseJID(team.WhatsAppId)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 	device, err := whatsAppContainer.GetDevice(jid)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 	client := whatsmeow.NewClient(device, whatsAppLog)
 	if client.Store.ID == nil {
-		log.Error("Client for deviceID not connected")
-		return
+		return errors.New("Client for deviceID not connected")
 	}
 	err = client.Connect()
 	if err != nil {
-		log.Error(err)
+		return err
 	}
 	//Ensure we disconnect on return
 	defer client.Disconnect()
 
-	if client != nil && client.IsConnected() {
-		//Check out if whe should send message to server of user
-		wgroups, _ := client.GetJoinedGroups()
-		for _, g := range wgroups {
-			if strings.EqualFold(g.GroupName.Name, name) {
-				_, err := client.SendMessage(context.Background(), g.JID,
-					&waProto.Message{
-						Conversation: proto.String(msg),
-					})
-				log.WithFields(log.Fields{
-					"msg": msg,
-					"to":  name,
-				}).Info("Sending Group Whatsapp")
-				if err != nil {
-					log.Error("Failed to send whatsapp", err)
-				}
-				return
-			}
-		}
-		//Not found send the message to name
-		if _, err := strconv.ParseInt(name, 10, 64); err == nil {
-			_, err := client.SendMessage(context.Background(), types.JID{
-				User:   name,
-				Server: types.DefaultUserServer,
-			}, &waProto.Message{
-				Conversation: proto.String(msg),
-			})
+	if !client.IsConnected() {
+		return errors.New("WhatsApp client not connected")
+	}
+	//Check out if whe should send message to server of user
+	wgroups, _ := client.GetJoinedGroups()
+	for _, g := range wgroups {
+		if strings.EqualFold(g.GroupName.Name, name) {
 			log.WithFields(log.Fields{
 				"msg": msg,
 				"to":  name,
-			}).Info("Sending Whatsapp")
-			if err != nil {
-				log.Error("Failed to send whatsapp", err)
-			}
-		} else {
-			log.Error("Failed to send whatsapp not a number", name)
+			}).Info("Sending Group Whatsapp")
+			_, err := client.SendMessage(context.Background(), g.JID,
+				&waProto.Message{
+					Conversation: proto.String(msg),
+				})
+			return err
 		}
 	}
+	//Not found send the message to name
+	if _, err := strconv.ParseInt(name, 10, 64); err != nil {
+		return errors.New("Failed to send whatsapp not a number " + name)
+	}
+	log.WithFields(log.Fields{
+		"msg": msg,
+		"to":  name,
+	}).Info("Sending Whatsapp")
+	_, err = client.SendMessage(context.Background(), types.JID{
+		User:   name,
+		Server: types.DefaultUserServer,
+	}, &waProto.Message{
+		Conversation: proto.String(msg),
+	})
+	return err
 }
 
 func main() {
 	var err error
 	Init()
-	db, err = sql.Open(dbType, "file:"+dbFile+"?_foreign_keys=on")
-	if err != nil {
-		log.Fatal(err)
-	}
 	//Create whatsAppContainer
 	if whatsApp {
 		store.SetOSInfo(AppName, sliceVersion(AppVersion))
 		var clientLog waLog.Logger = &stdoutLogger{}
-		whatsAppContainer = sqlstore.NewWithDB(db, dbType, clientLog)
+		whatsAppContainer = sqlstore.NewWithDB(db, storage.Dialect(), clientLog)
 		err = whatsAppContainer.Upgrade()
 		if err != nil {
 			log.Fatal(err)
@@ -2527,13 +2025,16 @@ func main() {
 	go func() {
 		<-c
 		log.Info("Waiting for clean Exit")
+		fleetSessions.Close()
 		mutex.Lock()
 		db.Close()
+		stopEmbedded()
 		os.Exit(0)
 	}()
 
 	if !singleRun {
-		go bookLoop()
+		go scheduler.Run()
+		go notifyLoop()
 		err := jsonServer()
 		if err != nil {
 			log.Fatal(err)
@@ -2554,7 +2055,8 @@ func main() {
 			}
 			log.Info("ID ", BookingId)
 		default:
-			bookLoop()
+			scheduler.RunOnce()
+			deliverNotifications()
 		}
 	}
 }
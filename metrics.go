@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var metricsToken string //The bearer token required for /metrics, empty=open
+
+var (
+	fleetRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "myboats_fleet_requests_total",
+		Help: "The number of my-fleet operations by operation and result.",
+	}, []string{"operation", "result"})
+	fleetDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "myboats_fleet_request_duration_seconds",
+		Help:    "The duration of my-fleet operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	bookingRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "myboats_booking_retries_total",
+		Help: "The number of booking retries by team.",
+	}, []string{"team"})
+	bookingFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "myboats_booking_fallbacks_total",
+		Help: "The number of times a fallback boat was used by team.",
+	}, []string{"team"})
+	bookingExternalChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "myboats_booking_external_changes_total",
+		Help: "The number of reservations canceled or changed outside the robot by team and state.",
+	}, []string{"team", "state"})
+	bookingWindowDelay = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myboats_booking_window_to_booked_seconds",
+		Help:    "The time from the opening of the book window to the successful booking.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 900, 1800, 3600, 4 * 3600, 24 * 3600},
+	})
+	schedulerDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myboats_scheduler_run_duration_seconds",
+		Help:    "The duration of processing the due bookings by the scheduler.",
+		Buckets: prometheus.DefBuckets,
+	})
+	notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "myboats_notifications_total",
+		Help: "The notification delivery attempts by channel and result.",
+	}, []string{"channel", "result"})
+	bookingsDesc = prometheus.NewDesc("myboats_bookings", "The number of bookings by team and state.", []string{"team", "state"}, nil)
+)
+
+// Collector counting the bookings in the database at scrape time
+type bookingCollector struct{}
+
+func (bookingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bookingsDesc
+}
+
+func (bookingCollector) Collect(ch chan<- prometheus.Metric) {
+	rows, err := db.Query("SELECT team, state, COUNT(*) FROM bookings GROUP BY team, state")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var team, state string
+		var count float64
+		if err := rows.Scan(&team, &state, &count); err != nil {
+			log.Error(err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(bookingsDesc, prometheus.GaugeValue, count, team, iif(state, "New"))
+	}
+}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(fleetRequests, fleetDuration, bookingRetries, bookingFallbacks, bookingExternalChanges,
+		bookingWindowDelay, schedulerDuration, notifications, bookingCollector{},
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// The result label of a error
+func metricResult(err error) string {
+	return cif(err == nil, "ok", "error")
+}
+
+// Observe a my-fleet operation
+func observeFleet(operation string, start time.Time, err error) {
+	fleetDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	fleetRequests.WithLabelValues(operation, metricResult(err)).Inc()
+}
+
+// Observe the time from the opening of the book window to the first successful booking
+func observeBooked(b *BookingInterface) {
+	open := time.Unix(b.EpochStart, 0).Add(time.Duration(minDuration)*time.Minute - time.Duration(bookWindow)*time.Hour)
+	if delay := timeNow().Sub(open); delay >= 0 {
+		bookingWindowDelay.Observe(delay.Seconds())
+	}
+}
+
+// The MyFleetClient recording the metrics of every operation
+type metricsFleetClient struct {
+	next MyFleetClient
+}
+
+func (m metricsFleetClient) Session(booking *BookingInterface) error {
+	start := time.Now()
+	err := m.next.Session(booking)
+	observeFleet("session", start, err)
+	return err
+}
+
+func (m metricsFleetClient) Login(booking *BookingInterface) error {
+	start := time.Now()
+	err := m.next.Login(booking)
+	observeFleet("login", start, err)
+	return err
+}
+
+func (m metricsFleetClient) ListBoats(booking *BookingInterface) (BoatListStruct, error) {
+	start := time.Now()
+	boats, err := m.next.ListBoats(booking)
+	observeFleet("boatlist", start, err)
+	return boats, err
+}
+
+func (m metricsFleetClient) Book(booking *BookingInterface, startTime int64, endTime int64) error {
+	start := time.Now()
+	err := m.next.Book(booking, startTime, endTime)
+	observeFleet("book", start, err)
+	return err
+}
+
+func (m metricsFleetClient) Update(booking *BookingInterface, startTime int64, endTime int64) error {
+	start := time.Now()
+	err := m.next.Update(booking, startTime, endTime)
+	observeFleet("update", start, err)
+	return err
+}
+
+func (m metricsFleetClient) Cancel(booking *BookingInterface) error {
+	start := time.Now()
+	err := m.next.Cancel(booking)
+	observeFleet("cancel", start, err)
+	return err
+}
+
+func (m metricsFleetClient) Confirm(booking *BookingInterface) error {
+	start := time.Now()
+	err := m.next.Confirm(booking)
+	observeFleet("confirm", start, err)
+	return err
+}
+
+func (m metricsFleetClient) Logout(booking *BookingInterface) error {
+	start := time.Now()
+	err := m.next.Logout(booking)
+	observeFleet("logout", start, err)
+	return err
+}
+
+// The /metrics handler, protected by the metrics token when set
+func metricsHandler() echo.HandlerFunc {
+	handler := echo.WrapHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return func(c echo.Context) error {
+		if metricsToken != "" &&
+			subtle.ConstantTimeCompare([]byte(c.Request().Header.Get("Authorization")), []byte("Bearer "+metricsToken)) != 1 {
+			return c.String(http.StatusUnauthorized, "Unauthorized")
+		}
+		return handler(c)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/sirupsen/logrus"
+)
+
+// MyFleetClient is the interface used by the booking engine to talk to my-fleet
+type MyFleetClient interface {
+	Session(booking *BookingInterface) error                                //Create a new anonymous session
+	Login(booking *BookingInterface) error                                  //Login for the user of the booking
+	ListBoats(booking *BookingInterface) (BoatListStruct, error)            //Scrape the boat grid
+	Book(booking *BookingInterface, startTime int64, endTime int64) error   //Create a new reservation
+	Update(booking *BookingInterface, startTime int64, endTime int64) error //Move an existing reservation
+	Cancel(booking *BookingInterface) error                                 //Cancel an existing reservation
+	Confirm(booking *BookingInterface) error                                //Confirm an existing reservation
+	Logout(booking *BookingInterface) error                                 //Kill the session
+}
+
+// The scraping implementation of the MyFleetClient
+type myFleetWeb struct {
+	baseUrl string //The base url including the version, like https://my-fleet.eu/R1B34
+	guiUrl  string //The gui url towards the fleet.eu backend
+	textUrl string //Default backend url
+	authUrl string //Backend url towards authentication
+}
+
+var fleetUrl string = "https://my-fleet.eu/" //The base url of the my-fleet server
+var fleetClient MyFleetClient                //The client used to talk to my-fleet
+var errSessionExpired = errors.New("my-fleet session expired")
+
+// Create a new my-fleet client for the given base url
+func newMyFleetWeb(baseUrl string) *myFleetWeb {
+	baseUrl = strings.TrimRight(baseUrl, "/")
+	return &myFleetWeb{
+		baseUrl: baseUrl,
+		guiUrl:  baseUrl + "/gui/index.php",
+		textUrl: baseUrl + "/text/index.php",
+		authUrl: baseUrl + "/text/authenticate.php",
+	}
+}
+
+// Do a request using the cookies of the booking, data is posted as form when set
+func (m *myFleetWeb) request(booking *BookingInterface, method string, uri string, data url.Values) (*http.Response, []byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = strings.NewReader(data.Encode())
+	}
+	request, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if booking.Jar == nil {
+		booking.Jar, _ = cookiejar.New(nil)
+	}
+	client := &http.Client{Jar: booking.Jar}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	b, _ := io.ReadAll(response.Body)
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return response, b, errSessionExpired
+	}
+	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
+		return response, b, errors.New("HTTP Status is out of the 2xx range")
+	}
+	return response, b, nil
+}
+
+// The text of the page my-fleet shows when the reservation can not be confirmed yet
+const confirmRefused = "Bevestigen is nog niet mogelijk"
+
+// Check if the gui response is the login page, meaning our session has been killed
+func checkSession(b []byte) error {
+	if strings.Contains(string(b), "authenticate.php") {
+		return errSessionExpired
+	}
+	return nil
+}
+
+// Logout for the specified booking
+func (m *myFleetWeb) Logout(booking *BookingInterface) error {
+	//Just check if we have a session
+	if booking.Jar != nil {
+		var random string = fmt.Sprint(time.Now().Nanosecond())
+		//Calling auth with new random will kill the sessie
+		m.request(booking, http.MethodGet, m.authUrl+"?random="+random, nil)
+	}
+	booking.Jar = nil
+	return nil
+}
+
+// Create a new session and read the GuiEpochStart and GuiFleetId
+func (m *myFleetWeb) Session(booking *BookingInterface) error {
+	//We use the textUrl and guiUrl to get the session cookie in a new cookie jar
+	booking.Jar, _ = cookiejar.New(nil)
+	if _, _, err := m.request(booking, http.MethodGet, m.textUrl+"?clubname="+clubId+"&variant=", nil); err != nil {
+		return err
+	}
+	if _, _, err := m.request(booking, http.MethodGet, m.guiUrl+"?clubname="+clubId+"&variant=", nil); err != nil {
+		return err
+	}
+
+	//Get the GuiStartEpoch and GuiFleetId
+	_, b, err := m.request(booking, http.MethodGet, m.guiUrl+"?clubname="+clubId, nil)
+	if err != nil {
+		return err
+	}
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(string(b)))
+	// Find the sunrise, sunset, min and max times allowed
+	doc.Find("form").Each(func(base int, basehtml *goquery.Selection) {
+		basehtml.Find("input").Each(func(baseint int, basein *goquery.Selection) {
+			val, exists := basein.Attr("name")
+			if exists && val == "start" {
+				val, exists = basein.Attr("value")
+				if exists && len(strings.Fields(val)) > 1 {
+					theTime, err := time.Parse(time.RFC3339, (strings.Fields(val)[0])+"T"+(strings.Fields(val)[1])+":00"+timeZone)
+					if err == nil {
+						booking.GuiEpochStart = theTime.Unix()
+					}
+				}
+			}
+		})
+	})
+
+	doc.Find("link").Each(func(base int, basehtml *goquery.Selection) {
+		_, exists := basehtml.Attr("media")
+		val, exists2 := basehtml.Attr("href")
+		if exists && exists2 { //href=index.php?a=i&uniq=myfleet62e7e8ea838ba
+			re := regexp.MustCompile(`.*uniq=(.*)$`)
+			if rem := re.FindStringSubmatch(val); len(rem) > 1 {
+				booking.GuiFleetId = rem[1]
+			}
+		}
+	})
+	if booking.GuiFleetId == "" || booking.GuiEpochStart == 0 {
+		return errors.New("GuiFleetId or GuiEpochStart not found")
+	}
+	return nil
+}
+
+// Login for the specified booking and save the required cookie
+func (m *myFleetWeb) Login(booking *BookingInterface) error {
+	random := fmt.Sprint(time.Now().Nanosecond())
+	if err := m.Session(booking); err != nil {
+		return err
+	}
+
+	//First get authentication killling old session
+	if _, _, err := m.request(booking, http.MethodGet, m.authUrl+"?random="+random, nil); err != nil {
+		return err
+	}
+
+	//Now post the our info to login, the password is only decrypted here
+	password, err := decryptSecret(booking.Password)
+	if err != nil {
+		return err
+	}
+	data := url.Values{}
+	data.Set("un", booking.Username)
+	data.Set("pw", password)
+	_, b, err := m.request(booking, http.MethodPost, m.authUrl+"?random="+random, data)
+	if err != nil {
+		return err
+	}
+	//Correct loging
+	if !strings.Contains(string(b), "Exit Page") {
+		return errors.New("Login response invalid:" + string(b))
+	}
+
+	//Now get the user ID
+	_, b, err = m.request(booking, http.MethodGet, m.textUrl+"?clubname="+clubId+"&variant=", nil)
+	if err != nil {
+		return err
+	}
+	re := regexp.MustCompile(`brsuser=(.*)"`)
+	rem := re.FindStringSubmatch(string(b))
+	booking.UserId = 0
+	if len(rem) > 0 {
+		booking.UserId, _ = strconv.ParseInt(rem[1], 10, 64)
+	}
+	if booking.UserId == 0 {
+		return errors.New("User id not found")
+	}
+
+	//Get the new GuiFleedId
+	_, b, err = m.request(booking, http.MethodGet, m.guiUrl+"?language=NL&brsuser="+strconv.FormatInt(booking.UserId, 10)+"&clubname="+clubId, nil)
+	if err != nil {
+		return err
+	}
+
+	re = regexp.MustCompile(`&uniq=(.*)"`)
+	rem = re.FindStringSubmatch(string(b))
+	if len(rem) == 0 {
+		return errors.New("GuiFleedId not found")
+	}
+	booking.GuiFleetId = rem[1]
+	return nil
+}
+
+// Create the gui url with the extrainfo for a reservation action
+func (m *myFleetWeb) extraInfoUrl(menu string, extraInfo string) string {
+	values := url.Values{}
+	values.Set("a", "e")
+	values.Set("menu", menu)
+	values.Set("extrainfo", extraInfo)
+	return m.guiUrl + "?" + values.Encode()
+}
+
+// Cancel a booking
+func (m *myFleetWeb) Cancel(booking *BookingInterface) error {
+	//STEP: Create Reference to the booking
+	_, b, err := m.request(booking, http.MethodGet, m.extraInfoUrl("Omenu", "mid="+booking.BoatId+
+		"&co=0&rid="+booking.BookingId+
+		"&from="+strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10)+
+		"&dur="+strconv.FormatInt(int64(booking.BookDur/15), 10)+"&rec=0&user="+strconv.FormatInt(booking.UserId, 10)), nil)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+
+	//Step 2: Login to the reference
+	data := url.Values{}
+	data.Set("newStart", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("newEnd", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart+booking.BookDur*60)/(15*60)), 10))
+	_, b, err = m.request(booking, http.MethodPost, m.guiUrl+"?a=e&menu=Rmenu&page=1_cancel", data)
+	if err != nil {
+		return err
+	}
+	//A expired session returns the login page, the boat is then still reserved
+	if err = checkSession(b); err != nil {
+		return err
+	}
+
+	booking.State = "Canceled"
+	booking.BookDur = 0
+	booking.BookStart = 0
+	return nil
+}
+
+// Confirm a booking, my-fleet refuses a confirmation with a page containing the refusal
+func (m *myFleetWeb) Confirm(booking *BookingInterface) error {
+	//STEP: Create Reference to the booking
+	_, b, err := m.request(booking, http.MethodGet, m.extraInfoUrl("Rmenu", "mid="+booking.BoatId+
+		"&co=0&rid="+booking.BookingId+
+		"&from="+strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10)+
+		"&dur="+strconv.FormatInt(int64(booking.BookDur/15), 10)+"&rec=0&user="+strconv.FormatInt(booking.UserId, 10)), nil)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+
+	//Step 2: Confirm the reference
+	data := url.Values{}
+	data.Set("newStart", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("newEnd", strconv.FormatInt(int64((booking.BookStart-booking.GuiEpochStart+booking.BookDur*60)/(15*60)), 10))
+	_, b, err = m.request(booking, http.MethodPost, m.guiUrl+"?a=e&menu=Rmenu&page=1_confirm", data)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+	//The refusal is a normal page, so the status does not tell
+	if strings.Contains(string(b), confirmRefused) {
+		return errors.New("Confirmation not accepted, " + confirmRefused)
+	}
+	//The reservation must still be in a fresh grid
+	boats, err := m.ListBoats(booking)
+	if err != nil {
+		return err
+	}
+	booking.Boats = &boats
+	if _, bb := findReservation(booking); bb == nil {
+		return errors.New("Confirmation not accepted, reservation " + booking.BookingId + " not found")
+	}
+	return nil
+}
+
+// Create a new boat booking with start and end time
+func (m *myFleetWeb) Book(booking *BookingInterface, startTime int64, endTime int64) error {
+	//STEP: Session
+	booking.BookingId = ""
+
+	//STEP: Create Reference to the booking
+	_, _, err := m.request(booking, http.MethodGet, m.extraInfoUrl("Amenu", "mid="+booking.BoatId+
+		"&from="+strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10)+
+		"&dur="+strconv.FormatInt(int64(((endTime-startTime)/60)/15), 10)), nil)
+	if err != nil {
+		return err
+	}
+
+	//Step 2: Login to the reference
+	data := url.Values{}
+	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
+	if c := bookingComment(booking); c != "" {
+		data.Set("comment", c)
+	}
+	data.Set("act", "Verder\n>>")
+	_, b, err := m.request(booking, http.MethodPost, m.guiUrl+"?a=e&menu=Amenu&page=1_single", data)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+	//Read the booking id form the reponse
+	re := regexp.MustCompile(`ReservationId = (.*) `)
+	rem := re.FindStringSubmatch(string(b))
+	if len(rem) > 0 {
+		booking.BookingId = strings.Trim(rem[1], " ")
+	}
+	if booking.BookingId == "" {
+		return errors.New("Failed to create reservation")
+	}
+	//Save the real booking start and duration
+	booking.BookDur = (endTime - startTime) / 60
+	booking.BookStart = startTime
+	return nil
+}
+
+// Update a boat booking start and end time
+func (m *myFleetWeb) Update(booking *BookingInterface, startTime int64, endTime int64) error {
+	//STEP: Create Reference to the booking
+	_, b, err := m.request(booking, http.MethodGet, m.extraInfoUrl("Rmenu", "mid="+booking.BoatId+
+		"&co=0&rid="+booking.BookingId+
+		"&from="+strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10)+
+		"&dur="+strconv.FormatInt(int64(((startTime-endTime)/60)/15), 10)+"&rec=0"), nil)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+
+	//Step 2: Login to the reference
+	data := url.Values{}
+	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("clubcode", "")
+	password, err := decryptSecret(booking.Password)
+	if err != nil {
+		return err
+	}
+	data.Set("username", booking.Username)
+	data.Set("password", password)
+	_, b, err = m.request(booking, http.MethodPost, m.guiUrl+"?a=e&menu=Rmenu&page=1_modifylogbook", data)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+
+	//STEP: Update the booking
+	data = url.Values{}
+	data.Set("newStart", strconv.FormatInt(int64((startTime-booking.GuiEpochStart)/(15*60)), 10))
+	data.Set("newEnd", strconv.FormatInt(int64((endTime-booking.GuiEpochStart)/(15*60)), 10))
+	if c := bookingComment(booking); c != "" {
+		data.Set("comment", c)
+	}
+	data.Set("page", "3_commit")
+	data.Set("act", "Ok")
+	_, b, err = m.request(booking, http.MethodPost, m.guiUrl+"?a=e&menu=Amenu", data)
+	if err != nil {
+		return err
+	}
+	if err = checkSession(b); err != nil {
+		return err
+	}
+	//Save the real booking start and duration
+	booking.BookDur = (endTime - startTime) / 60
+	booking.BookStart = startTime
+	return nil
+}
+
+// Perform a gui action, b=start screen, c=content screen
+func (m *myFleetWeb) guiAction(booking *BookingInterface, action string) (string, error) {
+	values := url.Values{}
+	values.Set("a", action)
+	values.Set("uniq", booking.GuiFleetId)
+	_, b, err := m.request(booking, http.MethodGet, m.guiUrl+"?"+values.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	return string(b), checkSession(b)
+}
+
+// Scrape the boat grid from my-fleet
+func (m *myFleetWeb) ListBoats(booking *BookingInterface) (BoatListStruct, error) {
+	//Get the unix start time of screen
+	start, err := m.guiAction(booking, "b")
+	if err != nil {
+		return BoatListStruct{}, err
+	}
+	//Get the content of screen
+	content, err := m.guiAction(booking, "c")
+	if err != nil {
+		return BoatListStruct{}, err
+	}
+	//Record the grid for the replay
+	if recordGrid != "" {
+		if err := saveGridFixture(start, content); err != nil {
+			log.Error("Record grid ", err)
+		}
+	}
+	return parseBoatList(start, content)
+}
+
+// Parse the start and content screen of the gui into a boat list
+func parseBoatList(start string, content string) (BoatListStruct, error) {
+	boats := BoatListStruct{}
+	epochStart := int64(0)
+	re := regexp.MustCompile(`var starttime_unix = "(.*)";`)
+	rem := re.FindStringSubmatch(start)
+	if len(rem) > 0 {
+		epochStart, _ = strconv.ParseInt(rem[1], 10, 64)
+	}
+
+	re = regexp.MustCompile(`var info=(.*);`)
+	rem = re.FindStringSubmatch(content)
+	if len(rem) == 0 {
+		return boats, errors.New("Boat info not found")
+	}
+	/* Parse the boat list*/
+	type BoatStruct []struct {
+		M struct {
+			BoatId   int      `json:"i"`
+			BoatInfo []string `json:"c"` //  [name,type,location,weigth,spacer,permision]
+		} `json:"m"`
+		R []struct {
+			P  string  `json:"p"`
+			S  string  `json:"s"`
+			X  float64 `json:"x"`
+			W  float64 `json:"w"`
+			U  string  `json:"u"`
+			C  string  `json:"c"`
+			ID string  `json:"id"`
+		} `json:"r"`
+	}
+	webboats := BoatStruct{}
+	if err := json.Unmarshal([]byte(rem[1]), &webboats); err != nil {
+		return boats, err
+	}
+	re = regexp.MustCompile(`var grid_width = (.*);`)
+	rem = re.FindStringSubmatch(content)
+	pixelToMin := float64(12)
+	if len(rem) > 0 {
+		pixelToMin, _ = strconv.ParseFloat(rem[1], 64)
+	}
+	for _, b := range webboats {
+		if len(b.M.BoatInfo) < 5 {
+			continue
+		}
+		//Create a new boat
+		bname := strings.Split(b.M.BoatInfo[0], "&")[0]
+		bc := BoatElementStruct{Id: b.M.BoatId, Name: bname, Type: b.M.BoatInfo[1],
+			Location: b.M.BoatInfo[2], WeigthClass: b.M.BoatInfo[3],
+			Permission: strings.Split(b.M.BoatInfo[4], "&")[0]}
+		//Add all bookings
+		for _, bb := range b.R {
+			if (bb.S == "B" || bb.S == "R") && bb.W > 0 {
+				//The color code indicaties a window not available
+				bbb := BoatElementBookingStruct{
+					Type:        cif(bb.C == "#404040", "N", cif(bb.ID == "", "S", bb.S)),
+					EpochStart:  epochStart + int64((bb.X/pixelToMin)*(15*60)),
+					EpochEnd:    epochStart + int64((bb.X+bb.W)/pixelToMin)*(15*60),
+					Duration:    int64(bb.W/pixelToMin) * 15,
+					BookingId:   bb.ID,
+					BookingInfo: bb.U,
+				}
+				//Add the booking
+				bc.Bookings = append(bc.Bookings, bbb)
+			}
+		}
+		//Save it to the boats list
+		boats = append(boats, bc)
+	}
+	return boats, nil
+}
+
+// The comment we add to a booking, including the team prefix
+func bookingComment(booking *BookingInterface) string {
+	if team, err := getTeamByName(booking.Team); err == nil {
+		return iif(team.Prefix, commentPrefix) + booking.Comment
+	}
+	return commentPrefix + booking.Comment
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Start a fake my-fleet server and a client talking to it
+func newTestFleet(t *testing.T) (*FakeFleet, *myFleetWeb) {
+	t.Helper()
+	updateTimeZone()
+	f := NewFakeFleet()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, newMyFleetWeb(srv.URL)
+}
+
+// Login and reserve the boat tomorrow at 10:00 for a hour
+func bookTestBoat(t *testing.T, f *FakeFleet, m *myFleetWeb, boat string) *BookingInterface {
+	t.Helper()
+	b := &BookingInterface{Username: "u1", Password: "p"}
+	if err := m.Login(b); err != nil {
+		t.Fatal(err)
+	}
+	boats, err := m.ListBoats(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bs := range boats {
+		if bs.Name == boat {
+			b.BoatId = strconv.Itoa(bs.Id)
+		}
+	}
+	start := f.gridStart() + 34*3600
+	if err = m.Book(b, start, start+3600); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCancelExpiredSession(t *testing.T) {
+	f, m := newTestFleet(t)
+	b := bookTestBoat(t, f, m, "Lynx")
+	b.State = "Cancel"
+	f.ExpireSessions()
+	if err := m.Cancel(b); !errors.Is(err, errSessionExpired) {
+		t.Fatalf("cancel with expired session returned %v", err)
+	}
+	if b.State != "Cancel" || len(f.Reservations()) != 1 {
+		t.Fatalf("state %s with %d reservations, the boat must still be reserved", b.State, len(f.Reservations()))
+	}
+	if err := m.Login(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Cancel(b); err != nil {
+		t.Fatal(err)
+	}
+	if b.State != "Canceled" || len(f.Reservations()) != 0 {
+		t.Fatalf("state %s with %d reservations after cancel", b.State, len(f.Reservations()))
+	}
+}
+
+func TestUpdateExpiredSession(t *testing.T) {
+	f, m := newTestFleet(t)
+	b := bookTestBoat(t, f, m, "Lynx")
+	start := b.BookStart
+	f.ExpireSessions()
+	if err := m.Update(b, start+1800, start+5400); !errors.Is(err, errSessionExpired) {
+		t.Fatalf("update with expired session returned %v", err)
+	}
+	if b.BookStart != start || f.Reservations()[0].Start != start {
+		t.Fatal("the reservation is changed with a expired session")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	f, m := newTestFleet(t)
+	b := bookTestBoat(t, f, m, "Lynx")
+	//Too early the confirmation is refused by my-fleet
+	f.ConfirmTime = 30
+	if err := m.Confirm(b); err == nil || !strings.Contains(err.Error(), confirmRefused) || f.Reservations()[0].Confirmed {
+		t.Fatalf("early confirm returned %v", err)
+	}
+	//A expired session is detected before the confirmation
+	f.ExpireSessions()
+	if err := m.Confirm(b); !errors.Is(err, errSessionExpired) {
+		t.Fatalf("confirm with expired session returned %v", err)
+	}
+	if err := m.Login(b); err != nil {
+		t.Fatal(err)
+	}
+	f.ConfirmTime = 0
+	if err := m.Confirm(b); err != nil || !f.Reservations()[0].Confirmed {
+		t.Fatalf("confirm returned %v", err)
+	}
+	//A reservation unknown in my-fleet is not confirmed
+	other := bookTestBoat(t, f, m, "Argus")
+	other.BookingId = "999999"
+	if err := m.Confirm(other); err == nil {
+		t.Fatal("confirm of a unknown reservation accepted")
+	}
+}
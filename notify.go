@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// A notification channel of a team
+type NotifyChannel struct {
+	Id      int64  `db:"id" json:"id"`
+	Team    string `db:"team" json:"team"`
+	Type    string `db:"type" json:"type"`               //whatsapp, smtp, webhook, telegram or ntfy
+	Target  string `db:"target" json:"target"`           //Receiver, email addresses, url, chat id or topic
+	Secret  string `db:"secret" json:"secret,omitempty"` //Webhook key, bot token or access token, write only
+	States  string `db:"states" json:"states"`           //Comma separated booking states, empty for the default states
+	Enabled bool   `db:"enabled" json:"enabled"`         //Should we use the channel
+	Default bool   `db:"-" json:"default,omitempty"`     //The implicit whatsapp channel of the team
+}
+
+// A delivery attempt of a notification on a channel
+type NotifyDelivery struct {
+	Id        int64  `db:"id" json:"id"`
+	Channel   int64  `db:"channel" json:"channel"`
+	Team      string `db:"team" json:"team"`
+	Type      string `db:"type" json:"type"`
+	Target    string `db:"target" json:"target"`
+	State     string `db:"state" json:"state"`
+	Message   string `db:"message" json:"message"`
+	Body      string `db:"body" json:"-"`
+	Status    string `db:"status" json:"status"` //Pending, Sent or Failed
+	Attempts  int    `db:"attempts" json:"attempts"`
+	LastError string `db:"lasterror" json:"lasterror,omitempty"`
+	Created   int64  `db:"created" json:"created"`
+	Next      int64  `db:"next" json:"next,omitempty"`
+}
+
+// A booking in a notification
+type NotificationBooking struct {
+	Id      int64  `json:"id"`
+	Boat    string `json:"boat"`
+	Date    string `json:"date"`
+	Time    string `json:"time"`
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// The notification send to the channels
+type Notification struct {
+	Team     string                `json:"team"`
+	Group    int64                 `json:"group,omitempty"` //The booking group, 0=none
+	State    string                `json:"state"`
+	Message  string                `json:"message"`
+	Bookings []NotificationBooking `json:"bookings"`
+	Time     int64                 `json:"time"`
+}
+
+// Notifier sends a notification over a channel type
+type Notifier interface {
+	Send(channel *NotifyChannel, n *Notification) error
+}
+
+// The available notifiers by channel type
+var notifiers = map[string]Notifier{
+	"whatsapp": whatsAppNotifier{},
+	"smtp":     smtpNotifier{},
+	"webhook":  webhookNotifier{},
+	"telegram": telegramNotifier{},
+	"ntfy":     ntfyNotifier{},
+}
+
+var notifyRetry int = 5                                    //The number of delivery attempts of a notification
+var notifyClient = &http.Client{Timeout: 10 * time.Second} //The http client used by the notifiers
+var notifyWake = make(chan bool, 1)                        //Wake the delivery loop
+var smtpHost string                                        //The smtp server used for email
+var smtpPort string = "587"                                //The port of the smtp server
+var smtpUser string                                        //The smtp user, empty=no authentication
+var smtpPwd string                                         //The smtp password
+var smtpFrom string                                        //The from address of the email
+var telegramUrl string = "https://api.telegram.org"        //The telegram bot api
+var ntfyUrl string = "https://ntfy.sh"                     //The ntfy server used for topics without url
+
+// Check if the channel should notify the booking state
+func (c *NotifyChannel) notifies(state string) bool {
+	if c.States == "" {
+		return notifyStates[state]
+	}
+	for _, s := range strings.Split(c.States, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), state) {
+			return true
+		}
+	}
+	return false
+}
+
+// The enabled channels of the team, including the implicit whatsapp channel when not configured
+func teamChannels(teamName string) []NotifyChannel {
+	var channels []NotifyChannel
+	hasWhatsApp := false
+	for _, c := range readNotifyChannels(teamName) {
+		hasWhatsApp = hasWhatsApp || c.Type == "whatsapp"
+		if c.Enabled && (c.Type != "whatsapp" || whatsApp) {
+			channels = append(channels, c)
+		}
+	}
+	if team, err := getTeamByName(teamName); err == nil && !hasWhatsApp && whatsApp && team.WhatsAppId != "" {
+		channels = append(channels, NotifyChannel{Team: teamName, Type: "whatsapp", Enabled: true, Default: true})
+	}
+	return channels
+}
+
+// Create the message for bookings with the same state
+func bookingMessage(state string, bookings BookingSlice) string {
+	//Finished: booking Amalthea, Argus, Artemis and Lynx at 9:30.
+	var msg string
+	for i, b := range bookings {
+		if i == len(bookings)-1 && i > 0 {
+			msg = msg + " and "
+		} else if i > 0 {
+			msg = msg + ", "
+		}
+		msg = msg + b.BoatLabel()
+	}
+	return "Booking " + strings.ToLower(state) + " for " + msg + " at " + shortDate(bookings[0].Date) + " " + shortTime(bookings[0].Time) + " hour."
+}
+
+// Queue the notifications for all changed bookings, grouped by team, channel, state and receiver.
+// The bookings of a booking group are notified by the group
+func notifyBookings(bookingSlice BookingSlice) {
+	teamBookings := map[string]BookingSlice{}
+	for _, b := range bookingSlice {
+		if b.Changed && b.GroupId == 0 {
+			teamBookings[b.Team] = append(teamBookings[b.Team], b)
+		}
+	}
+	queued := false
+	for teamName, bookings := range teamBookings {
+		for _, c := range teamChannels(teamName) {
+			//Whatsapp is grouped by the receiver of the booking, the other channels have a fixed receiver
+			list := map[string]BookingSlice{}
+			keys := []string{}
+			for _, b := range bookings {
+				if !c.notifies(b.State) {
+					continue
+				}
+				to := c.receiver(&b)
+				if to == "" {
+					continue
+				}
+				key := b.State + ":" + to
+				if _, ok := list[key]; !ok {
+					keys = append(keys, key)
+				}
+				list[key] = append(list[key], b)
+			}
+			for _, k := range keys {
+				v := list[k]
+				n := Notification{Team: teamName, State: v[0].State, Message: bookingMessage(v[0].State, v), Time: timeNow().Unix()}
+				n.addBookings(v)
+				queued = queueNotification(&c, strings.SplitN(k, ":", 2)[1], &n) || queued
+			}
+		}
+	}
+	if queued {
+		wakeNotifier()
+	}
+}
+
+// The receiver of the booking on the channel, whatsapp uses the receiver of the booking
+func (c *NotifyChannel) receiver(b *BookingInterface) string {
+	if c.Type == "whatsapp" {
+		return iif(b.WhatsAppTo, c.Target)
+	}
+	return c.Target
+}
+
+// Add the bookings to the notification
+func (n *Notification) addBookings(bookings BookingSlice) {
+	for _, b := range bookings {
+		n.Bookings = append(n.Bookings, NotificationBooking{Id: b.Id, Boat: b.BoatLabel(), Date: b.Date, Time: b.Time, State: b.State, Message: b.Message})
+	}
+}
+
+// Queue the delivery of the notification on the channel to the receiver
+func queueNotification(c *NotifyChannel, to string, n *Notification) bool {
+	body, _ := json.Marshal(n)
+	d := NotifyDelivery{Channel: c.Id, Team: n.Team, Type: c.Type, Target: to,
+		State: n.State, Message: n.Message, Body: string(body), Status: "Pending", Created: timeNow().Unix()}
+	err := withTx(func(tx *sql.Tx) error {
+		_, err := insertNotifyDelivery(tx, &d)
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return true
+}
+
+// Wake the delivery loop
+func wakeNotifier() {
+	select {
+	case notifyWake <- true:
+	default:
+	}
+}
+
+// Deliver a single notification, a failure is retried with a increasing delay
+func deliver(d *NotifyDelivery) {
+	var n Notification
+	err := json.Unmarshal([]byte(d.Body), &n)
+	if err == nil {
+		var c NotifyChannel
+		if d.Channel != 0 {
+			c, err = readNotifyChannel(db, d.Channel)
+		} else {
+			c = NotifyChannel{Team: d.Team, Type: d.Type, Enabled: true}
+		}
+		if err == nil {
+			c.Target = d.Target
+			if c.Secret, err = decryptSecret(c.Secret); err == nil {
+				if notifier, ok := notifiers[c.Type]; ok {
+					err = notifier.Send(&c, &n)
+				} else {
+					err = errors.New("unknown channel type " + c.Type)
+				}
+			}
+		}
+	}
+	d.Attempts++
+	notifications.WithLabelValues(d.Type, metricResult(err)).Inc()
+	if err == nil {
+		d.Status = "Sent"
+		d.LastError = ""
+		d.Next = 0
+	} else {
+		d.LastError = err.Error()
+		if d.Attempts >= notifyRetry {
+			d.Status = "Failed"
+			d.Next = 0
+		} else {
+			d.Next = timeNow().Add(time.Minute << (d.Attempts - 1)).Unix()
+		}
+	}
+	fields := log.WithFields(log.Fields{
+		"team":     d.Team,
+		"channel":  d.Type,
+		"to":       d.Target,
+		"state":    d.State,
+		"status":   d.Status,
+		"attempts": d.Attempts,
+	})
+	if d.LastError != "" {
+		fields.Warn("Notification failed: " + d.LastError)
+	} else {
+		fields.Info("Notification delivered")
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		return updateNotifyDelivery(tx, d)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Deliver all pending notifications which are due, returns the time of the next retry
+func deliverNotifications() int64 {
+	var next int64 = 0
+	for _, d := range readNotifyDeliveries("status = 'Pending' ORDER BY id") {
+		if d.Next > timeNow().Unix() {
+			if next == 0 || d.Next < next {
+				next = d.Next
+			}
+			continue
+		}
+		deliver(&d)
+		if d.Status == "Pending" && (next == 0 || d.Next < next) {
+			next = d.Next
+		}
+	}
+	return next
+}
+
+// The delivery loop, waking on new notifications and retries
+func notifyLoop() {
+	for {
+		wait := time.Hour
+		if next := deliverNotifications(); next != 0 {
+			wait = time.Unix(next, 0).Sub(timeNow())
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-notifyWake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// The whatsapp notifier, the target is the group or number
+type whatsAppNotifier struct{}
+
+func (whatsAppNotifier) Send(c *NotifyChannel, n *Notification) error {
+	return sendWhatsApp(n.Team, c.Target, n.Message)
+}
+
+// The email notifier, the target is a comma separated list of addresses
+type smtpNotifier struct{}
+
+func (smtpNotifier) Send(c *NotifyChannel, n *Notification) error {
+	if smtpHost == "" {
+		return errors.New("smtp server not configured")
+	}
+	to := strings.Split(c.Target, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPwd, smtpHost)
+	}
+	msg := "From: " + iif(smtpFrom, smtpUser) + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + AppName + " booking " + strings.ToLower(n.State) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + n.Message + "\r\n"
+	return smtp.SendMail(net.JoinHostPort(smtpHost, smtpPort), auth, iif(smtpFrom, smtpUser), to, []byte(msg))
+}
+
+// Post the request of a notifier and check the response
+func notifyPost(request *http.Request) error {
+	response, err := notifyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
+		return errors.New("HTTP Status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+// The webhook notifier, posts the notification as json signed with the secret
+type webhookNotifier struct{}
+
+func (webhookNotifier) Send(c *NotifyChannel, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, c.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		request.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return notifyPost(request)
+}
+
+// The telegram notifier, the target is the chat id and the secret the bot token
+type telegramNotifier struct{}
+
+func (telegramNotifier) Send(c *NotifyChannel, n *Notification) error {
+	data := url.Values{}
+	data.Set("chat_id", c.Target)
+	data.Set("text", n.Message)
+	request, err := http.NewRequest(http.MethodPost, telegramUrl+"/bot"+c.Secret+"/sendMessage", strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return notifyPost(request)
+}
+
+// The ntfy notifier, the target is the topic or topic url and the secret a optional access token
+type ntfyNotifier struct{}
+
+func (ntfyNotifier) Send(c *NotifyChannel, n *Notification) error {
+	topic := c.Target
+	if !strings.HasPrefix(topic, "http://") && !strings.HasPrefix(topic, "https://") {
+		topic = strings.TrimRight(ntfyUrl, "/") + "/" + topic
+	}
+	request, err := http.NewRequest(http.MethodPost, topic, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Title", AppName+" booking "+strings.ToLower(n.State))
+	if c.Secret != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Secret)
+	}
+	return notifyPost(request)
+}
+
+// Remove the secrets of the channels before sending them
+func publicChannels(list []NotifyChannel) []NotifyChannel {
+	result := make([]NotifyChannel, len(list))
+	for i, c := range list {
+		c.Secret = ""
+		result[i] = c
+	}
+	return result
+}
+
+// The notification api of the teams
+func notifyRoutes(g *echo.Group) {
+	g.GET("/notify", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		return c.JSON(http.StatusOK, publicChannels(readNotifyChannels(teamFilter(team))))
+	})
+
+	g.POST("/notify", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		channel := new(NotifyChannel)
+		if err = c.Bind(channel); err != nil || notifiers[channel.Type] == nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		channel.Team = team.teamOf(channel.Team)
+		if channel.Secret, err = encryptSecret(channel.Secret); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			_, err := insertNotifyChannel(tx, channel)
+			return err
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.WithFields(log.Fields{
+			"team": channel.Team,
+			"type": channel.Type,
+		}).Info("Added notification channel")
+		return c.JSON(http.StatusOK, publicChannels(readNotifyChannels(teamFilter(team))))
+	})
+
+	g.PUT("/notify/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		channel := new(NotifyChannel)
+		if err = c.Bind(channel); err != nil || notifiers[channel.Type] == nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		current, err := readNotifyChannel(db, id)
+		if err != nil || !team.Allowed(current.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		channel.Id = current.Id
+		channel.Team = team.teamOf(iif(channel.Team, current.Team))
+		//The secret is write only, keep the current one when not set
+		if channel.Secret == "" {
+			channel.Secret = current.Secret
+		} else if channel.Secret, err = encryptSecret(channel.Secret); err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return updateNotifyChannel(tx, channel)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		return c.JSON(http.StatusOK, publicChannels(readNotifyChannels(teamFilter(team))))
+	})
+
+	g.DELETE("/notify/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		current, err := readNotifyChannel(db, id)
+		if err != nil || !team.Allowed(current.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return deleteNotifyChannel(tx, current.Id)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		return c.JSON(http.StatusOK, publicChannels(readNotifyChannels(teamFilter(team))))
+	})
+
+	g.GET("/notify/deliveries", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		return c.JSON(http.StatusOK, readNotifyDeliveries("? = '' OR team = ? ORDER BY id DESC LIMIT 100", teamFilter(team), teamFilter(team)))
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reconcileInterval int = 15 //The interval in minutes our reservations are compared with the grid, 0=disabled
+var rebook bool = false        //Should we book again when our reservation is canceled outside the robot
+
+// The states of a booking holding a reservation that is only compared with the grid
+var reconciledStates = map[string]bool{"Finished": true, "Confirmed": true, "ExternallyModified": true}
+
+// Check if the state is final, a external cancel is only final when we do not book again
+func reconcileTerminal(state string) bool {
+	return state == "ExternallyCanceled" && !rebook
+}
+
+// Check if the reservation of the booking should be compared with the grid
+func reconcileDue(b *BookingInterface) bool {
+	return reconcileInterval > 0 && b.BookingId != "" && reconciledStates[b.State] && b.EpochStart > timeNow().Unix()
+}
+
+// Check if the grid shows the day of the booking, only then a missing reservation means it is canceled
+func gridCovers(b *BookingInterface) bool {
+	for _, bs := range *b.Boats {
+		if b.BoatId != strconv.Itoa(bs.Id) && !strings.EqualFold(bs.Name, b.BookedBoat) {
+			continue
+		}
+		sunrise, sunset := false, false
+		for _, bb := range bs.Bookings {
+			if bb.Type == "S" {
+				sunrise = sunrise || bb.EpochEnd <= b.EpochStart
+				sunset = sunset || bb.EpochStart >= b.EpochStart
+			}
+		}
+		return sunrise && sunset
+	}
+	return false
+}
+
+// Find our reservation of the booking in the grid
+func findReservation(b *BookingInterface) (*BoatElementStruct, *BoatElementBookingStruct) {
+	for i := range *b.Boats {
+		bs := &(*b.Boats)[i]
+		for j := range bs.Bookings {
+			if bb := &bs.Bookings[j]; bb.Type == "R" && bb.BookingId == b.BookingId {
+				return bs, bb
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Check if the reservation in the grid differs from the booked boat and period
+func reservationChanged(b *BookingInterface, bs *BoatElementStruct, bb *BoatElementBookingStruct) bool {
+	if bb == nil {
+		return gridCovers(b) //A reservation beyond the grid is unknown
+	}
+	//Older bookings do not know the booked period, only a cancel is detected
+	moved := b.BoatId != "" && b.BoatId != strconv.Itoa(bs.Id)
+	return moved || (b.BookStart != 0 && (b.BookStart != bb.EpochStart || b.BookDur != (bb.EpochEnd-bb.EpochStart)/60))
+}
+
+// Compare the reservation of the booking with the grid, a reservation canceled or changed outside the robot
+// gets the state ExternallyCanceled or ExternallyModified. Only the reconciled states are compared, a booking
+// the robot is still booking, changing or canceling could differ from the grid. Returns true when the booking is changed.
+func reconcileBooking(b *BookingInterface) bool {
+	if b.BookingId == "" || b.Boats == nil || !reconciledStates[b.State] {
+		return false
+	}
+	bs, bb := findReservation(b)
+	if !reservationChanged(b, bs, bb) {
+		return false
+	}
+	//The cached grid could be older than our last change, so check again with a fresh grid
+	if _, boats := readBoatJson(b, 0); len(boats) > 0 {
+		b.Boats = &boats
+		if bs, bb = findReservation(b); !reservationChanged(b, bs, bb) {
+			return false
+		}
+	}
+	if bb != nil {
+		loc, _ := time.LoadLocation(timeZoneLoc)
+		b.BoatId = strconv.Itoa(bs.Id)
+		b.BookedBoat = bs.Name
+		b.BookStart, b.BookDur = bb.EpochStart, (bb.EpochEnd-bb.EpochStart)/60
+		b.State = "ExternallyModified"
+		b.Message = "Reservation changed outside the robot to " + bs.Name + " " +
+			time.Unix(bb.EpochStart, 0).In(loc).Format("15:04") + " - " + time.Unix(bb.EpochEnd, 0).In(loc).Format("15:04")
+	} else {
+		b.State = "ExternallyCanceled"
+		b.Message = "Reservation of " + b.BoatLabel() + " canceled outside the robot" + cif(rebook, ", booking again", "")
+		b.BookingId = ""
+		b.BookedBoat = ""
+		b.BookStart, b.BookDur = 0, 0
+		b.FallbackIndex = 0
+		b.Retry = 0
+	}
+	bookingExternalChanges.WithLabelValues(b.Team, b.State).Inc()
+	return true
+}
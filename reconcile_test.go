@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Reserve a boat on the fake my-fleet as a finished booking of the robot, the fleet client talks to the fake
+func reconcileTestBooking(t *testing.T) (*FakeFleet, *myFleetWeb, *BookingInterface, int64) {
+	t.Helper()
+	inTempDir(t)
+	f, m := newTestFleet(t)
+	saved := fleetClient
+	t.Cleanup(func() { fleetClient = saved })
+	fleetClient = m
+	b := bookTestBoat(t, f, m, "Lynx")
+	b.State, b.BookedBoat, b.EpochStart = "Finished", "Lynx", b.BookStart
+	id, err := strconv.ParseInt(b.BookingId, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, m, b, id
+}
+
+// Read the current grid of the fake into the booking
+func readTestGrid(t *testing.T, m *myFleetWeb, b *BookingInterface) {
+	t.Helper()
+	boats, err := m.ListBoats(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Boats = &boats
+}
+
+func TestReconcileUnchanged(t *testing.T) {
+	_, m, b, _ := reconcileTestBooking(t)
+	readTestGrid(t, m, b)
+	if !gridCovers(b) {
+		t.Fatal("grid does not cover the day of the booking")
+	}
+	if reconcileBooking(b) || b.State != "Finished" {
+		t.Fatalf("unchanged reservation reconciled to %s: %s", b.State, b.Message)
+	}
+}
+
+func TestReconcileExternalCancel(t *testing.T) {
+	f, m, b, id := reconcileTestBooking(t)
+	f.Remove(id)
+	readTestGrid(t, m, b)
+	if !reconcileBooking(b) || b.State != "ExternallyCanceled" || b.BookingId != "" || b.BookStart != 0 || b.BookedBoat != "" {
+		t.Fatalf("external cancel reconciled to %s: %+v", b.State, b)
+	}
+}
+
+func TestReconcileExternalChange(t *testing.T) {
+	cases := []struct {
+		name       string
+		start, end int64 //The change of the start and end in seconds
+	}{
+		{"shorten", 0, -1800},
+		{"move", 1800, 1800},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, m, b, id := reconcileTestBooking(t)
+			start, end := b.BookStart+c.start, b.BookStart+b.BookDur*60+c.end
+			if err := f.Modify(id, start, end); err != nil {
+				t.Fatal(err)
+			}
+			readTestGrid(t, m, b)
+			if bs, bb := findReservation(b); !reservationChanged(b, bs, bb) {
+				t.Fatal("changed reservation not detected")
+			}
+			if !reconcileBooking(b) || b.State != "ExternallyModified" || b.BookingId == "" {
+				t.Fatalf("external change reconciled to %s: %s", b.State, b.Message)
+			}
+			if b.BookStart != start || b.BookDur != (end-start)/60 {
+				t.Fatalf("period %d %d, expected %d %d", b.BookStart, b.BookDur, start, (end-start)/60)
+			}
+		})
+	}
+}
+
+func TestReconcileBeyondGrid(t *testing.T) {
+	f, m, b, _ := reconcileTestBooking(t)
+	readTestGrid(t, m, b)
+	//A reservation on a day the grid does not show is missing, but not canceled
+	b.BookingId = "999999"
+	b.EpochStart = f.gridStart() + int64(f.Days+1)*24*3600 + 10*3600
+	b.BookStart = b.EpochStart
+	if gridCovers(b) {
+		t.Fatal("grid covers a day beyond the grid")
+	}
+	if reconcileBooking(b) || b.State != "Finished" || b.BookingId != "999999" {
+		t.Fatalf("reservation beyond the grid reconciled to %s: %s", b.State, b.Message)
+	}
+}
+
+func TestReconcileStaleGrid(t *testing.T) {
+	f, m, b, id := reconcileTestBooking(t)
+	//The grid read before the reservation was made misses it, the fresh grid shows it
+	f.Remove(id)
+	readTestGrid(t, m, b)
+	start := b.BookStart
+	if _, err := f.Reserve("Lynx", start, start+b.BookDur*60, ""); err != nil {
+		t.Fatal(err)
+	}
+	b.BookingId = strconv.FormatInt(f.Reservations()[0].Id, 10)
+	if bs, bb := findReservation(b); !reservationChanged(b, bs, bb) {
+		t.Fatal("stale grid shows the reservation")
+	}
+	if reconcileBooking(b) || b.State != "Finished" {
+		t.Fatalf("reservation missing in a stale grid reconciled to %s: %s", b.State, b.Message)
+	}
+}
+
+func TestReconcileOnlyReconciledStates(t *testing.T) {
+	f, m, b, id := reconcileTestBooking(t)
+	f.Remove(id)
+	readTestGrid(t, m, b)
+	//A booking the robot is canceling or changing is not compared with the grid
+	for _, state := range []string{"Cancel", "Update", "Retry", "ConfirmRetry"} {
+		b.State = state
+		if reconcileBooking(b) || b.State != state || b.BookingId == "" {
+			t.Fatalf("state %s reconciled to %s", state, b.State)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var recordGrid string = "" //The directory the scraped boat grids are recorded in, empty=disabled
+
+// The raw payloads of a scraped boat grid
+type GridFixture struct {
+	Recorded  int64  `json:"recorded"`       //The moment the grid was scraped
+	StartTime string `json:"starttime_unix"` //The var starttime_unix of the start screen
+	GridWidth string `json:"grid_width"`     //The var grid_width of the content screen
+	Info      string `json:"info"`           //The var info of the content screen
+}
+
+// The start and content screen of the recorded grid, as served by my-fleet
+func (f *GridFixture) screens() (string, string) {
+	start := "<script>\nvar starttime_unix = \"" + f.StartTime + "\";\n</script>\n"
+	content := "<script>\nvar info=" + f.Info + ";\n"
+	if f.GridWidth != "" {
+		content += "var grid_width = " + f.GridWidth + ";\n"
+	}
+	return start, content + "</script>\n"
+}
+
+// Save the raw payloads of the scraped grid as fixture in the record directory
+func saveGridFixture(start string, content string) error {
+	f := GridFixture{Recorded: timeNow().Unix()}
+	if rem := regexp.MustCompile(`var starttime_unix = "(.*)";`).FindStringSubmatch(start); len(rem) > 0 {
+		f.StartTime = rem[1]
+	}
+	if rem := regexp.MustCompile(`var grid_width = (.*);`).FindStringSubmatch(content); len(rem) > 0 {
+		f.GridWidth = rem[1]
+	}
+	rem := regexp.MustCompile(`var info=(.*);`).FindStringSubmatch(content)
+	if len(rem) == 0 {
+		return errors.New("Boat info not found")
+	}
+	info, err := sanitizeGridInfo(rem[1])
+	if err != nil {
+		return err
+	}
+	f.Info = info
+	if err := os.MkdirAll(recordGrid, 0755); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(f, "", "  ")
+	return os.WriteFile(filepath.Join(recordGrid, "grid-"+strconv.FormatInt(f.Recorded, 10)+".json"), data, 0644)
+}
+
+// Replace the member names of the reservations in the grid info by Member 1, Member 2, ..., so a recorded
+// grid can be added to the replay cases. The same name gets the same replacement within the grid
+func sanitizeGridInfo(info string) (string, error) {
+	var grid []map[string]any
+	d := json.NewDecoder(strings.NewReader(info))
+	d.UseNumber()
+	if err := d.Decode(&grid); err != nil {
+		return "", err
+	}
+	names := map[string]string{}
+	for _, boat := range grid {
+		reservations, _ := boat["r"].([]any)
+		for _, r := range reservations {
+			if res, ok := r.(map[string]any); ok {
+				if name, _ := res["u"].(string); name != "" {
+					if names[name] == "" {
+						names[name] = "Member " + strconv.Itoa(len(names)+1)
+					}
+					res["u"] = names[name]
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(grid)
+	return string(b), err
+}
+
+// Read a recorded grid and parse it like a scraped grid
+func loadGridFixture(file string) (GridFixture, BoatListStruct, error) {
+	var f GridFixture
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return f, nil, err
+	}
+	if err = json.Unmarshal(data, &f); err != nil {
+		return f, nil, err
+	}
+	boats, err := parseBoatList(f.screens())
+	return f, boats, err
+}
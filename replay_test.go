@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The directory with the recorded grids and the replay cases
+const replayDir = "testdata/replay"
+
+// The expected result of a replayed booking. A empty time expects no time, "any" is not checked
+type ReplayExpect struct {
+	State   string `json:"state"`
+	Start   string `json:"start"`          //The start of the booked or moved reservation, RFC3339
+	End     string `json:"end"`            //The end of the booked or moved reservation, RFC3339
+	Next    string `json:"next"`           //The EpochNext of the booking, RFC3339
+	Message string `json:"message"`        //Part of the message
+	Date    string `json:"date,omitempty"` //The date of the booking, changed by a repeat
+}
+
+// A step of the lifecycle of a booking, processed by the scheduler logic at the time of the fake clock
+type ReplayStep struct {
+	Now     string       `json:"now,omitempty"`     //Set the clock to the time, RFC3339
+	Advance string       `json:"advance,omitempty"` //Advance the clock by the duration
+	Expect  ReplayExpect `json:"expect"`
+}
+
+// A booking replayed against a recorded grid, with the expected result
+type ReplayCase struct {
+	Name        string           `json:"name"`
+	Grid        string           `json:"grid"`                  //The fixture file of the grid
+	Now         string           `json:"now"`                   //The simulated time, RFC3339
+	MinDuration int              `json:"minDuration,omitempty"` //The minimal duration, 0=default
+	BookWindow  int              `json:"bookWindow,omitempty"`  //The book window in hours, 0=default
+	Booking     BookingInterface `json:"booking"`
+	Expect      ReplayExpect     `json:"expect"`          //The result of a single doBooking
+	Steps       []ReplayStep     `json:"steps,omitempty"` //The lifecycle, replaces the single doBooking
+}
+
+// The MyFleetClient of the replay, the grid is recorded and the reservations are only remembered
+type replayFleetClient struct {
+	boats BoatListStruct
+	start int64 //The start of the last book or update
+	end   int64 //The end of the last book or update
+}
+
+func (r *replayFleetClient) Session(booking *BookingInterface) error { return nil }
+func (r *replayFleetClient) Login(booking *BookingInterface) error   { return nil }
+func (r *replayFleetClient) Logout(booking *BookingInterface) error  { return nil }
+func (r *replayFleetClient) Confirm(booking *BookingInterface) error { return nil }
+
+func (r *replayFleetClient) ListBoats(booking *BookingInterface) (BoatListStruct, error) {
+	return r.boats, nil
+}
+
+func (r *replayFleetClient) Book(booking *BookingInterface, startTime int64, endTime int64) error {
+	r.start, r.end = startTime, endTime
+	booking.BookingId = "replay"
+	booking.BookStart, booking.BookDur = startTime, (endTime-startTime)/60
+	return nil
+}
+
+func (r *replayFleetClient) Update(booking *BookingInterface, startTime int64, endTime int64) error {
+	r.start, r.end = startTime, endTime
+	booking.BookStart, booking.BookDur = startTime, (endTime-startTime)/60
+	return nil
+}
+
+func (r *replayFleetClient) Cancel(booking *BookingInterface) error {
+	booking.State = "Canceled"
+	return nil
+}
+
+// Compare the epoch with the expected RFC3339 time
+func replayTime(name string, expect string, epoch int64) error {
+	if expect == "any" {
+		return nil
+	}
+	if expect == "" {
+		if epoch > 0 {
+			return fmt.Errorf("%s %s, expected none", name, time.Unix(epoch, 0).Format(time.RFC3339))
+		}
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, expect)
+	if err != nil {
+		return fmt.Errorf("invalid expected %s %s", name, expect)
+	}
+	if t.Unix() != epoch {
+		actual := "none"
+		if epoch > 0 {
+			actual = time.Unix(epoch, 0).In(t.Location()).Format(time.RFC3339)
+		}
+		return fmt.Errorf("%s %s, expected %s", name, actual, expect)
+	}
+	return nil
+}
+
+// Check the booking and the reservation made against the expected result
+func (e *ReplayExpect) check(b *BookingInterface, client *replayFleetClient) error {
+	var errs []string
+	if b.State != e.State {
+		errs = append(errs, "state "+iif(b.State, "New")+", expected "+iif(e.State, "New"))
+	}
+	for _, err := range []error{replayTime("start", e.Start, client.start), replayTime("end", e.End, client.end),
+		replayTime("next", e.Next, b.EpochNext)} {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if !strings.Contains(b.Message, e.Message) {
+		errs = append(errs, "message "+b.Message+", expected "+e.Message)
+	}
+	if e.Date != "" && shortDate(b.Date) != e.Date {
+		errs = append(errs, "date "+b.Date+", expected "+e.Date)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Replay a single case through doBooking, or through the lifecycle steps, at the time of the fake clock
+func runReplayCase(c *ReplayCase, dir string) error {
+	now, err := time.Parse(time.RFC3339, c.Now)
+	if err != nil {
+		return errors.New("invalid now " + c.Now)
+	}
+	_, boats, err := loadGridFixture(filepath.Join(dir, c.Grid))
+	if err != nil {
+		return err
+	}
+	client := &replayFleetClient{boats: boats}
+	fake := NewFakeClock(now)
+	savedClient, savedMin, savedWindow, savedClock := fleetClient, minDuration, bookWindow, clock
+	defer func() {
+		fleetClient, minDuration, bookWindow, clock = savedClient, savedMin, savedWindow, savedClock
+		updateTimeZone()
+	}()
+	fleetClient, clock = client, fake
+	if c.MinDuration != 0 {
+		minDuration = c.MinDuration
+	}
+	if c.BookWindow != 0 {
+		bookWindow = c.BookWindow
+	}
+	updateTimeZone()
+
+	b := c.Booking
+	b.normalizeFallbacks()
+	if len(c.Steps) == 0 {
+		b.Boats = &boats
+		if err = setBookingEpochs(&b); err != nil {
+			return err
+		}
+		if _, err = doBooking(&b); err != nil {
+			return err
+		}
+		return c.Expect.check(&b, client)
+	}
+	for i, step := range c.Steps {
+		if step.Now != "" {
+			t, err := time.Parse(time.RFC3339, step.Now)
+			if err != nil {
+				return errors.New("invalid now " + step.Now)
+			}
+			fake.Set(t)
+		}
+		if step.Advance != "" {
+			d, err := time.ParseDuration(step.Advance)
+			if err != nil {
+				return errors.New("invalid advance " + step.Advance)
+			}
+			fake.Advance(d)
+		}
+		updateTimeZone()
+		//The grid is read from the fixture, never from the cached grid
+		os.Remove(boatFile)
+		client.start, client.end = 0, 0
+		b.Changed = false
+		processBooking(&b)
+		if err := step.Expect.check(&b, client); err != nil {
+			return fmt.Errorf("step %d at %s: %v", i+1, fake.Now().Format(time.RFC3339), err)
+		}
+	}
+	return nil
+}
+
+// Run the test in a empty work directory, so the cached boat grid of a local robot is not touched
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.Mkdir(filepath.Join(dir, dbPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Every recorded grid must be parsed into a boat list
+func TestGridFixtures(t *testing.T) {
+	updateTimeZone()
+	files, err := filepath.Glob(filepath.Join(replayDir, "grid-*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no grid fixtures found", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			_, boats, err := loadGridFixture(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(boats) == 0 {
+				t.Fatal("no boats in the grid")
+			}
+		})
+	}
+}
+
+func TestRecordSanitizedGrid(t *testing.T) {
+	f, m := newTestFleet(t)
+	defer func(dir string) { recordGrid = dir }(recordGrid)
+	recordGrid = t.TempDir()
+	start := f.gridStart() + 34*3600
+	if _, err := f.Reserve("Argus", start, start+3600, "Piet Pietersen"); err != nil {
+		t.Fatal(err)
+	}
+	b := &BookingInterface{Username: "u1", Password: "p"}
+	if err := m.Login(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ListBoats(b); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(recordGrid, "grid-*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d grids recorded", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Piet") {
+		t.Fatal("member name recorded in the grid")
+	}
+	//The sanitized grid still holds the reservation
+	_, boats, err := loadGridFixture(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bs := range boats {
+		for _, bb := range bs.Bookings {
+			if bb.Type == "R" && bs.Name == "Argus" && bb.EpochStart == start && bb.BookingInfo == "Member 1" {
+				return
+			}
+		}
+	}
+	t.Fatal("reservation missing in the recorded grid")
+}
+
+// Replay the cases of the replay directory against their recorded grid
+func TestReplay(t *testing.T) {
+	dir, err := filepath.Abs(replayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "cases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []ReplayCase
+	if err = json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	inTempDir(t)
+	openTestDB(t)
+	for i := range cases {
+		c := &cases[i]
+		t.Run(c.Name, func(t *testing.T) {
+			if err := runReplayCase(c, dir); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The role of a account within the team, a higher role includes the rights of the lower roles
+type Role int
+
+const (
+	RoleNone      Role = iota
+	RoleViewer         //Can only read the data of the team
+	RoleMember         //Can change only the own bookings
+	RolePlanner        //Can change all bookings and groups of the team
+	RoleTeamAdmin      //Can change the users, accounts, notifications and settings of the team
+	RoleClubAdmin      //Can change everything of all teams and the club wide settings
+)
+
+var roleNames = []string{"", "viewer", "member", "planner", "team-admin", "club-admin"}
+
+func (r Role) String() string {
+	if r < RoleNone || int(r) >= len(roleNames) {
+		return ""
+	}
+	return roleNames[r]
+}
+
+// Parse the name of a role
+func parseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if i > 0 && strings.EqualFold(n, name) {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, errors.New("invalid role " + name + ", use " + strings.Join(roleNames[1:], ", "))
+}
+
+// Struc used to store a individual account of a team
+type AccountInterface struct {
+	Id       int64  `db:"id" json:"id"`
+	Team     string `db:"team" json:"team"`
+	Username string `db:"username" json:"user"` //The login name, a member owns the bookings of this my-fleet user
+	Password string `db:"password" json:"password,omitempty"`
+	Name     string `db:"name" json:"name"`
+	Role     string `db:"role" json:"role"`
+}
+
+// The team and account of a request with the role of the account. Logged in with the team password
+// there is no account, the role is then team-admin or club-admin for a admin team. A team admin can turn
+// the team password off by accountsonly
+type Principal struct {
+	*TeamInterface
+	Account *AccountInterface
+	Role    Role
+}
+
+// The principal of a login with the team password
+func teamPrincipal(t *TeamInterface) *Principal {
+	if t.Admin {
+		return &Principal{TeamInterface: t, Role: RoleClubAdmin}
+	}
+	return &Principal{TeamInterface: t, Role: RoleTeamAdmin}
+}
+
+// Check if the team has a account that can manage the team, required to turn the team password off
+func hasAdminAccount(t *TeamInterface) bool {
+	required := RoleTeamAdmin
+	if t.Admin {
+		required = RoleClubAdmin
+	}
+	for _, a := range readAccounts(t.Team) {
+		if role, err := parseRole(a.Role); err == nil && role >= required && a.Password != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// The principal of a account login
+func accountPrincipal(t *TeamInterface, a *AccountInterface) *Principal {
+	role, _ := parseRole(a.Role)
+	return &Principal{TeamInterface: t, Account: a, Role: role}
+}
+
+// Check if the principal has at least the role
+func (p *Principal) Has(role Role) bool {
+	return p.Role >= role
+}
+
+// Check if the principal can manage all teams
+func (p *Principal) ClubAdmin() bool {
+	return p.Role >= RoleClubAdmin
+}
+
+// Check if the principal has at least the role for the data of the team
+func (p *Principal) Allowed(team string, role Role) bool {
+	return p.Role >= role && (p.ClubAdmin() || p.Team == team)
+}
+
+// Check if the principal may change the booking, a member only the bookings of the own my-fleet user
+func (p *Principal) CanChange(b *BookingInterface) bool {
+	if !p.Allowed(b.Team, RoleMember) {
+		return false
+	}
+	return p.Role >= RolePlanner || (p.Account != nil && strings.EqualFold(b.Username, p.Account.Username))
+}
+
+// The team of new data, only a club admin may choose a other team
+func (p *Principal) teamOf(requested string) string {
+	return cif(p.ClubAdmin(), iif(requested, p.Team), p.Team)
+}
+
+// The name of the acting account used in the logs of a booking
+func (p *Principal) Actor() string {
+	if p.Account == nil {
+		return p.Title
+	}
+	return iif(p.Account.Name, p.Account.Username) + " (" + p.Account.Team + ")"
+}
+
+// The login name of the account, empty when logged in with the team password
+func accountName(p *Principal) string {
+	if p.Account == nil {
+		return ""
+	}
+	return p.Account.Username
+}
+
+// Find the account of the team by name and check the password
+func authenticateAccount(team string, username string, password string) (*Principal, error) {
+	for i, t := range teams {
+		if t.Team != team {
+			continue
+		}
+		a, err := readAccountByName(db, team, username)
+		if err != nil || a.Password == "" || password == "" ||
+			bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(password)) != nil {
+			break
+		}
+		return accountPrincipal(&teams[i], a), nil
+	}
+	return nil, errors.New("invalid account or password")
+}
+
+// Remove the password hash of the accounts before sending them
+func publicAccounts(list []AccountInterface) []AccountInterface {
+	for i := range list {
+		list[i].Password = ""
+	}
+	return list
+}
+
+// Check the role given to a account, nobody can give a role higher than the own role
+func checkAccountRole(p *Principal, a *AccountInterface) error {
+	role, err := parseRole(iif(a.Role, RoleViewer.String()))
+	if err != nil {
+		return err
+	}
+	if role > p.Role {
+		return errors.New("role " + role.String() + " is above your own role")
+	}
+	a.Role = role.String()
+	return nil
+}
+
+// The api of the accounts, managed by the team admin
+func accountRoutes(g *echo.Group) {
+	g.GET("/accounts", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		return c.JSON(http.StatusOK, publicAccounts(readAccounts(teamFilter(team))))
+	})
+
+	g.POST("/accounts", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		a := new(AccountInterface)
+		if err = c.Bind(a); err != nil || a.Username == "" || a.Password == "" {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		a.Team = team.teamOf(a.Team)
+		if err = checkAccountRole(team, a); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if a.Password, err = hashPassword(a.Password); err != nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			_, err := insertAccount(tx, a)
+			return err
+		})
+		if err != nil {
+			log.Error(err)
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		log.WithFields(log.Fields{
+			"team":    a.Team,
+			"account": a.Username,
+			"role":    a.Role,
+			"by":      team.Actor(),
+		}).Info("Added account")
+		return c.JSON(http.StatusOK, publicAccounts(readAccounts(teamFilter(team))))
+	})
+
+	g.PUT("/accounts/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		a := new(AccountInterface)
+		if err = c.Bind(a); err != nil || a.Username == "" {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		current, err := readAccount(db, id)
+		if err != nil || !team.Allowed(current.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		if role, _ := parseRole(current.Role); role > team.Role {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		a.Id = current.Id
+		a.Team = team.teamOf(iif(a.Team, current.Team))
+		if err = checkAccountRole(team, a); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		//The password is write only, keep the current one when not set
+		if a.Password == "" {
+			a.Password = current.Password
+		} else if a.Password, err = hashPassword(a.Password); err != nil {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return updateAccount(tx, a)
+		})
+		if err != nil {
+			log.Error(err)
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		log.WithFields(log.Fields{
+			"team":    a.Team,
+			"account": a.Username,
+			"role":    a.Role,
+			"by":      team.Actor(),
+		}).Info("Updated account")
+		return c.JSON(http.StatusOK, publicAccounts(readAccounts(teamFilter(team))))
+	})
+
+	g.DELETE("/accounts/:id", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil || !team.Has(RoleTeamAdmin) {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		current, err := readAccount(db, id)
+		if err != nil || !team.Allowed(current.Team, RoleTeamAdmin) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		if role, _ := parseRole(current.Role); role > team.Role {
+			return c.String(http.StatusForbidden, "Forbidden.")
+		}
+		err = withTx(func(tx *sql.Tx) error {
+			return deleteAccount(tx, current.Id)
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, err)
+		}
+		log.WithFields(log.Fields{
+			"team":    current.Team,
+			"account": current.Username,
+			"by":      team.Actor(),
+		}).Info("Deleted account")
+		return c.JSON(http.StatusOK, publicAccounts(readAccounts(teamFilter(team))))
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// Add a account to the team with a hashed password
+func addTestAccount(t *testing.T, team string, username string, role Role) {
+	t.Helper()
+	hash, err := hashPassword(username + "-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := AccountInterface{Team: team, Username: username, Password: hash, Role: role.String()}
+	if err = withTx(func(tx *sql.Tx) error { _, err := insertAccount(tx, &a); return err }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountsOnly(t *testing.T) {
+	openTestDB(t)
+	defer func(list []TeamInterface, secret []byte) { teams, tokenSecret = list, secret }(teams, tokenSecret)
+	tokenSecret = []byte("test")
+	hash, err := hashPassword("team-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	team := TeamInterface{Team: "t1", Title: "Team 1", Password: hash}
+	if err = withTx(func(tx *sql.Tx) error { _, err := insertTeam(tx, &team, false); return err }); err != nil {
+		t.Fatal(err)
+	}
+	teams = readTeams()
+	if _, err = authenticateTeam("t1", "team-pw"); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := issueToken(teamPrincipal(&team))
+
+	//Only a account able to manage the team allows the team password to be turned off
+	addTestAccount(t, "t1", "viewer", RoleViewer)
+	if hasAdminAccount(&team) {
+		t.Fatal("viewer account accepted as admin account")
+	}
+	addTestAccount(t, "t1", "admin", RoleTeamAdmin)
+	if !hasAdminAccount(&team) {
+		t.Fatal("team admin account not found")
+	}
+	if admin := (TeamInterface{Team: "t1", Admin: true}); hasAdminAccount(&admin) {
+		t.Fatal("team admin account accepted for a admin team")
+	}
+
+	team.Accounts = true
+	if err = withTx(func(tx *sql.Tx) error { return updateTeam(tx, &team) }); err != nil {
+		t.Fatal(err)
+	}
+	teams = readTeams()
+	if _, err = authenticateTeam("t1", "team-pw"); err == nil {
+		t.Fatal("team password accepted with accountsonly")
+	}
+	if _, err = parseToken(token); err == nil {
+		t.Fatal("token of the team password accepted with accountsonly")
+	}
+	if p, err := authenticateAccount("t1", "admin", "admin-pw"); err != nil || p.Role != RoleTeamAdmin {
+		t.Fatalf("account login refused with accountsonly: %v", err)
+	}
+}
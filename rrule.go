@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A RFC 5545 recurrence rule, only the date parts are used because the booking has its own time.
+// Supported are FREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY and BYMONTH
+type RRule struct {
+	Freq       string    //DAILY, WEEKLY, MONTHLY or YEARLY
+	Interval   int       //The number of periods between the occurrences
+	Count      int       //The maximum number of occurrences, 0=unlimited
+	Until      time.Time //The last possible occurrence, zero=unlimited
+	ByDay      []ruleDay //The week days, with an optional ordinal like 2SA or -1SU
+	ByMonthDay []int     //The days of the month, negative from the end of the month
+	ByMonth    []int     //The months of the year
+}
+
+// A week day in a rule with the optional ordinal, 0=every
+type ruleDay struct {
+	N   int
+	Day time.Weekday
+}
+
+const maxOccurrences = 100           //The maximum number of occurrences in a preview
+const maxRulePeriods = 100 * 366     //Stop searching for occurrences after this number of periods
+const ruleDate string = "2006-01-02" //The date format of the start, until and exception dates
+
+var ruleWeekDays = map[string]time.Weekday{"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday}
+
+// The rules of the old repeat types
+var repeatRules = map[RepeatType]string{Daily: "FREQ=DAILY", Weekly: "FREQ=WEEKLY", Monthly: "FREQ=MONTHLY", Yearly: "FREQ=YEARLY"}
+
+// Parse a list of integers of a rule part
+func parseRuleInts(value string, min int, max int) ([]int, error) {
+	var list []int
+	for _, v := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < min || i > max || i == 0 {
+			return nil, errors.New("invalid value " + v)
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// Parse a recurrence rule like FREQ=WEEKLY;BYDAY=TU,TH;UNTIL=20270331
+func parseRRule(value string) (*RRule, error) {
+	r := &RRule{Interval: 1}
+	value = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "RRULE:")
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid rule part " + part)
+		}
+		var err error
+		switch kv[0] {
+		case "FREQ":
+			r.Freq = kv[1]
+		case "INTERVAL":
+			if r.Interval, err = strconv.Atoi(kv[1]); err == nil && r.Interval < 1 {
+				err = errors.New("invalid interval")
+			}
+		case "COUNT":
+			if r.Count, err = strconv.Atoi(kv[1]); err == nil && r.Count < 1 {
+				err = errors.New("invalid count")
+			}
+		case "UNTIL":
+			if len(kv[1]) < 8 {
+				return nil, errors.New("invalid until " + kv[1])
+			}
+			r.Until, err = time.Parse("20060102", kv[1][:8])
+		case "BYDAY":
+			for _, d := range strings.Split(kv[1], ",") {
+				if len(d) < 2 {
+					return nil, errors.New("invalid day " + d)
+				}
+				day, ok := ruleWeekDays[d[len(d)-2:]]
+				if !ok {
+					return nil, errors.New("invalid day " + d)
+				}
+				n := 0
+				if len(d) > 2 {
+					if n, err = strconv.Atoi(d[:len(d)-2]); err != nil || n == 0 || n < -53 || n > 53 {
+						return nil, errors.New("invalid day " + d)
+					}
+				}
+				r.ByDay = append(r.ByDay, ruleDay{N: n, Day: day})
+			}
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseRuleInts(kv[1], -31, 31)
+		case "BYMONTH":
+			r.ByMonth, err = parseRuleInts(kv[1], 1, 12)
+		case "WKST":
+			//Weeks always start on monday
+		default:
+			return nil, errors.New("unsupported rule part " + kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, errors.New("invalid frequency " + r.Freq)
+	}
+	if r.Count != 0 && !r.Until.IsZero() {
+		return nil, errors.New("count and until can not be combined")
+	}
+	return r, nil
+}
+
+// Check if the value is in the list, an empty list contains all values
+func ruleContains(list []int, value int) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the date is on one of the days, the ordinals are ignored
+func (r *RRule) onWeekDay(d time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, bd := range r.ByDay {
+		if bd.Day == d.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the date is on one of the month days
+func (r *RRule) onMonthDay(d time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	last := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, md := range r.ByMonthDay {
+		if md == d.Day() || last+md+1 == d.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+// The dates within the range matching the week days of the rule, the ordinals count within the range
+func (r *RRule) expandDays(first time.Time, last time.Time) []time.Time {
+	var dates []time.Time
+	for _, bd := range r.ByDay {
+		var matches []time.Time
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			if d.Weekday() == bd.Day {
+				matches = append(matches, d)
+			}
+		}
+		switch {
+		case bd.N == 0:
+			dates = append(dates, matches...)
+		case bd.N > 0 && bd.N <= len(matches):
+			dates = append(dates, matches[bd.N-1])
+		case bd.N < 0 && -bd.N <= len(matches):
+			dates = append(dates, matches[len(matches)+bd.N])
+		}
+	}
+	return dates
+}
+
+// The candidate dates of a month
+func (r *RRule) monthDates(year int, month time.Month, start time.Time) []time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	last := first.AddDate(0, 1, -1)
+	var dates []time.Time
+	switch {
+	case len(r.ByDay) > 0:
+		for _, d := range r.expandDays(first, last) {
+			if r.onMonthDay(d) {
+				dates = append(dates, d)
+			}
+		}
+	case len(r.ByMonthDay) > 0:
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			if r.onMonthDay(d) {
+				dates = append(dates, d)
+			}
+		}
+	case start.Day() <= last.Day():
+		dates = append(dates, time.Date(year, month, start.Day(), 0, 0, 0, 0, time.UTC))
+	}
+	return dates
+}
+
+// The candidate dates of the period, the period number counts the intervals from the start
+func (r *RRule) periodDates(start time.Time, period int) []time.Time {
+	var dates []time.Time
+	switch r.Freq {
+	case "DAILY":
+		d := start.AddDate(0, 0, period*r.Interval)
+		if r.onWeekDay(d) && r.onMonthDay(d) {
+			dates = append(dates, d)
+		}
+	case "WEEKLY":
+		monday := start.AddDate(0, 0, -((int(start.Weekday())+6)%7)+7*period*r.Interval)
+		for i := 0; i < 7; i++ {
+			d := monday.AddDate(0, 0, i)
+			if (len(r.ByDay) == 0 && d.Weekday() == start.Weekday()) || (len(r.ByDay) > 0 && r.onWeekDay(d)) {
+				dates = append(dates, d)
+			}
+		}
+	case "MONTHLY":
+		m := time.Date(start.Year(), start.Month()+time.Month(period*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+		dates = r.monthDates(m.Year(), m.Month(), start)
+	case "YEARLY":
+		year := start.Year() + period*r.Interval
+		switch {
+		case len(r.ByMonth) > 0:
+			for _, m := range r.ByMonth {
+				dates = append(dates, r.monthDates(year, time.Month(m), start)...)
+			}
+		case len(r.ByDay) > 0:
+			for _, d := range r.expandDays(time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)) {
+				if r.onMonthDay(d) {
+					dates = append(dates, d)
+				}
+			}
+		case len(r.ByMonthDay) > 0:
+			for m := time.January; m <= time.December; m++ {
+				dates = append(dates, r.monthDates(year, m, start)...)
+			}
+		default:
+			dates = r.monthDates(year, start.Month(), start)
+		}
+	}
+	var result []time.Time
+	for _, d := range dates {
+		if ruleContains(r.ByMonth, int(d.Month())) {
+			result = append(result, d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+	return result
+}
+
+// The next occurrences of the rule on or after the date, the exception dates are skipped but do count
+func (r *RRule) Occurrences(start time.Time, exdates map[string]bool, after time.Time, n int) []time.Time {
+	var result []time.Time
+	count := 0
+	for period := 0; period < maxRulePeriods && len(result) < n; period++ {
+		for _, d := range r.periodDates(start, period) {
+			if d.Before(start) {
+				continue
+			}
+			if (!r.Until.IsZero() && d.After(r.Until)) || (r.Count != 0 && count >= r.Count) {
+				return result
+			}
+			count++
+			if !d.Before(after) && !exdates[d.Format(ruleDate)] {
+				result = append(result, d)
+				if len(result) >= n {
+					return result
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Parse the comma separated exception dates
+func parseExDates(value string) (map[string]bool, error) {
+	exdates := map[string]bool{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		d, err := time.Parse(ruleDate, v)
+		if err != nil {
+			if d, err = time.Parse("20060102", v); err != nil {
+				return nil, errors.New("invalid exception date " + v)
+			}
+		}
+		exdates[d.Format(ruleDate)] = true
+	}
+	return exdates, nil
+}
+
+// The recurrence rule of the booking, the old repeat type is used when no rule is set
+func (b *BookingInterface) recurrence() (*RRule, error) {
+	if b.RRule != "" {
+		return parseRRule(b.RRule)
+	}
+	if rule, ok := repeatRules[b.Repeat]; ok {
+		return parseRRule(rule)
+	}
+	return nil, nil
+}
+
+// The next occurrences of the booking on or after the date
+func (b *BookingInterface) occurrences(after string, n int) ([]string, error) {
+	var list []string
+	rule, err := b.recurrence()
+	if err != nil || rule == nil {
+		return list, err
+	}
+	start, err := time.Parse(ruleDate, shortDate(iif(b.RepeatStart, b.Date)))
+	if err != nil {
+		return list, err
+	}
+	from, err := time.Parse(ruleDate, shortDate(after))
+	if err != nil {
+		return list, err
+	}
+	exdates, err := parseExDates(b.ExDates)
+	if err != nil {
+		return list, err
+	}
+	for _, d := range rule.Occurrences(start, exdates, from, n) {
+		list = append(list, d.Format(ruleDate))
+	}
+	return list, nil
+}
+
+// The date of the next occurrence after the current date of the booking, occurrences in the past are skipped
+func (b *BookingInterface) nextOccurrence() (string, bool) {
+	current, err := time.Parse(ruleDate, shortDate(b.Date))
+	if err != nil {
+		return "", false
+	}
+	today, _ := time.Parse(ruleDate, timeNow().Format(ruleDate))
+	after := current.AddDate(0, 0, 1)
+	if today.After(after) {
+		after = today
+	}
+	list, err := b.occurrences(after.Format(ruleDate), 1)
+	if err != nil || len(list) == 0 {
+		return "", false
+	}
+	return list[0], true
+}
+
+// Check the recurrence of a new or changed booking and move the date to the first occurrence
+func prepareRecurrence(b *BookingInterface) error {
+	b.RRule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(b.RRule)), "RRULE:")
+	if b.RRule == "" && b.Repeat == None {
+		b.RepeatStart = ""
+		return nil
+	}
+	b.RepeatStart = iif(b.RepeatStart, shortDate(b.Date))
+	list, err := b.occurrences(b.Date, 1)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return errors.New("the recurrence has no occurrences")
+	}
+	if list[0] != shortDate(b.Date) {
+		b.Date = list[0]
+	}
+	return nil
+}
+
+// The number of occurrences asked for in a preview
+func previewCount(c echo.Context) int {
+	n, err := strconv.Atoi(c.QueryParam("count"))
+	if err != nil || n < 1 {
+		return 10
+	}
+	return int(MinInt64(int64(n), maxOccurrences))
+}
+
+// The api previewing the occurrences of a recurrence rule or a booking
+func recurrenceRoutes(g *echo.Group) {
+	//Preview a rule: /rrule?rrule=FREQ=WEEKLY;BYDAY=TU,TH&start=2026-10-20&exdates=2026-12-24&count=10
+	g.GET("/rrule", func(c echo.Context) error {
+		b := BookingInterface{RRule: c.QueryParam("rrule"), ExDates: c.QueryParam("exdates"),
+			Date: iif(c.QueryParam("start"), timeNow().Format(ruleDate))}
+		if b.RRule == "" {
+			return c.String(http.StatusBadRequest, "Bad request.")
+		}
+		list, err := b.occurrences(b.Date, previewCount(c))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	//The next occurrences of a booking, starting with the current date
+	g.GET("/booking/:id/occurrences", func(c echo.Context) error {
+		team, err := getTeamByContext(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err)
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		booking, err := readBooking(db, id)
+		if err != nil || !team.Allowed(booking.Team, RoleViewer) {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+		list, err := booking.occurrences(booking.Date, previewCount(c))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if len(list) == 0 && booking.Repeat == None && booking.RRule == "" {
+			list = append(list, shortDate(booking.Date))
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+}
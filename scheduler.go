@@ -0,0 +1,592 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An entry in the scheduler queue, the booking is processed at epoch
+type scheduleItem struct {
+	id    int64 //The booking id
+	epoch int64 //The moment the booking becomes actionable
+	index int   //The index within the heap
+}
+
+// Priority queue of bookings ordered on the moment they become actionable
+type scheduleQueue []*scheduleItem
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].epoch < q[j].epoch }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *scheduleQueue) Push(x interface{}) {
+	item := x.(*scheduleItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// The scheduler wakes up exactly when a booking becomes actionable
+type Scheduler struct {
+	mutex   sync.Mutex
+	queue   scheduleQueue
+	items   map[int64]*scheduleItem //The queued bookings by id
+	running map[int64]bool          //The bookings being processed, true when notified while running
+	wake    chan struct{}           //Used to wake the scheduler on changes
+}
+
+var scheduler = newScheduler()       //The booking scheduler
+const resyncInterval = 1 * time.Hour //The interval we reload all bookings as safety net
+const maxSaveRetries = 3             //The number of times a changed booking is merged before the save fails
+
+// The fields of the reservation in my-fleet, the robot knows their real value so its changes are always kept
+var reservationFields = map[string]bool{"bookingid": true, "boatid": true, "bookstart": true, "bookdur": true, "bookedboat": true}
+
+func newScheduler() *Scheduler {
+	return &Scheduler{items: map[int64]*scheduleItem{}, running: map[int64]bool{}, wake: make(chan struct{}, 1)}
+}
+
+// Schedule the booking at the given epoch, replacing the existing entry
+func (s *Scheduler) Schedule(id int64, epoch int64) {
+	s.mutex.Lock()
+	if item, ok := s.items[id]; ok {
+		item.epoch = epoch
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item = &scheduleItem{id: id, epoch: epoch}
+		heap.Push(&s.queue, item)
+		s.items[id] = item
+	}
+	s.mutex.Unlock()
+	s.signal()
+}
+
+// Remove the booking from the schedule
+func (s *Scheduler) Remove(id int64) {
+	s.mutex.Lock()
+	if item, ok := s.items[id]; ok {
+		heap.Remove(&s.queue, item.index)
+		delete(s.items, id)
+	}
+	s.mutex.Unlock()
+}
+
+// Notify the scheduler the booking has been created, updated or canceled by the api
+func (s *Scheduler) Notify(id int64) {
+	if dryRunRecorder != nil {
+		dryRunRecorder.Forget(id)
+	}
+	s.mutex.Lock()
+	if _, ok := s.running[id]; ok {
+		//Process it again when the running action is finished
+		s.running[id] = true
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	s.Schedule(id, 0)
+}
+
+// Wake the scheduler loop without blocking
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reload all bookings from the database and calculate the moment they should be processed
+func (s *Scheduler) Reload() {
+	bookings := readBookings("")
+	s.mutex.Lock()
+	s.queue = scheduleQueue{}
+	s.items = map[int64]*scheduleItem{}
+	for i := range bookings {
+		if _, ok := s.running[bookings[i].Id]; ok {
+			continue
+		}
+		item := &scheduleItem{id: bookings[i].Id, epoch: bookingWakeTime(&bookings[i])}
+		heap.Push(&s.queue, item)
+		s.items[item.id] = item
+	}
+	s.mutex.Unlock()
+	s.signal()
+}
+
+// Take all bookings that are due from the queue and mark them as running
+func (s *Scheduler) popDue(now int64) []int64 {
+	var due []int64
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.queue) != 0 && s.queue[0].epoch <= now {
+		item := heap.Pop(&s.queue).(*scheduleItem)
+		delete(s.items, item.id)
+		s.running[item.id] = false
+		due = append(due, item.id)
+	}
+	return due
+}
+
+// The epoch of the first booking in the queue
+func (s *Scheduler) next() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.queue) == 0 {
+		return math.MaxInt64
+	}
+	return s.queue[0].epoch
+}
+
+// Run the scheduler loop, processing the bookings when they become actionable
+func (s *Scheduler) Run() {
+	log.Info("Start processing")
+	s.Reload()
+	resync := timeNow().Add(resyncInterval)
+	for {
+		//Sleep till the first booking is due, the next resync or a notify
+		wakeAt := resync
+		if next := s.next(); next != math.MaxInt64 && time.Unix(next, 0).Before(wakeAt) {
+			wakeAt = time.Unix(next, 0).Add(-time.Duration(sleepOffset) * time.Second)
+		}
+		if d := wakeAt.Sub(timeNow()); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				timer.Stop()
+				continue
+			}
+		}
+		//Get the local time zone
+		updateTimeZone()
+		if !timeNow().Before(resync) {
+			s.Reload()
+			resync = timeNow().Add(resyncInterval)
+			continue
+		}
+		s.process(s.popDue(timeNow().Unix() + int64(sleepOffset)))
+	}
+}
+
+// Process all bookings which are due once
+func (s *Scheduler) RunOnce() {
+	log.Info("Start processing")
+	s.Reload()
+	s.process(s.popDue(timeNow().Unix()))
+}
+
+// Process the bookings in parallel, save the changes and reschedule them
+func (s *Scheduler) process(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	start := time.Now()
+	defer func() { schedulerDuration.Observe(time.Since(start).Seconds()) }()
+	var bookingSlice, origSlice BookingSlice
+	for _, id := range ids {
+		b, err := readBooking(db, id)
+		if err != nil {
+			//Booking has been removed
+			s.finish(id, nil)
+			continue
+		}
+		//A dry run continues with the simulated booking
+		if dryRunRecorder != nil {
+			b = dryRunRecorder.Simulated(b)
+		}
+		bookingSlice = append(bookingSlice, *b)
+		origSlice = append(origSlice, *b)
+	}
+	logCount := make([]int, len(bookingSlice))
+	wg := sync.WaitGroup{}
+	for i := range bookingSlice {
+		logCount[i] = len(bookingSlice[i].Logs)
+		wg.Add(1)
+		//We process a booking in parallel
+		go func(booking *BookingInterface) {
+			defer wg.Done()
+			processBooking(booking)
+		}(&bookingSlice[i])
+	}
+	//Wait for all bookings to have finished
+	wg.Wait()
+
+	//Save the changed bookings one by one and reschedule them, a dry run only keeps the simulated booking
+	changed := false
+	for i := range bookingSlice {
+		b := &bookingSlice[i]
+		if dryRunRecorder != nil {
+			dryRunRecorder.Simulate(b)
+			s.finish(b.Id, b)
+			continue
+		}
+		if b.Changed {
+			changed = true
+			if err := saveBooking(&origSlice[i], b, b.Logs[logCount[i]:]); err != nil {
+				log.Error(err)
+			}
+			events.PublishBooking(b, b.Logs[logCount[i]:])
+		}
+		s.finish(b.Id, b)
+	}
+	if changed {
+		notifyBookings(bookingSlice)
+		updateGroups(bookingSlice)
+	}
+}
+
+// Merge the changes the robot made to the booking since base into the current booking stored by the api.
+// A field changed by both keeps the value of the api, except the reservation fields
+func mergeBooking(base *BookingInterface, b *BookingInterface, current *BookingInterface) {
+	bv, rv, cv := reflect.ValueOf(base).Elem(), reflect.ValueOf(b).Elem(), reflect.ValueOf(current).Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i).Tag.Get("db")
+		if field == "" || field == "-" || field == "id" || field == "logs" || field == "version" {
+			continue
+		}
+		robotChanged := !reflect.DeepEqual(rv.Field(i).Interface(), bv.Field(i).Interface())
+		apiChanged := !reflect.DeepEqual(cv.Field(i).Interface(), bv.Field(i).Interface())
+		if !robotChanged || (apiChanged && !reservationFields[field]) {
+			rv.Field(i).Set(cv.Field(i))
+		}
+	}
+	b.Version = current.Version
+}
+
+// Mark the booking as finished and schedule the next moment it should be processed
+func (s *Scheduler) finish(id int64, b *BookingInterface) {
+	s.mutex.Lock()
+	notified := s.running[id]
+	delete(s.running, id)
+	s.mutex.Unlock()
+	switch {
+	case notified:
+		s.Schedule(id, 0)
+	case b != nil && b.State != "Delete":
+		//Never retry within the refresh interval to prevent hammering my-fleet
+		s.Schedule(id, MaxInt64(bookingWakeTime(b), timeNow().Add(time.Duration(refreshInterval)*time.Second).Unix()))
+	}
+}
+
+// The seconds between two confirm retries, the retries are spread over the confirm window
+func confirmRetryInterval() int64 {
+	return MaxInt64(int64(refreshInterval), int64(confirmTime)*60/int64(maxRetry+1))
+}
+
+// Calculate the moment the booking becomes actionable
+func bookingWakeTime(b *BookingInterface) int64 {
+	if err := setBookingEpochs(b); err != nil {
+		//Invalid bookings are only processed again when changed
+		if b.State == "Failed" {
+			return math.MaxInt64
+		}
+		return 0
+	}
+	now := timeNow().Unix()
+	//A skipped booking resumes immediately when the blackout is removed
+	if b.State == "Skipped" && bookingBlackout(b) == nil {
+		return 0
+	}
+	if b.State == "Finished" || b.State == "Confirmed" || b.State == "Canceled" ||
+		b.State == "Failed" || b.State == "ConfirmFailed" || b.State == "Skipped" ||
+		b.State == "ExternallyModified" || reconcileTerminal(b.State) || b.EpochNext > now {
+		var wake int64 = math.MaxInt64
+		//The moment we should confirm
+		if (b.State == "Finished" || b.State == "ExternallyModified") && confirmTime != 0 {
+			confirm := time.Unix(b.EpochStart, 0).Add(-time.Duration(confirmTime) * time.Minute).Unix()
+			if b.EpochStart >= now {
+				wake = MaxInt64(confirm, now)
+			}
+		}
+		//The moment we should compare our reservation with the grid
+		if reconcileDue(b) {
+			wake = MinInt64(wake, now+int64(reconcileInterval)*60)
+		}
+		//The moment we should retry
+		if b.EpochNext > now && b.State != "Finished" && b.State != "Confirmed" && b.State != "Canceled" &&
+			b.State != "Failed" && b.State != "ConfirmFailed" && b.State != "Skipped" &&
+			b.State != "ExternallyModified" && !reconcileTerminal(b.State) {
+			wake = MinInt64(wake, b.EpochNext)
+			//The moment the book window opens for the minimal duration
+			if b.State == "Waiting" {
+				window := time.Unix(b.EpochStart, 0).Add(time.Duration(minDuration)*time.Minute - time.Duration(bookWindow)*time.Hour).Unix()
+				if window > now {
+					wake = MinInt64(wake, window)
+				}
+			}
+		}
+		//The moment we should repeat or delete the booking
+		if _, repeat := b.nextOccurrence(); repeat {
+			wake = MinInt64(wake, b.EpochEnd)
+		} else {
+			wake = MinInt64(wake, time.Unix(b.EpochEnd, 0).Add(time.Hour*24).Unix())
+		}
+		return wake
+	}
+	return 0
+}
+
+// Set the time zone, duration and the epochs of the booking
+func setBookingEpochs(booking *BookingInterface) error {
+	//Set the timezone
+	booking.TimeZone = timeZone
+
+	//Correct the duration automaticly
+	//Set the minimal duration
+	if booking.Duration < int64(minDuration) {
+		booking.Duration = int64(minDuration)
+	}
+	//Set the maximal duration
+	if booking.Duration > int64(maxDuration) {
+		booking.Duration = int64(maxDuration)
+	}
+
+	//Set the correct EpochDatas
+	thetime, err := time.Parse(time.RFC3339, shortDate(booking.Date)+"T00:00:00+00:00")
+	if err != nil {
+		booking.Message = "date not valid yyyy-MM-dd"
+		return err
+	}
+	booking.EpochDate = thetime.Unix()
+	thetime, err = time.Parse(time.RFC3339, shortDate(booking.Date)+"T"+shortTime(booking.Time)+":00"+booking.TimeZone)
+	if err != nil {
+		booking.Message = "time not valid hh:mm"
+		return err
+	}
+
+	//Save the real start time and end time of booking
+	booking.EpochStart = thetime.Unix()
+	booking.EpochEnd = thetime.Add(time.Minute * time.Duration(booking.Duration)).Unix()
+	return nil
+}
+
+// Process a single booking, all checks are done and the booking is made
+func processBooking(booking *BookingInterface) {
+	var err error
+	//At return we log if changed
+	defer func() {
+		//If data has been changed update the booking array
+		if booking.Changed {
+			if booking.State == "Retry" {
+				bookingRetries.WithLabelValues(booking.Team).Inc()
+				booking.EpochNext = 0 //On Retry Item we will not wait
+				booking.Retry++
+				if maxRetry == 0 || booking.Retry > maxRetry {
+					booking.State = "Blocked"
+				}
+			}
+			//Sleep the booking for at least 15 min, if we are not instructed to skip
+			if booking.State == "Blocked" {
+				booking.EpochNext = 0 //On Blocked  Item we will not wait
+				booking.Retry = 0
+			} else if booking.EpochNext <= timeNow().Unix() {
+				booking.EpochNext = MaxInt64(booking.EpochNext, timeNow().Add(15*time.Minute).Truncate(15*time.Minute).Unix())
+			}
+			loc, _ := time.LoadLocation(timeZoneLoc)
+			nextStr := time.Unix(booking.EpochNext, 0).In(loc).Format("15:04")
+			if err != nil {
+				log.WithFields(log.Fields{
+					"state": booking.State,
+					"boat":  booking.Name,
+					"user":  booking.Username,
+					"at":    shortDate(booking.Date),
+					"from":  shortTime(booking.Time),
+					"next":  shortTime(nextStr),
+					"unix":  timeNow().Unix(),
+				}).Error(err)
+			} else {
+				log.WithFields(log.Fields{
+					"state": booking.State,
+					"boat":  booking.Name,
+					"user":  booking.Username,
+					"at":    shortDate(booking.Date),
+					"from":  shortTime(booking.Time),
+					"next":  shortTime(nextStr),
+					"unix":  timeNow().Unix(),
+				}).Info(booking.Message)
+			}
+		}
+	}()
+
+	//Set the correct EpochDatas
+	if err = setBookingEpochs(booking); err != nil {
+		log.Error(booking.Message)
+		booking.State = "Failed"
+		booking.Changed = true
+		return
+	}
+
+	//Check if we should confirm the booking, or retry a failed confirmation
+	if (booking.State == "Finished" || booking.State == "ExternallyModified" || (booking.State == "ConfirmRetry" && booking.EpochNext <= timeNow().Unix())) && confirmTime != 0 &&
+		timeNow().Unix() >= time.Unix(booking.EpochStart, 0).Add(-time.Duration(confirmTime)*time.Minute).Unix() && timeNow().Unix() <= time.Unix(booking.EpochStart, 0).Unix() {
+		err = confirmBoat(booking)
+		if err == nil {
+			booking.State = "Confirmed"
+			booking.Message = "Booking confirmed"
+			booking.Retry = 0
+		} else {
+			booking.Message = "Confirm failed: " + err.Error()
+			booking.Retry++
+			//Like a booking the confirmation is retried maxRetry times
+			if maxRetry != 0 && booking.Retry <= maxRetry {
+				booking.State = "ConfirmRetry"
+				booking.EpochNext = timeNow().Unix() + confirmRetryInterval()
+			} else {
+				booking.State = "ConfirmFailed"
+				booking.Retry = 0
+			}
+		}
+		booking.Changed = true
+		booking.Logs = append(booking.Logs, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: booking.Message})
+		return
+	}
+
+	//A confirmation retry outside the confirm window has failed
+	if booking.State == "ConfirmRetry" && booking.EpochNext <= timeNow().Unix() {
+		booking.State = "ConfirmFailed"
+		booking.Message = "Confirm failed, confirm window passed"
+		booking.Retry = 0
+		booking.Changed = true
+		booking.Logs = append(booking.Logs, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: booking.Message})
+		return
+	}
+
+	//Skip the occurrence of a repeated booking within a blackout of the club, a removed blackout resumes it
+	switch booking.State {
+	case "", "Repeat", "Waiting", "Retry", "Blocked":
+		if bo := bookingBlackout(booking); bo != nil && booking.BookingId == "" {
+			booking.State = "Skipped"
+			booking.Message = "Skipped, club closed: " + iif(bo.Reason, "blackout")
+			booking.Changed = true
+			booking.Logs = append(booking.Logs, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: booking.Message})
+		}
+	case "Skipped":
+		if bookingBlackout(booking) == nil {
+			booking.State = ""
+			booking.Message = "Blackout removed, booking resumed"
+			booking.EpochNext = 0
+			booking.Changed = true
+			booking.Logs = append(booking.Logs, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: booking.Message})
+		}
+	}
+
+	//Check if have allready processed the booking, if so skip it. Our reservation is still compared with the grid
+	if (booking.State == "Finished" || booking.State == "Confirmed" || booking.State == "Canceled" ||
+		booking.State == "Failed" || booking.State == "ConfirmFailed" || booking.State == "Skipped" ||
+		booking.State == "ExternallyModified" || reconcileTerminal(booking.State) ||
+		booking.EpochNext > timeNow().Unix()) && !reconcileDue(booking) {
+		//Check if we should repeat this item on the next occurrence of the recurrence
+		next, repeat := "", false
+		if booking.EpochEnd < timeNow().Unix() {
+			next, repeat = booking.nextOccurrence()
+		}
+		if repeat {
+			booking.State = "Repeat"
+			booking.Message = "Booking is repeated on " + next
+			booking.Changed = true
+			booking.BookingId = ""
+			booking.BookedBoat = ""
+			booking.FallbackIndex = 0
+			booking.Date = next
+		} else
+		//Check if we should mark record for removal, after 24 hours
+		if booking.EpochEnd < timeNow().Add(-time.Hour*24).Unix() {
+			log.Debug("Delete", booking.EpochEnd, "<", timeNow().Add(-time.Hour*12).Unix())
+			booking.State = "Delete"
+			booking.Message = "Booking marked for Delete"
+			booking.Changed = true
+		}
+		//Nothing to do more with this booking
+		return
+	}
+
+	//Check if comment is set, if not fill default
+	team, err := getTeamByName(booking.Team)
+	if !booking.UserComment && err == nil && team.AddTime {
+		loc, _ := time.LoadLocation(timeZoneLoc)
+		booking.Comment = shortTime(booking.Time) + " - " + time.Unix(booking.EpochEnd, 0).In(loc).Format("15:04")
+	}
+
+	// doBooking
+	//Step 1: Login or reuse the session of the user
+	if err = fleetSessions.Acquire(booking); err != nil {
+		log.Error(err)
+		return
+	}
+	defer fleetSessions.Release(booking)
+
+	//We retry once with a new login when the session has expired
+	for attempt := 0; attempt < 2; attempt++ {
+		maxAge := 60
+		if attempt > 0 {
+			if err = fleetSessions.Renew(booking); err != nil {
+				log.Error(err)
+				return
+			}
+			maxAge = 0 //Force a reload of the boat list
+		}
+		//Step 2: Read all boat data if older than 60 seconds
+		_, boats := readBoatJson(booking, maxAge)
+		booking.Boats = &boats
+		if len(boats) == 0 {
+			if attempt == 0 {
+				continue //Could be a expired session
+			}
+			log.Error("ReadBoatJson returned empty list")
+			booking.State = "Retry"
+			booking.Message = "Boat list empty"
+			booking.Changed = true
+			break
+		}
+		//Step 3: Check if our reservation is canceled or changed outside the robot
+		if reconcileBooking(booking) {
+			booking.Changed = true
+			break
+		}
+		//A booked reservation is only compared with the grid
+		if reconcileDue(booking) {
+			break
+		}
+		//Step 4: Do the real Booking
+		booking.Changed, err = doBooking(booking)
+		if errors.Is(err, errSessionExpired) && attempt == 0 {
+			continue
+		}
+		if err != nil && booking.State == "Cancel" {
+			//A failed cancel is retried as cancel, the booking is never booked again
+			booking.Message = "Cancel failed: " + err.Error()
+			booking.Changed = !errors.Is(err, errSessionExpired)
+		} else if err != nil {
+			if maxRetry != 0 {
+				booking.State = "Retry"
+			} else {
+				booking.State = "Blocked"
+				booking.Message = err.Error()
+				booking.Changed = true
+			}
+		}
+		break
+	}
+
+	//Step 5: On Changed append the message to the log
+	if booking.Changed {
+		booking.Logs = append(booking.Logs, LogStruct{Date: timeNow().Unix(), State: booking.State, Log: booking.Message})
+	}
+}
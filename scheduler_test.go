@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// Run the booking logic on a fake clock standing still at the time, the settings are restored after the test
+func useFakeClock(t *testing.T, now string) *FakeClock {
+	t.Helper()
+	start, err := time.Parse(time.RFC3339, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeClock(start)
+	saved, settings := clock, []int{confirmTime, reconcileInterval, maxRetry, refreshInterval, minDuration, bookWindow}
+	t.Cleanup(func() {
+		clock = saved
+		confirmTime, reconcileInterval, maxRetry, refreshInterval, minDuration, bookWindow =
+			settings[0], settings[1], settings[2], settings[3], settings[4], settings[5]
+		updateTimeZone()
+	})
+	clock = fake
+	reconcileInterval = 0
+	updateTimeZone()
+	return fake
+}
+
+// Parse a RFC3339 time of a test case
+func testEpoch(t *testing.T, value string) int64 {
+	t.Helper()
+	if value == "max" {
+		return math.MaxInt64
+	}
+	e, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.Unix()
+}
+
+func TestBookingWakeTime(t *testing.T) {
+	cases := []struct {
+		name        string
+		confirmTime int
+		booking     BookingInterface
+		next        string //The EpochNext of the booking
+		wake        string //The expected wake time, empty=immediately
+	}{
+		{name: "new booking", booking: BookingInterface{Date: "2026-10-18", Time: "10:00", Duration: 90}},
+		{name: "finished booking is deleted a day after the end",
+			booking: BookingInterface{Date: "2026-10-18", Time: "10:00", Duration: 90, State: "Finished"},
+			wake:    "2026-10-19T11:30:00+02:00"},
+		{name: "finished booking is confirmed",
+			confirmTime: 30,
+			booking:     BookingInterface{Date: "2026-10-18", Time: "10:00", Duration: 90, State: "Finished"},
+			wake:        "2026-10-18T09:30:00+02:00"},
+		{name: "confirm within the confirm window is immediate",
+			confirmTime: 120,
+			booking:     BookingInterface{Date: "2026-10-17", Time: "10:00", Duration: 90, State: "Finished"},
+			wake:        "2026-10-17T09:00:00+02:00"},
+		{name: "failed confirmation is retried",
+			confirmTime: 120,
+			booking:     BookingInterface{Date: "2026-10-17", Time: "10:00", Duration: 90, State: "ConfirmRetry"},
+			next:        "2026-10-17T09:00:30+02:00",
+			wake:        "2026-10-17T09:00:30+02:00"},
+		{name: "waiting booking wakes when the book window opens",
+			booking: BookingInterface{Date: "2026-10-20", Time: "10:00", Duration: 90, State: "Waiting"},
+			next:    "2026-10-20T00:00:00+02:00",
+			wake:    "2026-10-18T11:00:00+02:00"},
+		{name: "repeated booking wakes at the end",
+			booking: BookingInterface{Date: "2026-10-18", Time: "10:00", Duration: 90, State: "Finished", RRule: "FREQ=WEEKLY"},
+			wake:    "2026-10-18T11:30:00+02:00"},
+		{name: "invalid date of a failed booking", booking: BookingInterface{Date: "2026-13-01", Time: "10:00", State: "Failed"},
+			wake: "max"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeClock(t, "2026-10-17T09:00:00+02:00")
+			confirmTime, minDuration, bookWindow = c.confirmTime, 60, 48
+			b := c.booking
+			if c.next != "" {
+				b.EpochNext = testEpoch(t, c.next)
+			}
+			var want int64
+			if c.wake != "" {
+				want = testEpoch(t, c.wake)
+			}
+			if got := bookingWakeTime(&b); got != want {
+				t.Fatalf("wake at %s, expected %s", time.Unix(got, 0).Format(time.RFC3339), c.wake)
+			}
+		})
+	}
+}
+
+// The fleet client of the replay refusing every confirmation
+type refusingFleetClient struct {
+	replayFleetClient
+}
+
+func (r *refusingFleetClient) Confirm(booking *BookingInterface) error {
+	return errors.New("refused")
+}
+
+func TestConfirmRetry(t *testing.T) {
+	fake := useFakeClock(t, "2026-10-17T09:00:00+02:00")
+	defer func(c MyFleetClient) { fleetClient = c }(fleetClient)
+	fleetClient = &refusingFleetClient{}
+	//The default retries and refresh interval with a confirm window of a hour
+	confirmTime = 60
+	b := BookingInterface{Date: "2026-10-17", Time: "10:00", Duration: 90, State: "Finished", BookingId: "1001", Username: "u1"}
+	//The first confirmation and every retry is retried spread over the confirm window, up to maxRetry times
+	interval := time.Duration(confirmTime*60/(maxRetry+1)) * time.Second
+	for i := 1; i <= maxRetry; i++ {
+		b.Changed = false
+		processBooking(&b)
+		if b.State != "ConfirmRetry" || b.Retry != i {
+			t.Fatalf("attempt %d: state %s, retry %d", i, b.State, b.Retry)
+		}
+		if want := fake.Now().Add(interval).Unix(); b.EpochNext != want || bookingWakeTime(&b) != want {
+			t.Fatalf("attempt %d: next %d, wake %d, expected %d", i, b.EpochNext, bookingWakeTime(&b), want)
+		}
+		fake.Advance(interval)
+	}
+	b.Changed = false
+	processBooking(&b)
+	if b.State != "ConfirmFailed" || b.Retry != 0 {
+		t.Fatalf("state %s, retry %d after %d retries", b.State, b.Retry, maxRetry)
+	}
+	if fake.Now().Unix() > b.EpochStart {
+		t.Fatal("retries beyond the start of the booking")
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	cases := []struct {
+		name    string
+		booking BookingInterface
+		after   string
+		want    []string
+	}{
+		{"weekly", BookingInterface{Date: "2026-10-17", RRule: "FREQ=WEEKLY"}, "2026-10-17",
+			[]string{"2026-10-17", "2026-10-24", "2026-10-31"}},
+		{"old repeat type", BookingInterface{Date: "2026-10-17", Repeat: Daily}, "2026-10-20",
+			[]string{"2026-10-20", "2026-10-21", "2026-10-22"}},
+		{"week days with exception", BookingInterface{Date: "2026-10-17", RRule: "FREQ=WEEKLY;BYDAY=TU,TH", ExDates: "2026-10-22"},
+			"2026-10-17", []string{"2026-10-20", "2026-10-27", "2026-10-29"}},
+		{"count includes the exceptions", BookingInterface{Date: "2026-10-17", RRule: "FREQ=DAILY;COUNT=3", ExDates: "20261018"},
+			"2026-10-17", []string{"2026-10-17", "2026-10-19"}},
+		{"until", BookingInterface{Date: "2026-10-17", RRule: "FREQ=WEEKLY;INTERVAL=2;UNTIL=20261101"}, "2026-10-17",
+			[]string{"2026-10-17", "2026-10-31"}},
+		{"last sunday of the month", BookingInterface{Date: "2026-10-01", RRule: "FREQ=MONTHLY;BYDAY=-1SU"}, "2026-10-01",
+			[]string{"2026-10-25", "2026-11-29", "2026-12-27"}},
+		{"last day of the month", BookingInterface{Date: "2027-01-31", RRule: "FREQ=MONTHLY;BYMONTHDAY=-1"}, "2027-01-31",
+			[]string{"2027-01-31", "2027-02-28", "2027-03-31"}},
+		{"friday the 13th", BookingInterface{Date: "2026-10-17", RRule: "FREQ=YEARLY;BYDAY=FR;BYMONTHDAY=13"}, "2026-10-17",
+			[]string{"2026-11-13", "2027-08-13", "2028-10-13"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.booking.occurrences(c.after, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("occurrences %v, expected %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("occurrences %v, expected %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBlackoutSkipsOccurrence(t *testing.T) {
+	openTestDB(t)
+	fake := useFakeClock(t, "2026-10-17T09:00:00+02:00")
+	bo := Blackout{Start: "2026-10-24", End: "2026-10-25", Reason: "Regatta"}
+	if err := withTx(func(tx *sql.Tx) error { return upsertBlackout(tx, &bo) }); err != nil {
+		t.Fatal(err)
+	}
+	b := BookingInterface{Date: "2026-10-17", Time: "07:00", Duration: 60, State: "Finished", RRule: "FREQ=WEEKLY",
+		BookingId: "1001", BookedBoat: "Lynx"}
+	//After the end the booking is repeated a week later, inside the blackout
+	fake.Set(time.Unix(testEpoch(t, "2026-10-18T08:00:00+02:00"), 0))
+	processBooking(&b)
+	if b.State != "Repeat" || b.Date != "2026-10-24" || b.BookingId != "" {
+		t.Fatalf("state %s on %s, expected a repeat on 2026-10-24", b.State, b.Date)
+	}
+	processBooking(&b)
+	if b.State != "Skipped" || b.Message != "Skipped, club closed: Regatta" {
+		t.Fatalf("state %s: %s, expected the occurrence to be skipped", b.State, b.Message)
+	}
+	if want := testEpoch(t, "2026-10-24T08:00:00+02:00"); bookingWakeTime(&b) != want {
+		t.Fatalf("skipped occurrence wakes at %d, expected the end %d", bookingWakeTime(&b), want)
+	}
+	//The occurrence after the blackout is booked again
+	fake.Set(time.Unix(testEpoch(t, "2026-10-24T09:00:00+02:00"), 0))
+	processBooking(&b)
+	if b.State != "Repeat" || b.Date != "2026-10-31" {
+		t.Fatalf("state %s on %s, expected a repeat on 2026-10-31", b.State, b.Date)
+	}
+	//A removed blackout resumes a skipped occurrence immediately
+	b.Date, b.State = "2026-10-24", "Skipped"
+	fake.Set(time.Unix(testEpoch(t, "2026-10-20T09:00:00+02:00"), 0))
+	if _, err := db.Exec("DELETE FROM blackouts"); err != nil {
+		t.Fatal(err)
+	}
+	if got := bookingWakeTime(&b); got != 0 {
+		t.Fatalf("skipped booking without blackout wakes at %d", got)
+	}
+}
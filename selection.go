@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Check if the booking asks for any boat matching the type, weight class and location instead of a named boat
+func (b *BookingInterface) byCriteria() bool {
+	return b.Name == "" && (b.BoatType != "" || b.WeightClass != "" || b.Location != "")
+}
+
+// The name of the boat for messages, the booked boat, the requested boat or the criteria
+func (b *BookingInterface) BoatLabel() string {
+	if b.BookedBoat != "" {
+		return b.BookedBoat
+	}
+	if !b.byCriteria() {
+		return b.Name
+	}
+	label := iif(b.BoatType, "boat")
+	if b.WeightClass != "" {
+		label += " " + b.WeightClass
+	}
+	if b.Location != "" {
+		label += " at " + b.Location
+	}
+	return label
+}
+
+// Check if the crew holds the permission required for the boat
+func hasPermission(b *BookingInterface, bs *BoatElementStruct) bool {
+	if bs.Permission == "" {
+		return true
+	}
+	for _, p := range strings.Split(b.Permissions, ",") {
+		if strings.EqualFold(strings.TrimSpace(p), bs.Permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the boat matches the criteria of the booking
+func boatMatches(b *BookingInterface, bs *BoatElementStruct) bool {
+	return (b.BoatType == "" || strings.EqualFold(bs.Type, b.BoatType)) &&
+		(b.WeightClass == "" || strings.EqualFold(bs.WeigthClass, b.WeightClass)) &&
+		(b.Location == "" || strings.EqualFold(bs.Location, b.Location)) &&
+		hasPermission(b, bs)
+}
+
+// The boats of the boat list matching the criteria of the booking
+func matchingBoats(b *BookingInterface) []*BoatElementStruct {
+	var list []*BoatElementStruct
+	if b.Boats == nil {
+		return list
+	}
+	for i := range *b.Boats {
+		if boatMatches(b, &(*b.Boats)[i]) {
+			list = append(list, &(*b.Boats)[i])
+		}
+	}
+	return list
+}
+
+// The free time around the booking on the boat, -1 when a reservation of someone else overlaps
+func freeWindow(b *BookingInterface, bs *BoatElementStruct) int64 {
+	var before int64 = 0
+	var after int64 = math.MaxInt64
+	for _, bb := range bs.Bookings {
+		if bb.Type != "R" || bb.BookingId == b.BookingId {
+			continue
+		}
+		if bb.EpochStart < b.EpochEnd && bb.EpochEnd > b.EpochStart {
+			return -1
+		}
+		if bb.EpochEnd <= b.EpochStart {
+			before = MaxInt64(before, bb.EpochEnd)
+		} else {
+			after = MinInt64(after, bb.EpochStart)
+		}
+	}
+	//Limit to the day, so a free boat does not overflow
+	before = MaxInt64(before, b.EpochStart-24*3600)
+	after = MinInt64(after, b.EpochEnd+24*3600)
+	return after - before
+}
+
+// Select the best available boat matching the criteria, the boat with the largest free window
+// around the booking is preferred so it can be moved or extended. The boat that just failed is skipped.
+func selectBoat(b *BookingInterface) *BoatElementStruct {
+	var best *BoatElementStruct
+	var bestWindow int64 = -1
+	for _, bs := range matchingBoats(b) {
+		if b.FallbackIndex > 0 && b.BookingId == "" && b.BoatId == strconv.Itoa(bs.Id) {
+			continue
+		}
+		if w := freeWindow(b, bs); w > bestWindow {
+			best, bestWindow = bs, w
+		}
+	}
+	return best
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FleetSession is an authenticated my-fleet session of a single user
+type FleetSession struct {
+	mutex         sync.Mutex     //Only one booking at the time may use the session
+	Username      string         //The my-fleet user of the session
+	Password      [32]byte       //The hash of the password used to login, a change will force a new login
+	Jar           http.CookieJar //The cookies of the session
+	GuiEpochStart int64          //The start of the gui grid of the session
+	GuiFleetId    string         //The gui id of the session
+	UserId        int64          //The my-fleet user id
+	LoginAt       time.Time      //The time of login
+	LastUsed      time.Time      //The time the session was last used
+}
+
+// SessionManager keeps the authenticated sessions per user, so bookings can reuse them
+type SessionManager struct {
+	mutex    sync.Mutex
+	sessions map[string]*FleetSession
+}
+
+var sessionTimeout int = 15 //Time in minutes an idle my-fleet session is reused
+var fleetSessions = &SessionManager{sessions: map[string]*FleetSession{}}
+
+// Get the session of the user, create a empty one if it does not exists
+func (m *SessionManager) get(username string) *FleetSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := strings.ToLower(username)
+	s, ok := m.sessions[key]
+	if !ok {
+		s = &FleetSession{Username: username}
+		m.sessions[key] = s
+	}
+	return s
+}
+
+// The hash of the decrypted password of the booking
+func sessionPassword(booking *BookingInterface) [32]byte {
+	password, _ := decryptSecret(booking.Password)
+	return sha256.Sum256([]byte(password))
+}
+
+// Check if the session is still usable for the booking
+func (s *FleetSession) valid(booking *BookingInterface) bool {
+	return s.Jar != nil && s.Password == sessionPassword(booking) &&
+		time.Since(s.LastUsed) < time.Duration(sessionTimeout)*time.Minute
+}
+
+// Log the state of a session
+func (s *FleetSession) log(state string) {
+	log.WithFields(log.Fields{
+		"user":    s.Username,
+		"session": state,
+		"age":     time.Since(s.LoginAt).Truncate(time.Second).String(),
+	}).Debug("My-fleet session " + state)
+}
+
+// Acquire the session of the booking user, login when there is no valid session.
+// The session is locked until Release is called
+func (m *SessionManager) Acquire(booking *BookingInterface) error {
+	s := m.get(booking.Username)
+	s.mutex.Lock()
+	if s.valid(booking) {
+		s.log("reused")
+	} else {
+		if s.Jar != nil {
+			s.log("expired")
+		}
+		if err := s.login(booking); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+	booking.Jar = s.Jar
+	booking.GuiEpochStart = s.GuiEpochStart
+	booking.GuiFleetId = s.GuiFleetId
+	booking.UserId = s.UserId
+	s.LastUsed = time.Now()
+	return nil
+}
+
+// Renew the acquired session of the booking user with a new login
+func (m *SessionManager) Renew(booking *BookingInterface) error {
+	s := m.get(booking.Username)
+	s.log("renew")
+	return s.login(booking)
+}
+
+// Login the booking user and store the session
+func (s *FleetSession) login(booking *BookingInterface) error {
+	s.Jar = nil
+	booking.Jar = nil
+	if err := fleetClient.Login(booking); err != nil {
+		return err
+	}
+	s.Password = sessionPassword(booking)
+	s.Jar = booking.Jar
+	s.GuiEpochStart = booking.GuiEpochStart
+	s.GuiFleetId = booking.GuiFleetId
+	s.UserId = booking.UserId
+	s.LoginAt = time.Now()
+	s.LastUsed = s.LoginAt
+	s.log("login")
+	return nil
+}
+
+// Release the session of the booking user
+func (m *SessionManager) Release(booking *BookingInterface) {
+	s := m.get(booking.Username)
+	s.LastUsed = time.Now()
+	s.mutex.Unlock()
+}
+
+// Logout all sessions
+func (m *SessionManager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.sessions {
+		s.mutex.Lock()
+		if s.Jar != nil {
+			fleetClient.Logout(&BookingInterface{Username: s.Username, Jar: s.Jar})
+			s.log("logout")
+		}
+		s.Jar = nil
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var dsn string = "" //The data source, a postgres:// url, a sqlite:// file or empty for the default SQLite file
+var storage Storage //The storage backend of the database
+
+// Start the embedded postgres server used by -dsn=embedded, only available when build with -tags embedpg
+var startEmbedded = func() (string, error) {
+	return "", errors.New("the embedded postgres server requires a build with -tags embedpg")
+}
+var stopEmbedded = func() {} //Stop the embedded postgres server
+
+// The storage backend of the database. The queries of the robot are written for SQLite with ? placeholders,
+// the backend translates them to its own dialect
+type Storage interface {
+	Dialect() string                                                      //The dialect, also used for the whatsapp store
+	Open() (*sql.DB, error)                                               //Open the database
+	Migration(statement string) string                                    //Translate a migration of the schema
+	InsertId(tx execer, query string, args ...interface{}) (int64, error) //Insert a row and return the new id
+	SyncIds(tx execer, table string) error                                //Continue the ids after a row is inserted with its id
+	String() string                                                       //The description without password
+}
+
+// Select the storage backend of the data source
+func newStorage(source string) Storage {
+	if strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://") {
+		return postgresStorage{dsn: source}
+	}
+	return sqliteStorage{file: iif(strings.TrimPrefix(source, "sqlite://"), dbFile)}
+}
+
+// The SQLite backend, the default using a single file
+type sqliteStorage struct {
+	file string
+}
+
+func (s sqliteStorage) Dialect() string {
+	return "sqlite3"
+}
+
+func (s sqliteStorage) Open() (*sql.DB, error) {
+	//Create the db path if it does not exists
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+s.file+"?_foreign_keys=on")
+}
+
+func (s sqliteStorage) Migration(statement string) string {
+	return statement
+}
+
+func (s sqliteStorage) InsertId(tx execer, query string, args ...interface{}) (int64, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s sqliteStorage) SyncIds(tx execer, table string) error {
+	return nil
+}
+
+func (s sqliteStorage) String() string {
+	return "sqlite " + s.file
+}
+
+// The PostgreSQL backend, can be shared by several instances
+type postgresStorage struct {
+	dsn string
+}
+
+func (s postgresStorage) Dialect() string {
+	return "postgres"
+}
+
+func (s postgresStorage) Open() (*sql.DB, error) {
+	connector, err := pq.NewConnector(s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(rebindConnector{next: connector}), nil
+}
+
+func (s postgresStorage) Migration(statement string) string {
+	//The ids are assigned by a sequence and the times need 64 bits
+	statement = strings.ReplaceAll(statement, "INTEGER PRIMARY KEY", "BIGSERIAL PRIMARY KEY")
+	return strings.ReplaceAll(statement, "INTEGER", "BIGINT")
+}
+
+func (s postgresStorage) InsertId(tx execer, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRow(query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+func (s postgresStorage) SyncIds(tx execer, table string) error {
+	_, err := tx.Exec("SELECT setval(pg_get_serial_sequence('" + table + "', 'id'), " +
+		"COALESCE((SELECT MAX(id) FROM " + table + "), 0) + 1, false)")
+	return err
+}
+
+func (s postgresStorage) String() string {
+	if u, err := url.Parse(s.dsn); err == nil {
+		return "postgres " + u.Redacted()
+	}
+	return "postgres"
+}
+
+// Replace the ? placeholders by the numbered placeholders of postgres, quoted text is kept
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var sb strings.Builder
+	n, quoted := 0, false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// The connector of the postgres driver accepting the ? placeholders
+type rebindConnector struct {
+	next driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.next.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn}, nil
+}
+
+func (c rebindConnector) Driver() driver.Driver {
+	return c.next.Driver()
+}
+
+// The connection of the postgres driver, every query is rebound before it is send
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, rebind(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c rebindConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c rebindConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// A single check of the storage backend
+type storageCheck struct {
+	name string
+	run  func(tx *sql.Tx, team string) error
+}
+
+// Compare a value read back from the database
+func expect(what string, got interface{}, want interface{}) error {
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("%s is %v, expected %v", what, got, want)
+	}
+	return nil
+}
+
+// The checks of the storage backend, every check runs in a own transaction that is rolled back
+var storageChecks = []storageCheck{
+	{"team", func(tx *sql.Tx, team string) error {
+		t := TeamInterface{Team: team, Title: "Check", Password: "x", WhatsApp: true}
+		if _, err := insertTeam(tx, &t, false); err != nil {
+			return err
+		}
+		t.Title, t.Planner = "Changed", true
+		if err := updateTeam(tx, &t); err != nil {
+			return err
+		}
+		var title string
+		var planner bool
+		if err := tx.QueryRow("SELECT title, planner FROM teams WHERE id = ?", t.Id).Scan(&title, &planner); err != nil {
+			return err
+		}
+		if err := expect("title", title, "Changed"); err != nil {
+			return err
+		}
+		if err := expect("planner", planner, true); err != nil {
+			return err
+		}
+		return deleteTeam(tx, &t)
+	}},
+	{"team with id", func(tx *sql.Tx, team string) error {
+		//A row inserted with its id must not break the ids assigned later
+		t := TeamInterface{Team: team, Title: "Check"}
+		if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM teams").Scan(&t.Id); err != nil {
+			return err
+		}
+		if _, err := insertTeam(tx, &t, true); err != nil {
+			return err
+		}
+		next := TeamInterface{Team: team + "-next", Title: "Check"}
+		if _, err := insertTeam(tx, &next, false); err != nil {
+			return err
+		}
+		if next.Id <= t.Id {
+			return errors.New("id " + strconv.FormatInt(next.Id, 10) + " assigned after id " + strconv.FormatInt(t.Id, 10))
+		}
+		return nil
+	}},
+	{"user", func(tx *sql.Tx, team string) error {
+		if err := touchUser(tx, team, "Check", "secret", ""); err != nil {
+			return err
+		}
+		if err := touchUser(tx, team, "check", "changed", ""); err != nil {
+			return err
+		}
+		password, err := readUserPassword(tx, team, "CHECK")
+		if err != nil {
+			return err
+		}
+		if err = expect("password", password, "changed"); err != nil {
+			return err
+		}
+		u := UserInterface{Team: team, Username: "other", Name: "Other", LastUsed: timeNow().Unix()}
+		if _, err = insertUser(tx, &u, false); err != nil {
+			return err
+		}
+		read, err := readUser(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		if err = expect("name", read.Name, "Other"); err != nil {
+			return err
+		}
+		return deleteUser(tx, u.Id)
+	}},
+	{"account", func(tx *sql.Tx, team string) error {
+		a := AccountInterface{Team: team, Username: "check", Name: "Check", Role: RoleMember.String()}
+		if _, err := insertAccount(tx, &a); err != nil {
+			return err
+		}
+		if _, err := insertAccount(tx, &AccountInterface{Team: team, Username: "check"}); err == nil {
+			return errors.New("duplicate account accepted")
+		}
+		return nil
+	}},
+	{"booking", func(tx *sql.Tx, team string) error {
+		b := BookingInterface{Team: team, Name: "Check", Fallbacks: []string{"A", "B"}, Date: "2024-06-01",
+			Time: "10:00", Duration: 90, State: "Pending", UserComment: true, BookStart: 1717228800}
+		if _, err := insertBooking(tx, &b, false); err != nil {
+			return err
+		}
+		if err := insertBookingLog(tx, b.Id, LogStruct{Date: 1717228800, State: "Pending", Log: "Check"}); err != nil {
+			return err
+		}
+		b.State = "Finished"
+		if err := updateBooking(tx, &b); err != nil {
+			return err
+		}
+		read, err := readBooking(tx, b.Id)
+		if err != nil {
+			return err
+		}
+		for _, e := range []error{expect("state", read.State, "Finished"), expect("fallbacks", read.Fallbacks, b.Fallbacks),
+			expect("bookstart", read.BookStart, b.BookStart), expect("logs", len(read.Logs), 1), expect("version", read.Version, 2)} {
+			if e != nil {
+				return e
+			}
+		}
+		//A update of a outdated version is rejected
+		stale := *read
+		stale.Version = 1
+		if err = updateBooking(tx, &stale); !errors.Is(err, errBookingConflict) {
+			return fmt.Errorf("update of a outdated version returned %v", err)
+		}
+		if err = deleteBooking(tx, b.Id); err != nil {
+			return err
+		}
+		if _, err = readBooking(tx, b.Id); !errors.Is(err, sql.ErrNoRows) {
+			return errors.New("deleted booking still found")
+		}
+		return nil
+	}},
+	{"group", func(tx *sql.Tx, team string) error {
+		g := BookingGroup{Team: team, Name: "Check", Minimum: 2, State: "Pending"}
+		if _, err := insertBookingGroup(tx, &g); err != nil {
+			return err
+		}
+		read, err := readBookingGroup(tx, g.Id)
+		if err != nil {
+			return err
+		}
+		if err = expect("minimum", read.Minimum, 2); err != nil {
+			return err
+		}
+		return deleteBookingGroup(tx, g.Id)
+	}},
+	{"notify", func(tx *sql.Tx, team string) error {
+		n := NotifyChannel{Team: team, Type: "ntfy", Target: "check", Enabled: true}
+		if _, err := insertNotifyChannel(tx, &n); err != nil {
+			return err
+		}
+		n.Enabled = false
+		if err := updateNotifyChannel(tx, &n); err != nil {
+			return err
+		}
+		read, err := readNotifyChannel(tx, n.Id)
+		if err != nil {
+			return err
+		}
+		if err = expect("enabled", read.Enabled, false); err != nil {
+			return err
+		}
+		return deleteNotifyChannel(tx, n.Id)
+	}},
+	{"blackout", func(tx *sql.Tx, team string) error {
+		bo := Blackout{Start: "2099-01-01", End: "2099-01-02", Reason: "Check", Uid: team}
+		if err := upsertBlackout(tx, &bo); err != nil {
+			return err
+		}
+		bo.Reason = "Changed"
+		if err := upsertBlackout(tx, &bo); err != nil {
+			return err
+		}
+		read, err := readBlackoutAt(tx, "2099-01-02")
+		if err != nil {
+			return err
+		}
+		return expect("reason", read.Reason, "Changed")
+	}},
+	{"setting", func(tx *sql.Tx, team string) error {
+		for _, v := range []string{"first", "second"} {
+			if err := writeSetting(tx, team, v); err != nil {
+				return err
+			}
+		}
+		value, err := readSetting(tx, team)
+		if err != nil {
+			return err
+		}
+		return expect("setting", value, "second")
+	}},
+	{"audit", func(tx *sql.Tx, team string) error {
+		a := AuditEntry{Time: timeNow().Unix(), Team: team, Actor: robotActor, Action: "Check", Diff: []byte(`{"a":[1,2]}`)}
+		if _, err := insertAudit(tx, &a); err != nil {
+			return err
+		}
+		var diff string
+		if err := tx.QueryRow("SELECT diff FROM audit WHERE id = ?", a.Id).Scan(&diff); err != nil {
+			return err
+		}
+		return expect("diff", diff, string(a.Diff))
+	}},
+	{"quoted placeholder", func(tx *sql.Tx, team string) error {
+		var text string
+		if err := tx.QueryRow("SELECT 'a?b' || CAST(? AS TEXT)", team).Scan(&text); err != nil {
+			return err
+		}
+		return expect("text", text, "a?b"+team)
+	}},
+}
+
+// Run every check in a own transaction that is rolled back, the data in the database is not changed
+func runStorageChecks(t *testing.T) {
+	team := "storage-check-" + strconv.FormatInt(timeNow().UnixNano(), 36)
+	for _, c := range storageChecks {
+		t.Run(c.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err = c.run(tx, team); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	//The reads outside a transaction
+	if err := expect("bookings", len(readBookings(team)), 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorageSQLite(t *testing.T) {
+	openTestDB(t)
+	runStorageChecks(t)
+}
+
+// The PostgreSQL database is set by TESTDSN, a url or embedded for the embedded server of a build with -tags embedpg
+func TestStoragePostgres(t *testing.T) {
+	dsn := os.Getenv("TESTDSN")
+	if dsn == "" {
+		t.Skip("no PostgreSQL database, set TESTDSN")
+	}
+	if dsn == "embedded" {
+		var err error
+		if dsn, err = startEmbedded(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(stopEmbedded)
+	}
+	openTestStorage(t, dsn)
+	if storage.Dialect() != "postgres" {
+		t.Fatalf("TESTDSN is a %s database", storage.Dialect())
+	}
+	runStorageChecks(t)
+}
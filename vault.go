@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The credential vault encrypts the my-fleet passwords of the members and the notification channel secrets stored in the database.
+// A stored secret looks like enc:v1:<key id>:<base64 nonce+ciphertext>
+const vaultPrefix = "enc:v1:"
+
+// The table and column of every secret stored by the vault
+var vaultColumns = [][2]string{{"users", "password"}, {"bookings", "password"}, {"notify_channels", "secret"}}
+
+var vaultKeyFile string = dbPath + "vault.key" //The file holding the vault key, when not set by VAULTKEY
+var rotateVaultKey string                      //The file with the new vault key to rotate to, empty=disabled
+
+// A vault key
+type vaultKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var vault *vaultKey
+
+// Create a vault key from the key material
+func newVaultKey(material string) (*vaultKey, error) {
+	material = strings.TrimSpace(material)
+	if material == "" {
+		return nil, errors.New("empty vault key")
+	}
+	key := sha256.Sum256([]byte(material))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(key[:])
+	return &vaultKey{id: hex.EncodeToString(id[:4]), aead: aead}, nil
+}
+
+// Read the key material from the file, a new random key is created when the file does not exist
+func readVaultKeyFile(fileName string) (string, error) {
+	b, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		r := make([]byte, 32)
+		if _, err = rand.Read(r); err != nil {
+			return "", err
+		}
+		material := base64.StdEncoding.EncodeToString(r)
+		if err = os.WriteFile(fileName, []byte(material+"\n"), 0600); err != nil {
+			return "", err
+		}
+		log.Info("Created new vault key file ", fileName)
+		return material, nil
+	}
+	return string(b), err
+}
+
+// Load the vault key from the VAULTKEY environment variable or the key file
+func loadVaultKey() error {
+	material := os.Getenv("VAULTKEY")
+	if material == "" {
+		var err error
+		if material, err = readVaultKeyFile(vaultKeyFile); err != nil {
+			return err
+		}
+	}
+	key, err := newVaultKey(material)
+	if err != nil {
+		return err
+	}
+	vault = key
+	return nil
+}
+
+// Check if the value is encrypted by the vault
+func isSecret(value string) bool {
+	return strings.HasPrefix(value, vaultPrefix)
+}
+
+// Encrypt a secret with the key
+func (k *vaultKey) encrypt(plain string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), []byte(k.id))
+	return vaultPrefix + k.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a secret with the key
+func (k *vaultKey) decrypt(secret string) (string, error) {
+	s := strings.SplitN(strings.TrimPrefix(secret, vaultPrefix), ":", 2)
+	if len(s) != 2 {
+		return "", errors.New("invalid vault secret")
+	}
+	if s[0] != k.id {
+		return "", errors.New("vault secret encrypted with unknown key " + s[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < k.aead.NonceSize() {
+		return "", errors.New("invalid vault secret")
+	}
+	plain, err := k.aead.Open(nil, sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():], []byte(k.id))
+	return string(plain), err
+}
+
+// Encrypt a password before storing it, empty and already encrypted values are kept
+func encryptSecret(plain string) (string, error) {
+	if plain == "" || isSecret(plain) {
+		return plain, nil
+	}
+	if vault == nil {
+		return "", errors.New("vault not loaded")
+	}
+	return vault.encrypt(plain)
+}
+
+// Decrypt a stored password at the moment it is used
+func decryptSecret(secret string) (string, error) {
+	if !isSecret(secret) {
+		return secret, nil
+	}
+	if vault == nil {
+		return "", errors.New("vault not loaded")
+	}
+	return vault.decrypt(secret)
+}
+
+// Re encrypt all stored secrets, plain text secrets are encrypted with the new key
+func reencryptSecrets(tx *sql.Tx, from *vaultKey, to *vaultKey) (int, error) {
+	count := 0
+	for _, tc := range vaultColumns {
+		table, column := tc[0], tc[1]
+		rows, err := tx.Query("SELECT id, " + column + " FROM " + table + " WHERE " + column + " <> ''")
+		if err != nil {
+			return count, err
+		}
+		secrets := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var password string
+			if err = rows.Scan(&id, &password); err != nil {
+				rows.Close()
+				return count, err
+			}
+			secrets[id] = password
+		}
+		rows.Close()
+		for id, password := range secrets {
+			if isSecret(password) {
+				if from == nil || strings.HasPrefix(password, vaultPrefix+to.id+":") {
+					continue
+				}
+				if password, err = from.decrypt(password); err != nil {
+					return count, errors.New(table + " " + err.Error())
+				}
+			}
+			if password, err = to.encrypt(password); err != nil {
+				return count, err
+			}
+			if _, err = tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE id = ?", password, id); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Encrypt the plain text secrets still in the database
+func migrateSecrets() error {
+	return withTx(func(tx *sql.Tx) error {
+		count, err := reencryptSecrets(tx, nil, vault)
+		if count > 0 {
+			log.Info("Encrypted ", count, " stored secrets")
+		}
+		return err
+	})
+}
+
+// Rotate the vault key to the key in the given file, all secrets are encrypted with the new key
+func rotateVault(fileName string) error {
+	material, err := readVaultKeyFile(fileName)
+	if err != nil {
+		return err
+	}
+	key, err := newVaultKey(material)
+	if err != nil {
+		return err
+	}
+	if key.id == vault.id {
+		return errors.New("new vault key is the same as the current key")
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		count, err := reencryptSecrets(tx, vault, key)
+		log.Info("Re-encrypted ", count, " stored secrets")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	vault = key
+	//Replace the current key file, the old key is kept as backup
+	if os.Getenv("VAULTKEY") != "" {
+		log.Warn("Vault key rotated, set VAULTKEY to the contents of ", fileName)
+		return nil
+	}
+	if old, err := os.ReadFile(vaultKeyFile); err == nil {
+		os.WriteFile(vaultKeyFile+".old", old, 0600)
+	}
+	if err = os.WriteFile(vaultKeyFile, []byte(strings.TrimSpace(material)+"\n"), 0600); err != nil {
+		return err
+	}
+	log.Info("Vault key rotated, new key stored in ", vaultKeyFile)
+	return nil
+}
+
+// Remove the passwords of the bookings before sending them
+func publicBookings(list BookingSlice) BookingSlice {
+	result := make(BookingSlice, len(list))
+	for i, b := range list {
+		b.Password = ""
+		result[i] = b
+	}
+	return result
+}
+
+// Remove the passwords of the users before sending them
+func publicUsers(list []UserInterface) []UserInterface {
+	result := make([]UserInterface, len(list))
+	for i, u := range list {
+		u.Password = ""
+		result[i] = u
+	}
+	return result
+}
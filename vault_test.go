@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Read the stored notify channel secret and check it decrypts with the current vault key
+func checkChannelSecret(t *testing.T, id int64, plain string) string {
+	t.Helper()
+	c, err := readNotifyChannel(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSecret(c.Secret) {
+		t.Fatalf("secret %q stored in plain text", c.Secret)
+	}
+	if got, err := decryptSecret(c.Secret); err != nil || got != plain {
+		t.Fatalf("secret decrypts to %q, %v", got, err)
+	}
+	return c.Secret
+}
+
+func TestVaultNotifySecret(t *testing.T) {
+	openTestDB(t)
+	defer func(v *vaultKey, file string) { vault, vaultKeyFile = v, file }(vault, vaultKeyFile)
+	t.Setenv("VAULTKEY", "")
+	dir := t.TempDir()
+	vaultKeyFile = filepath.Join(dir, "vault.key")
+	if err := loadVaultKey(); err != nil {
+		t.Fatal(err)
+	}
+	//A secret stored before the vault existed is encrypted by the migration
+	c := NotifyChannel{Team: "t1", Type: "webhook", Target: "http://localhost/hook", Secret: "hook-key", Enabled: true}
+	if err := withTx(func(tx *sql.Tx) error { _, err := insertNotifyChannel(tx, &c); return err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	old := checkChannelSecret(t, c.Id, "hook-key")
+	//The rotation encrypts it with the new key
+	newKey := filepath.Join(dir, "new.key")
+	if err := os.WriteFile(newKey, []byte("rotated key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotateVault(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if rotated := checkChannelSecret(t, c.Id, "hook-key"); rotated == old {
+		t.Fatal("secret not re-encrypted by the rotation")
+	}
+}